@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/resolve"
+	"github.com/VolatileDream/workbench/web/network-monitor/trace"
+)
+
+// Largest ttl that can be set on a packet, hops past it can't be traced.
+const maxTTL = 255
+
+// checkConfig loads the config and prints the problems found in it, for
+// validating configs without starting the monitor. Returns the exit code of
+// the process.
+func checkConfig(out io.Writer) int {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Fprintf(out, "could not load config: %v\n", err)
+		return 1
+	}
+
+	problems := configProblems(cfg)
+	for _, p := range problems {
+		fmt.Fprintf(out, "%s\n", p)
+	}
+	if len(problems) > 0 {
+		fmt.Fprintf(out, "config has %d problem(s)\n", len(problems))
+		return 1
+	}
+	fmt.Fprintf(out, "config ok: %d targets\n", len(cfg.Targets))
+	return 0
+}
+
+// configProblems returns the problems that parsing doesn't catch, because
+// they depend on flags or other settings.
+func configProblems(cfg *config.Config) []string {
+	var problems []string
+
+	// When the source is an address, only its family is pinged.
+	source, _ := netip.ParseAddr(cfg.Source)
+	pingable := func(name string, addr netip.Addr) {
+		// Checked as resolved, mapped addresses are pinged as ipv4.
+		addr = resolve.Unmapped(addr)
+		if !resolve.AllowedAddr(addr) {
+			problems = append(problems, fmt.Sprintf("%s: address %s is of a disabled family", name, addr))
+		} else if source.IsValid() && source.Unmap().Is4() != addr.Unmap().Is4() {
+			problems = append(problems, fmt.Sprintf("%s: address %s is not the family of source %s", name, addr, source))
+		}
+	}
+
+	for _, t := range cfg.Targets {
+		name := t.MetricName()
+		switch t := t.(type) {
+		case *config.StaticIP:
+			pingable(name, t.IP)
+
+		case *config.CIDRTarget:
+			pingable(name, t.Prefix.Addr())
+
+		case *config.RouteTarget:
+			if t.Dest.IsValid() {
+				pingable(name, t.Dest)
+			}
+
+		case *config.TraceHops:
+			if t.Dest.IsValid() {
+				pingable(name, t.Dest)
+			}
+			if t.MatchesHop() {
+				// The whole route is traced to find the hop.
+				continue
+			}
+			if t.Hop > maxTTL || t.Hop <= -trace.DefaultTTL {
+				problems = append(problems, fmt.Sprintf("%s: hop %d can never be traced", name, t.Hop))
+			}
+			if t.Hop >= 0 && t.MinValidHops > t.Hop+1 {
+				problems = append(problems, fmt.Sprintf("%s: min-valid-hops %d is more than the %d hops traced", name, t.MinValidHops, t.Hop+1))
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+)
+
+func Test_configProblems_MappedAddress(t *testing.T) {
+	cfg := &config.Config{
+		Source: "192.0.2.100",
+		Targets: []config.LatencyTarget{
+			&config.StaticIP{Name: "mapped", IP: netip.MustParseAddr("::ffff:192.0.2.1")},
+		},
+	}
+	if got := configProblems(cfg); len(got) != 0 {
+		t.Errorf("expected the mapped address to be pinged as ipv4, got: %v", got)
+	}
+
+	cfg.Source = "2001:db8::100"
+	if got := configProblems(cfg); len(got) != 1 {
+		t.Errorf("expected the mapped address to not be the family of the source, got: %v", got)
+	}
+}
@@ -3,23 +3,56 @@ package config
 import (
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"time"
 )
 
 const (
 	SmallestResolveInterval = time.Minute
 	SmallestPingInterval    = 10 * time.Millisecond
+
+	// DSCP is a 6 bit field.
+	MaxDSCP = 63
+
+	// Largest echo payload that fits a 1500 byte MTU without fragmenting,
+	// after the ipv4 and icmp headers.
+	MaxPayloadSize = 1500 - 20 - 8
+	// Like MaxPayloadSize, after the larger ipv6 header.
+	MaxPayloadSize6 = 1500 - 40 - 8
+
+	// Limits protect the process from configs that would exhaust file
+	// descriptors or memory. They are high enough to not matter in practice.
+	DefaultMaxTargets   = 10000
+	DefaultMaxAddresses = 100000
 )
 
 var (
 	cfgFlag = flag.String("config",
 		"config.json",
-		"Json encoded configuration file to use.")
+		"Configuration file to use, json or yaml depending on the extension.")
+	strictFlag = flag.Bool("config-strict",
+		true,
+		"Fail to load configs with unknown fields, instead of logging them.")
+	maxTargetsFlag = flag.Int("max-targets",
+		DefaultMaxTargets,
+		"Maximum number of targets a config may contain, larger configs fail to load.")
+	maxAddressesFlag = flag.Int("max-addresses",
+		DefaultMaxAddresses,
+		"Maximum number of resolved addresses to monitor across all targets.")
 )
 
+// FilePath returns the path of the config file LoadConfig reads.
+func FilePath() string {
+	return *cfgFlag
+}
+
 func LoadConfig() (*Config, error) {
 	file, err := os.Open(*cfgFlag)
 	defer file.Close()
@@ -27,21 +60,48 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("failed to read config: %w", err)
 	}
 
-	c, err := ParseConfig(file)
+	parse := ParseConfig
+	if !*strictFlag {
+		parse = ParseConfigLenient
+	}
+	switch filepath.Ext(*cfgFlag) {
+	case ".yaml", ".yml":
+		parse = ParseConfigYAML
+		if !*strictFlag {
+			parse = ParseConfigYAMLLenient
+		}
+	}
+	c, err := parse(file)
 	if err != nil {
 		return nil, err
 	}
 
+	if len(c.Targets) > *maxTargetsFlag {
+		return nil, fmt.Errorf("config has too many targets: %d > %d (see --max-targets)", len(c.Targets), *maxTargetsFlag)
+	}
+	c.MaxAddresses = *maxAddressesFlag
+
 	if c.ResolveInterval < SmallestResolveInterval {
-		log.Printf("configured resolve interval is lower than the minimum allowed: %v < %v\n", c.ResolveInterval, SmallestResolveInterval)
+		slog.Warn("configured resolve interval is lower than the minimum allowed", "interval", c.ResolveInterval, "min", SmallestResolveInterval)
 		c.ResolveInterval = SmallestResolveInterval
 	}
 
 	if c.PingInterval < SmallestPingInterval {
-		log.Printf("configured ping interval is lower than the minimum allowed: %v < %v\n", c.PingInterval, SmallestPingInterval)
+		slog.Warn("configured ping interval is lower than the minimum allowed", "interval", c.PingInterval, "min", SmallestPingInterval)
 		c.PingInterval = SmallestPingInterval
 	}
 
+	for _, t := range c.Targets {
+		o, ok := t.(overridable)
+		if !ok {
+			continue
+		}
+		if i := o.overrides().PingInterval; i != 0 && i < SmallestPingInterval {
+			slog.Warn("ping interval of target is lower than the minimum allowed", "target", t.MetricName(), "interval", i, "min", SmallestPingInterval)
+			o.overrides().PingInterval = SmallestPingInterval
+		}
+	}
+
 	return c, nil
 }
 
@@ -62,6 +122,86 @@ type Config struct {
 	//
 	// The lowest value accepted is 10ms.
 	PingInterval time.Duration
+
+	// PingTimeout is how long to wait for the reply to a ping, before it's
+	// reported as lost, regardless of the ping interval.
+	//
+	// Zero waits 3 ping intervals of the target, but at least a second.
+	PingTimeout time.Duration
+
+	// RampUp is the duration after startup over which the ping rate
+	// increases from a fraction of the configured rate to the full rate.
+	// This avoids a large burst of probes when the monitor starts.
+	//
+	// Zero disables the ramp up.
+	RampUp time.Duration
+
+	// Jitter spreads the pings of the addresses over their ping interval,
+	// instead of sending them all at once every interval. Bursts of probes
+	// can trip rate limits of routers along the path.
+	Jitter bool
+
+	// Warmup is the number of latency results to discard after an address
+	// starts being monitored, because the first packets to a new address
+	// can include ARP/ND resolution or route setup. Lost packets are still
+	// counted during warmup.
+	Warmup int
+
+	// MaxAddresses limits the total number of addresses the targets may
+	// resolve to, addresses past the limit are not monitored.
+	//
+	// Zero means there is no limit.
+	MaxAddresses int
+
+	// Source is the interface name or local address that pings are sent
+	// from. Pings of the other address family are not sent when it's an
+	// address. Empty uses the --interface flag.
+	Source string
+
+	// LatencyBuckets are the boundaries of the latency histogram buckets, in
+	// milliseconds. Empty uses the default boundaries. Only read at startup.
+	LatencyBuckets []float64
+}
+
+// Equal reports whether both configs have the same settings and targets, in
+// the same order. Targets are compared by value, so a config that was loaded
+// again from the same file is equal to the original.
+func (c Config) Equal(o Config) bool {
+	return reflect.DeepEqual(c, o)
+}
+
+// AddressTarget is a single address of a target that resolves to multiple
+// addresses, so that each address has its own metric series. Created by the
+// resolver, never configured directly.
+type AddressTarget struct {
+	Parent LatencyTarget
+	// Index of the address, in the sorted addresses of the parent. For
+	// RouteTargets, the hop of the route the address is at.
+	Index int
+	// Addr names the target instead of the index if it's valid, for parents
+	// whose addresses never change, like CIDRTarget.
+	Addr netip.Addr
+}
+
+var _ LatencyTarget = &AddressTarget{}
+
+func (a *AddressTarget) MetricName() string {
+	if a.Addr.IsValid() {
+		return fmt.Sprintf("%s/%s", a.Parent.MetricName(), a.Addr)
+	}
+	return fmt.Sprintf("%s/%d", a.Parent.MetricName(), a.Index)
+}
+
+func (a *AddressTarget) String() string {
+	return fmt.Sprintf("AddressTarget{Parent: %s, Index:%d}", a.Parent, a.Index)
+}
+
+// overrides are those of the parent, so that settings apply to every address.
+func (a *AddressTarget) overrides() *Overrides {
+	if o, ok := a.Parent.(overridable); ok {
+		return o.overrides()
+	}
+	return &Overrides{}
 }
 
 type LatencyTarget interface {
@@ -75,6 +215,58 @@ type LatencyTarget interface {
 	MetricName() string
 }
 
+// Overrides are the optional per-target settings of pinged targets, they take
+// precedence over the global settings.
+type Overrides struct {
+	// DontFragment sets the don't fragment bit on probes, so that paths
+	// that need to fragment them are detected instead of adding latency.
+	DontFragment bool
+
+	// Selection chooses which of the resolved addresses are pinged.
+	Selection Selection
+
+	// PingInterval replaces the global ping interval for the target, if
+	// it's not zero.
+	PingInterval time.Duration
+
+	// DSCP marks probes with the differentiated services code point, to
+	// measure the latency of a traffic class. Zero leaves probes unmarked.
+	DSCP int
+
+	// PayloadSize pads the data of echo requests to the number of bytes, to
+	// measure paths with MTU issues. Zero uses the default payload.
+	PayloadSize int
+
+	// Timestamp sends ICMP Timestamp requests instead of echo requests to
+	// ipv4 addresses, which also estimate the latency in each direction.
+	// Addresses that don't reply to them are pinged with echo requests.
+	Timestamp bool
+}
+
+// Selection is the strategy used to pick the addresses of a target to ping.
+type Selection string
+
+const (
+	// Ping every address the target resolved to.
+	SelectAll Selection = ""
+	// Briefly ping every address after each resolve, then only ping the
+	// address with the lowest latency until the next resolve. Gives the
+	// best achievable latency of anycast or CDN hosts.
+	SelectClosest Selection = "closest"
+	// Ping one address every interval, rotating through the addresses, to
+	// sample all of them without multiplying the load.
+	SelectRoundRobin Selection = "round-robin"
+)
+
+func (o *Overrides) overrides() *Overrides {
+	return o
+}
+
+// overridable is implemented by targets that embed Overrides.
+type overridable interface {
+	overrides() *Overrides
+}
+
 // TraceHops attempts to run a traceroute to Dest, and uses the IP address
 // for the Hop-th hop in the route. Only usable if the process is sufficiently
 // privileged to run traceroute (eg: root, etc.)
@@ -85,10 +277,33 @@ type LatencyTarget interface {
 type TraceHops struct {
 	Name string
 	Dest netip.Addr
+	// Host is traced instead of Dest when Dest is not set. It is resolved to
+	// an address of the Family before every trace.
+	Host   string
+	Family Family
 	// Hop specifies which of the trace route hops to resolve to.
 	// Zero specifies the current host, one the first hop and so on.
 	// Negative indicies are allowed, -1 specifies the hop before the Dest.
 	Hop int
+	// HopMatchRegex selects the first hop with a reverse DNS name that
+	// matches it instead of the Hop index, empty if not set.
+	HopMatchRegex string
+	// HopASN selects the first hop in the autonomous system instead of the
+	// Hop index, zero if not set. When both are set, the hop must match both.
+	HopASN uint32
+	// MinValidHops is the number of hops that must have responded for the
+	// trace to be used. Traces with fewer fail to resolve, and the previous
+	// hop continues to be used.
+	MinValidHops int
+
+	Overrides
+}
+
+// MatchesHop reports whether the hop is selected by matching its name or
+// autonomous system, instead of by index. Route lengths vary, so matching
+// keeps selecting the same router when the index of it changes.
+func (s *TraceHops) MatchesHop() bool {
+	return s.HopMatchRegex != "" || s.HopASN != 0
 }
 
 var _ LatencyTarget = &TraceHops{}
@@ -98,12 +313,62 @@ func (s *TraceHops) MetricName() string {
 }
 
 func (s *TraceHops) String() string {
+	if !s.Dest.IsValid() {
+		return fmt.Sprintf("TraceHops{Name: %s, Host:%s, Family:%s, Hop:%d}", s.Name, s.Host, s.Family, s.Hop)
+	}
 	return fmt.Sprintf("TraceHops{Name: %s, Dest:%s, Hop:%d}", s.Name, s.Dest, s.Hop)
 }
 
+// RouteTarget traces the route to Dest like TraceHops, but pings every hop
+// that responded instead of a single one, like mtr. Each hop is a separate
+// target named after its index in the route, see AddressTarget.
+type RouteTarget struct {
+	Name string
+	Dest netip.Addr
+	// Host is traced instead of Dest when Dest is not set. It is resolved to
+	// an address of the Family before every trace.
+	Host   string
+	Family Family
+
+	Overrides
+}
+
+var _ LatencyTarget = &RouteTarget{}
+
+func (s *RouteTarget) MetricName() string {
+	return s.Name
+}
+
+func (s *RouteTarget) String() string {
+	if !s.Dest.IsValid() {
+		return fmt.Sprintf("Route{Name:%s, Host:%s, Family:%s}", s.Name, s.Host, s.Family)
+	}
+	return fmt.Sprintf("Route{Name:%s, Dest:%s}", s.Name, s.Dest)
+}
+
+// Family restricts which address family a hostname resolves to.
+type Family string
+
+const (
+	FamilyAny  Family = ""
+	FamilyIPv4 Family = "ip4"
+	FamilyIPv6 Family = "ip6"
+)
+
+// Network returns the network name to look up addresses of the family with,
+// as accepted by net.Resolver.LookupNetIP.
+func (f Family) Network() string {
+	if f == FamilyAny {
+		return "ip"
+	}
+	return string(f)
+}
+
 type StaticIP struct {
 	Name string
 	IP   netip.Addr
+
+	Overrides
 }
 
 var _ LatencyTarget = &StaticIP{}
@@ -115,9 +380,36 @@ func (s *StaticIP) String() string {
 	return fmt.Sprintf("StaticIps{Name:%s, IP:%+v}", s.Name, s.IP)
 }
 
+// CIDRTarget pings every host address of a small subnet, each as a separate
+// target named after the address, see AddressTarget.
+type CIDRTarget struct {
+	Name   string
+	Prefix netip.Prefix
+
+	Overrides
+}
+
+// MaxCIDRHostBits limits CIDRTargets to subnets of at most 256 addresses, an
+// ipv4 /24 or an ipv6 /120.
+const MaxCIDRHostBits = 8
+
+var _ LatencyTarget = &CIDRTarget{}
+
+func (s *CIDRTarget) MetricName() string {
+	return s.Name
+}
+func (s *CIDRTarget) String() string {
+	return fmt.Sprintf("CIDR{Name:%s, Prefix:%s}", s.Name, s.Prefix)
+}
+
 type HostnameTarget struct {
 	Name string
 	Host string
+	// Expand monitors each address the host resolves to as a separate
+	// target, see AddressTarget.
+	Expand bool
+
+	Overrides
 }
 
 var _ LatencyTarget = &HostnameTarget{}
@@ -128,3 +420,92 @@ func (s *HostnameTarget) MetricName() string {
 func (s *HostnameTarget) String() string {
 	return fmt.Sprintf("Hostname{Name:%s, Host:%s}", s.Name, s.Host)
 }
+
+// SRVTarget pings every host the SRV record of the service points at, as
+// looked up by net.Resolver.LookupSRV. Priorities and weights are ignored.
+type SRVTarget struct {
+	Name    string
+	Service string
+	Proto   string
+	Domain  string
+
+	Overrides
+}
+
+var _ LatencyTarget = &SRVTarget{}
+
+func (s *SRVTarget) MetricName() string {
+	return s.Name
+}
+func (s *SRVTarget) String() string {
+	return fmt.Sprintf("SRV{Name:%s, Service:%s, Proto:%s, Domain:%s}", s.Name, s.Service, s.Proto, s.Domain)
+}
+
+// HttpTarget measures the latency of a full HTTP request to URL, rather than
+// the network latency to a host. The request is considered successful if the
+// response status code matches ExpectedStatus.
+type HttpTarget struct {
+	Name   string
+	URL    *url.URL
+	Method string
+	// ExpectedStatus is the status code a healthy response returns.
+	ExpectedStatus int
+	// FollowRedirects controls if redirect responses are followed, or
+	// returned as the response to the probe.
+	FollowRedirects bool
+	// Timeout bounds the total duration of a single request.
+	Timeout time.Duration
+}
+
+var _ LatencyTarget = &HttpTarget{}
+
+func (s *HttpTarget) MetricName() string {
+	return s.Name
+}
+func (s *HttpTarget) String() string {
+	return fmt.Sprintf("Http{Name:%s, Method:%s, URL:%s}", s.Name, s.Method, s.URL)
+}
+
+// TcpTarget measures the latency of completing a TCP handshake with Host,
+// for paths where ICMP is blocked.
+type TcpTarget struct {
+	Name string
+	// Host is a hostname or address, resolved when connecting.
+	Host string
+	Port int
+	// Timeout bounds a single connection attempt.
+	Timeout time.Duration
+}
+
+var _ LatencyTarget = &TcpTarget{}
+
+func (s *TcpTarget) MetricName() string {
+	return s.Name
+}
+func (s *TcpTarget) String() string {
+	return fmt.Sprintf("Tcp{Name:%s, Host:%s, Port:%d}", s.Name, s.Host, s.Port)
+}
+
+// Address returns the host and port to connect to.
+func (s *TcpTarget) Address() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// BroadcastTarget sends echo requests to a broadcast or multicast address,
+// and counts the number of distinct hosts that respond within Window.
+type BroadcastTarget struct {
+	Name string
+	Addr netip.Addr
+	// Window is how long to wait for responses after each request, always
+	// shorter than the ping interval.
+	Window time.Duration
+}
+
+var _ LatencyTarget = &BroadcastTarget{}
+
+func (s *BroadcastTarget) MetricName() string {
+	return s.Name
+}
+func (s *BroadcastTarget) String() string {
+	return fmt.Sprintf("Broadcast{Name:%s, Addr:%s}", s.Name, s.Addr)
+}
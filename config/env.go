@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// envPattern matches ${VAR} and ${VAR:-default} references.
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces environment variable references in the string. Unset
+// variables use their default, and are an error without one.
+func expandEnv(s string) (string, error) {
+	var err error
+	expanded := envPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		m := envPattern.FindStringSubmatch(ref)
+		value, ok := os.LookupEnv(m[1])
+		if len(m[2]) > 0 && (!ok || len(value) == 0) {
+			return m[3]
+		}
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", m[1])
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// expandFields expands environment variable references in every string field
+// of the struct, recursing into embedded structs and slices of structs. The
+// prefix is the json path of the struct, for errors.
+func expandFields(prefix string, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fv := v.Field(i)
+		name := prefix + strings.Split(f.Tag.Get("json"), ",")[0]
+
+		switch {
+		case f.Anonymous && f.Type.Kind() == reflect.Struct:
+			if err := expandFields(prefix, fv); err != nil {
+				return err
+			}
+		case f.Type.Kind() == reflect.String:
+			s, err := expandEnv(fv.String())
+			if err != nil {
+				return fmt.Errorf("failed to expand '%s': %w", name, err)
+			}
+			fv.SetString(s)
+		case f.Type.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.Struct:
+			for index := 0; index < fv.Len(); index++ {
+				p := fmt.Sprintf("%s[%d].", name, index)
+				if err := expandFields(p, fv.Index(index)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
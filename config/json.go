@@ -4,41 +4,308 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/http"
 	"net/netip"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
 const (
 	defaultResolveInterval = 15 * time.Minute
 	defaultPingInterval    = 1 * time.Second
+	defaultHttpTimeout     = 10 * time.Second
+	defaultTcpTimeout      = 10 * time.Second
+	defaultWarmup          = 1
+	defaultBroadcastWindow = 1 * time.Second
 )
 
 // JsonConfig exists to serialize Configs to and from disk, because of the
 // nature of the dynamic types.
 type JsonConfig struct {
-	Hops            []JsonTraceHop `json:"hops"`
-	Static          []JsonStaticIp `json:"static"`
-	Hosts           []JsonHostname `json:"hosts"`
-	ResolveInterval string         `json:"resolve-interval"`
-	PingInterval    string         `json:"ping-interval"`
+	Hops            []JsonTraceHop  `json:"hops" yaml:"hops"`
+	Routes          []JsonRoute     `json:"routes" yaml:"routes"`
+	Static          []JsonStaticIp  `json:"static" yaml:"static"`
+	CIDR            []JsonCIDR      `json:"cidr" yaml:"cidr"`
+	Hosts           []JsonHostname  `json:"hosts" yaml:"hosts"`
+	SRV             []JsonSRV       `json:"srv" yaml:"srv"`
+	Http            []JsonHttp      `json:"http" yaml:"http"`
+	Tcp             []JsonTcp       `json:"tcp" yaml:"tcp"`
+	Broadcast       []JsonBroadcast `json:"broadcast" yaml:"broadcast"`
+	ResolveInterval string          `json:"resolve-interval" yaml:"resolve-interval"`
+	PingInterval    string          `json:"ping-interval" yaml:"ping-interval"`
+	PingTimeout     string          `json:"ping-timeout" yaml:"ping-timeout"`
+	RampUp          string          `json:"ramp-up" yaml:"ramp-up"`
+	Jitter          bool            `json:"jitter" yaml:"jitter"`
+	// Interface name or local address to send pings from.
+	Source string `json:"source" yaml:"source"`
+	// Increasing boundaries of the latency histogram, in milliseconds.
+	LatencyBuckets []float64 `json:"latency-buckets" yaml:"latency-buckets"`
+	// Pointer to distinguish unset from an explicit zero.
+	Warmup *int `json:"warmup" yaml:"warmup"`
 }
 
 type JsonTraceHop struct {
-	Name        string `json:"name"`
-	Destination string `json:"destination"`
-	Hop         int    `json:"hop"`
+	Name        string `json:"name" yaml:"name"`
+	Destination string `json:"destination" yaml:"destination"`
+	// Host is a hostname to trace instead of the destination. Family is
+	// one of "ip4", "ip6" or "both", where both creates a target per family.
+	Host   string `json:"host" yaml:"host"`
+	Family string `json:"family" yaml:"family"`
+	Hop    int    `json:"hop" yaml:"hop"`
+	// Select the first hop with a matching reverse DNS name, or in the
+	// autonomous system, instead of the hop index.
+	HopMatch string `json:"hop-match" yaml:"hop-match"`
+	HopASN   uint32 `json:"hop-asn" yaml:"hop-asn"`
+	// Traces with fewer responding hops are treated as failures.
+	MinValidHops int `json:"min-valid-hops" yaml:"min-valid-hops"`
+
+	JsonOverrides `yaml:",inline"`
+}
+
+type JsonRoute struct {
+	Name        string `json:"name" yaml:"name"`
+	Destination string `json:"destination" yaml:"destination"`
+	// Host is a hostname to trace instead of the destination, resolved to
+	// an address of the family, "ip4" or "ip6".
+	Host   string `json:"host" yaml:"host"`
+	Family string `json:"family" yaml:"family"`
+
+	JsonOverrides `yaml:",inline"`
 }
 
 type JsonStaticIp struct {
-	Name string `json:"name"`
-	IP   string `json:"ip"`
+	Name string `json:"name" yaml:"name"`
+	IP   string `json:"ip" yaml:"ip"`
+
+	JsonOverrides `yaml:",inline"`
+}
+
+type JsonCIDR struct {
+	Name string `json:"name" yaml:"name"`
+	// Every host address of the prefix is monitored, named "<name>/<address>".
+	Prefix string `json:"prefix" yaml:"prefix"`
+
+	JsonOverrides `yaml:",inline"`
 }
 
 type JsonHostname struct {
-	Name string `json:"name"`
-	Host string `json:"host"`
+	Name string `json:"name" yaml:"name"`
+	Host string `json:"host" yaml:"host"`
+	// Monitor each address as a separate target, named "<name>/<index>".
+	Expand bool `json:"expand" yaml:"expand"`
+
+	JsonOverrides `yaml:",inline"`
+}
+
+type JsonSRV struct {
+	Name string `json:"name" yaml:"name"`
+	// Looks up _service._proto.domain, an empty service and proto look up
+	// domain directly.
+	Service string `json:"service" yaml:"service"`
+	Proto   string `json:"proto" yaml:"proto"`
+	Domain  string `json:"domain" yaml:"domain"`
+
+	JsonOverrides `yaml:",inline"`
+}
+
+// parse returns the targets for the trace hop, a target per family if both
+// families of a host are traced.
+func (th *JsonTraceHop) parse() ([]*TraceHops, error) {
+	overrides, err := th.JsonOverrides.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var dest netip.Addr
+	if len(th.Host) > 0 {
+		if len(th.Destination) > 0 {
+			return nil, fmt.Errorf("only one of 'destination' and 'host' may be set")
+		}
+	} else if dest, err = netip.ParseAddr(th.Destination); err != nil {
+		return nil, err
+	} else if len(th.Family) > 0 {
+		return nil, fmt.Errorf("'family' requires 'host' to be set")
+	}
+
+	if len(th.Name) == 0 {
+		return nil, fmt.Errorf(
+			"missing 'name': destination %s%s, hop %d",
+			th.Destination,
+			th.Host,
+			th.Hop)
+	}
+	if th.MinValidHops < 0 {
+		return nil, fmt.Errorf("'min-valid-hops' must not be negative: %d", th.MinValidHops)
+	}
+	if len(th.HopMatch) > 0 {
+		if _, err := regexp.Compile(th.HopMatch); err != nil {
+			return nil, fmt.Errorf("bad 'hop-match': %w", err)
+		}
+	}
+	if (len(th.HopMatch) > 0 || th.HopASN != 0) && th.Hop != 0 {
+		return nil, fmt.Errorf("'hop' can't be set with 'hop-match' or 'hop-asn'")
+	}
+
+	var families []Family
+	switch th.Family {
+	case "":
+		families = []Family{FamilyAny}
+	case string(FamilyIPv4), string(FamilyIPv6):
+		families = []Family{Family(th.Family)}
+	case "both":
+		families = []Family{FamilyIPv4, FamilyIPv6}
+	default:
+		return nil, fmt.Errorf("unknown 'family': %q", th.Family)
+	}
+
+	result := make([]*TraceHops, 0, len(families))
+	for _, f := range families {
+		name := th.Name
+		if len(families) > 1 {
+			// Each family needs a distinct name to tell the metrics apart.
+			name = fmt.Sprintf("%s-%s", th.Name, f)
+		}
+		result = append(result, &TraceHops{
+			Name:          name,
+			Dest:          dest,
+			Host:          th.Host,
+			Family:        f,
+			Hop:           th.Hop,
+			HopMatchRegex: th.HopMatch,
+			HopASN:        th.HopASN,
+			MinValidHops:  th.MinValidHops,
+			Overrides:     overrides,
+		})
+	}
+	return result, nil
+}
+
+func (r *JsonRoute) parse() (*RouteTarget, error) {
+	overrides, err := r.JsonOverrides.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var dest netip.Addr
+	if len(r.Host) > 0 {
+		if len(r.Destination) > 0 {
+			return nil, fmt.Errorf("only one of 'destination' and 'host' may be set")
+		}
+	} else if dest, err = netip.ParseAddr(r.Destination); err != nil {
+		return nil, err
+	} else if len(r.Family) > 0 {
+		return nil, fmt.Errorf("'family' requires 'host' to be set")
+	}
+
+	switch Family(r.Family) {
+	case FamilyAny, FamilyIPv4, FamilyIPv6:
+	default:
+		return nil, fmt.Errorf("unknown 'family': %q", r.Family)
+	}
+
+	name := r.Name
+	if len(name) == 0 {
+		name = fmt.Sprintf("route:%s%s", r.Destination, r.Host)
+	}
+	return &RouteTarget{
+		Name:      name,
+		Dest:      dest,
+		Host:      r.Host,
+		Family:    Family(r.Family),
+		Overrides: overrides,
+	}, nil
+}
+
+// JsonOverrides are the per-target settings shared by pinged targets.
+type JsonOverrides struct {
+	DontFragment bool `json:"dont-fragment" yaml:"dont-fragment"`
+	// One of "all", "closest" or "round-robin", defaults to all.
+	Select string `json:"select" yaml:"select"`
+	// Defaults to the global ping interval.
+	PingInterval string `json:"ping-interval" yaml:"ping-interval"`
+	// Between 0 and 63, defaults to unmarked.
+	DSCP int `json:"dscp" yaml:"dscp"`
+	// Bytes of echo data, at most MaxPayloadSize, or MaxPayloadSize6 for
+	// ipv6 addresses.
+	PayloadSize int `json:"payload-size" yaml:"payload-size"`
+	// Pings ipv4 addresses with ICMP Timestamp requests.
+	Timestamp bool `json:"timestamp" yaml:"timestamp"`
+}
+
+func (j JsonOverrides) parse() (Overrides, error) {
+	o := Overrides{
+		DontFragment: j.DontFragment,
+		Timestamp:    j.Timestamp,
+	}
+	switch j.Select {
+	case "", "all":
+		o.Selection = SelectAll
+	case string(SelectClosest):
+		o.Selection = SelectClosest
+	case string(SelectRoundRobin):
+		o.Selection = SelectRoundRobin
+	default:
+		return Overrides{}, fmt.Errorf("unknown 'select': %q", j.Select)
+	}
+	if len(j.PingInterval) > 0 {
+		d, err := time.ParseDuration(j.PingInterval)
+		if err != nil {
+			return Overrides{}, fmt.Errorf("failed to parse 'ping-interval': %w", err)
+		}
+		if d <= 0 {
+			return Overrides{}, fmt.Errorf("'ping-interval' must be positive: %s", d)
+		}
+		o.PingInterval = d
+	}
+	if j.DSCP < 0 || j.DSCP > MaxDSCP {
+		return Overrides{}, fmt.Errorf("'dscp' must be between 0 and %d: %d", MaxDSCP, j.DSCP)
+	}
+	o.DSCP = j.DSCP
+	if j.PayloadSize < 0 || j.PayloadSize > MaxPayloadSize {
+		return Overrides{}, fmt.Errorf("'payload-size' must be between 0 and %d: %d", MaxPayloadSize, j.PayloadSize)
+	}
+	o.PayloadSize = j.PayloadSize
+	return o, nil
+}
+
+// checkPayload fails if ipv6 probes of the payload size would need to be
+// fragmented. Only targets with a known address can be checked, the pingers
+// cut the payload of other targets down to fit, see ping.payloadSize.
+func (o Overrides) checkPayload(addr netip.Addr) error {
+	if addr.Unmap().Is6() && o.PayloadSize > MaxPayloadSize6 {
+		return fmt.Errorf("'payload-size' of ipv6 addresses must be at most %d: %d", MaxPayloadSize6, o.PayloadSize)
+	}
+	return nil
+}
+
+type JsonHttp struct {
+	Name            string `json:"name" yaml:"name"`
+	URL             string `json:"url" yaml:"url"`
+	Method          string `json:"method" yaml:"method"`
+	ExpectedStatus  int    `json:"expected-status" yaml:"expected-status"`
+	FollowRedirects bool   `json:"follow-redirects" yaml:"follow-redirects"`
+	Timeout         string `json:"timeout" yaml:"timeout"`
+}
+
+type JsonTcp struct {
+	Name    string `json:"name" yaml:"name"`
+	Host    string `json:"host" yaml:"host"`
+	Port    int    `json:"port" yaml:"port"`
+	Timeout string `json:"timeout" yaml:"timeout"`
 }
 
+type JsonBroadcast struct {
+	Name    string `json:"name" yaml:"name"`
+	Address string `json:"address" yaml:"address"`
+	Window  string `json:"window" yaml:"window"`
+}
+
+// ParseConfig parses a json config, failing if there are any unknown fields.
 func ParseConfig(r io.Reader) (*Config, error) {
 	decoder := json.NewDecoder(r)
 	decoder.DisallowUnknownFields()
@@ -49,10 +316,89 @@ func ParseConfig(r io.Reader) (*Config, error) {
 		return nil, err
 	}
 
+	return fromJson(j)
+}
+
+// ParseConfigLenient parses a json config, logging any unknown fields instead
+// of failing. This allows newer configs to be deployed before the binaries
+// that understand them.
+func ParseConfigLenient(r io.Reader) (*Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var j JsonConfig
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+
+	for _, field := range unknownFields("", data, reflect.TypeOf(j)) {
+		slog.Warn("ignoring unknown config field", "field", field)
+	}
+
+	return fromJson(j)
+}
+
+// unknownFields returns the path of every json object key in data that does
+// not map to a field of the struct type t, recursing into slices of structs.
+func unknownFields(prefix string, data []byte, t reflect.Type) []string {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil
+	}
+
+	known := make(map[string]reflect.Type, t.NumField())
+	addFields(known, t)
+
+	var unknown []string
+	for key, value := range object {
+		ft, ok := known[key]
+		if !ok {
+			unknown = append(unknown, prefix+key)
+			continue
+		}
+		if ft.Kind() != reflect.Slice || ft.Elem().Kind() != reflect.Struct {
+			continue
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(value, &items); err != nil {
+			continue
+		}
+		for index, item := range items {
+			p := fmt.Sprintf("%s%s[%d].", prefix, key, index)
+			unknown = append(unknown, unknownFields(p, item, ft.Elem())...)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// addFields adds the json names of the fields of t to known, including the
+// fields of embedded structs, which are promoted by encoding/json.
+func addFields(known map[string]reflect.Type, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			addFields(known, f.Type)
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		known[name] = f.Type
+	}
+}
+
+func fromJson(j JsonConfig) (*Config, error) {
+	// Values may refer to the environment as ${VAR} or ${VAR:-default}.
+	if err := expandFields("", reflect.ValueOf(&j).Elem()); err != nil {
+		return nil, err
+	}
+
 	c := &Config{
-		Targets:         make([]LatencyTarget, 0, len(j.Hops)+len(j.Static)+len(j.Hosts)),
+		Targets:         make([]LatencyTarget, 0, len(j.Hops)+len(j.Routes)+len(j.Static)+len(j.CIDR)+len(j.Hosts)+len(j.SRV)+len(j.Http)+len(j.Tcp)+len(j.Broadcast)),
 		ResolveInterval: 15 * time.Minute,
 		PingInterval:    1 * time.Second,
+		Warmup:          defaultWarmup,
 	}
 
 	if len(j.ResolveInterval) > 0 {
@@ -71,23 +417,61 @@ func ParseConfig(r io.Reader) (*Config, error) {
 		}
 	}
 
+	if len(j.PingTimeout) > 0 {
+		d, err := time.ParseDuration(j.PingTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'ping-timeout': %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("'ping-timeout' must be positive: %s", d)
+		}
+		c.PingTimeout = d
+	}
+
+	if len(j.RampUp) > 0 {
+		if d, err := time.ParseDuration(j.RampUp); err != nil {
+			return nil, fmt.Errorf("failed to parse 'ramp-up': %w", err)
+		} else {
+			c.RampUp = d
+		}
+	}
+
+	c.Jitter = j.Jitter
+	c.Source = j.Source
+
+	for i, b := range j.LatencyBuckets {
+		if b < 0 {
+			return nil, fmt.Errorf("'latency-buckets' must not be negative: %v", b)
+		}
+		if i > 0 && b <= j.LatencyBuckets[i-1] {
+			return nil, fmt.Errorf("'latency-buckets' must be increasing: %v", j.LatencyBuckets)
+		}
+	}
+	c.LatencyBuckets = j.LatencyBuckets
+
+	if j.Warmup != nil {
+		if *j.Warmup < 0 {
+			return nil, fmt.Errorf("'warmup' must not be negative: %d", *j.Warmup)
+		}
+		c.Warmup = *j.Warmup
+	}
+
 	for index, th := range j.Hops {
-		dest, err := netip.ParseAddr(th.Destination)
+		hops, err := th.parse()
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse 'hops[%d]': %w", index, err)
 		}
-		if len(th.Name) == 0 {
-			return nil, fmt.Errorf(
-				"hops[%d] missing 'name': destination %s, hop %d",
-				index,
-				dest,
-				th.Hop)
-		}
-		c.Targets = append(c.Targets, &TraceHops{
-			Name: th.Name,
-			Dest: dest,
-			Hop:  th.Hop,
-		})
+		for _, h := range hops {
+			c.Targets = append(c.Targets, h)
+		}
+	}
+
+	for index, route := range j.Routes {
+		r, err := route.parse()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'routes[%d]': %w", index, err)
+		}
+		c.Targets = append(c.Targets, r)
 	}
 
 	for index, static := range j.Static {
@@ -98,21 +482,184 @@ func ParseConfig(r io.Reader) (*Config, error) {
 		if len(static.Name) == 0 {
 			static.Name = fmt.Sprintf("static-ip:%s", dest)
 		}
+		overrides, err := static.JsonOverrides.parse()
+		if err == nil {
+			err = overrides.checkPayload(dest)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'static[%d]': %w", index, err)
+		}
 		c.Targets = append(c.Targets, &StaticIP{
-			Name: static.Name,
-			IP:   dest,
+			Name:      static.Name,
+			IP:        dest,
+			Overrides: overrides,
+		})
+	}
+
+	for index, cidr := range j.CIDR {
+		prefix, err := netip.ParsePrefix(cidr.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'cidr[%d]': %w", index, err)
+		}
+		prefix = prefix.Masked()
+		if hostBits := prefix.Addr().BitLen() - prefix.Bits(); hostBits > MaxCIDRHostBits {
+			return nil, fmt.Errorf("cidr[%d] has more than %d addresses: %s", index, 1<<MaxCIDRHostBits, prefix)
+		}
+		if len(cidr.Name) == 0 {
+			cidr.Name = fmt.Sprintf("cidr:%s", prefix)
+		}
+		overrides, err := cidr.JsonOverrides.parse()
+		if err == nil {
+			err = overrides.checkPayload(prefix.Addr())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'cidr[%d]': %w", index, err)
+		}
+		c.Targets = append(c.Targets, &CIDRTarget{
+			Name:      cidr.Name,
+			Prefix:    prefix,
+			Overrides: overrides,
 		})
 	}
 
-	for _, h := range j.Hosts {
+	for index, h := range j.Hosts {
 		if len(h.Name) == 0 {
 			h.Name = fmt.Sprintf("host:%s", h.Host)
 		}
+		overrides, err := h.JsonOverrides.parse()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'hosts[%d]': %w", index, err)
+		}
 		c.Targets = append(c.Targets, &HostnameTarget{
-			Name: h.Name,
-			Host: h.Host,
+			Name:      h.Name,
+			Host:      h.Host,
+			Expand:    h.Expand,
+			Overrides: overrides,
+		})
+	}
+
+	for index, s := range j.SRV {
+		if len(s.Domain) == 0 {
+			return nil, fmt.Errorf("srv[%d] is missing a domain", index)
+		}
+		if (len(s.Service) == 0) != (len(s.Proto) == 0) {
+			return nil, fmt.Errorf("srv[%d] must set both service and proto, or neither", index)
+		}
+		overrides, err := s.JsonOverrides.parse()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'srv[%d]': %w", index, err)
+		}
+		target := &SRVTarget{
+			Name:      s.Name,
+			Service:   s.Service,
+			Proto:     s.Proto,
+			Domain:    s.Domain,
+			Overrides: overrides,
+		}
+		if len(target.Name) == 0 {
+			target.Name = fmt.Sprintf("srv:_%s._%s.%s", s.Service, s.Proto, s.Domain)
+			if len(s.Service) == 0 {
+				target.Name = fmt.Sprintf("srv:%s", s.Domain)
+			}
+		}
+		c.Targets = append(c.Targets, target)
+	}
+
+	for index, h := range j.Http {
+		u, err := url.Parse(h.URL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'http[%d]': %w", index, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("http[%d] has unsupported scheme: %q", index, u.Scheme)
+		}
+		if len(h.Name) == 0 {
+			h.Name = fmt.Sprintf("http:%s", u)
+		}
+		if len(h.Method) == 0 {
+			h.Method = http.MethodGet
+		}
+		if h.ExpectedStatus == 0 {
+			h.ExpectedStatus = http.StatusOK
+		}
+		timeout := defaultHttpTimeout
+		if len(h.Timeout) > 0 {
+			if timeout, err = time.ParseDuration(h.Timeout); err != nil {
+				return nil, fmt.Errorf("failed to parse 'http[%d].timeout': %w", index, err)
+			}
+		}
+		c.Targets = append(c.Targets, &HttpTarget{
+			Name:            h.Name,
+			URL:             u,
+			Method:          h.Method,
+			ExpectedStatus:  h.ExpectedStatus,
+			FollowRedirects: h.FollowRedirects,
+			Timeout:         timeout,
+		})
+	}
+
+	for index, t := range j.Tcp {
+		if len(t.Host) == 0 {
+			return nil, fmt.Errorf("tcp[%d] is missing a host", index)
+		}
+		if t.Port <= 0 || t.Port > 65535 {
+			return nil, fmt.Errorf("tcp[%d] has invalid port: %d", index, t.Port)
+		}
+		tcp := &TcpTarget{
+			Name:    t.Name,
+			Host:    t.Host,
+			Port:    t.Port,
+			Timeout: defaultTcpTimeout,
+		}
+		if len(tcp.Name) == 0 {
+			tcp.Name = fmt.Sprintf("tcp:%s", tcp.Address())
+		}
+		if len(t.Timeout) > 0 {
+			var err error
+			if tcp.Timeout, err = time.ParseDuration(t.Timeout); err != nil {
+				return nil, fmt.Errorf("failed to parse 'tcp[%d].timeout': %w", index, err)
+			}
+		}
+		c.Targets = append(c.Targets, tcp)
+	}
+
+	for index, b := range j.Broadcast {
+		addr, err := netip.ParseAddr(b.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 'broadcast[%d]': %w", index, err)
+		}
+		if addr.Is6() && !addr.IsMulticast() {
+			// Ipv6 doesn't have broadcast addresses.
+			return nil, fmt.Errorf("broadcast[%d] must be a multicast address: %s", index, addr)
+		}
+		if len(b.Name) == 0 {
+			b.Name = fmt.Sprintf("broadcast:%s", addr)
+		}
+		// Each probe has to finish before the next one is sent.
+		window := min(defaultBroadcastWindow, c.PingInterval/2)
+		if len(b.Window) > 0 {
+			if window, err = time.ParseDuration(b.Window); err != nil {
+				return nil, fmt.Errorf("failed to parse 'broadcast[%d].window': %w", index, err)
+			}
+		}
+		if window <= 0 || window >= c.PingInterval {
+			return nil, fmt.Errorf("broadcast[%d].window must be positive and shorter than the ping interval %v: %v", index, c.PingInterval, window)
+		}
+		c.Targets = append(c.Targets, &BroadcastTarget{
+			Name:   b.Name,
+			Addr:   addr,
+			Window: window,
 		})
 	}
 
+	// Targets with the same name would share their metric series.
+	names := make(map[string]LatencyTarget, len(c.Targets))
+	for _, t := range c.Targets {
+		if prev, ok := names[t.MetricName()]; ok {
+			return nil, fmt.Errorf("duplicate target name %q: %v and %v", t.MetricName(), prev, t)
+		}
+		names[t.MetricName()] = t
+	}
+
 	return c, nil
 }
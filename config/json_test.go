@@ -3,7 +3,9 @@ package config
 import (
 	"bytes"
 	"net/netip"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -22,6 +24,7 @@ func Test_Parse(t *testing.T) {
 				Targets:         []LatencyTarget{},
 				ResolveInterval: defaultResolveInterval,
 				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
 			},
 			err: false,
 		},
@@ -49,6 +52,47 @@ func Test_Parse(t *testing.T) {
 			cfg:  Config{},
 			err:  true,
 		},
+		{
+			name: "bad ping timeout",
+			json: `{"ping-timeout":"-1s"}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "ping timeout",
+			json: `{"ping-timeout":"500ms"}`,
+			cfg: Config{
+				Targets:         []LatencyTarget{},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				PingTimeout:     500 * time.Millisecond,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "bad ramp up time",
+			json: `{"ramp-up":"abc"}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "negative warmup",
+			json: `{"warmup":-1}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "warmup disabled",
+			json: `{"warmup":0}`,
+			cfg: Config{
+				Targets:         []LatencyTarget{},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          0,
+			},
+			err: false,
+		},
 		{
 			name: "bad json",
 			json: `{"`,
@@ -61,14 +105,453 @@ func Test_Parse(t *testing.T) {
 			cfg:  Config{},
 			err:  true,
 		},
+		{
+			name: "bad http url",
+			json: `{"http":[{"url":"ftp://example.com"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "bad http timeout",
+			json: `{"http":[{"url":"https://example.com", "timeout":"abc"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "duplicate names",
+			json: `{"static":[{"ip":"1.1.1.1", "name":"dns"}], "hosts":[{"host":"one.one.one.one", "name":"dns"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "duplicate generated names",
+			json: `{"static":[{"ip":"1.1.1.1"}, {"ip":"1.1.1.1"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "bad dscp",
+			json: `{"static":[{"ip":"1.1.1.1", "dscp":64}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "srv without proto",
+			json: `{"srv":[{"service":"sip", "domain":"example.com"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "srv defaults",
+			json: `{"srv":[{"service":"xmpp-server", "proto":"tcp", "domain":"example.com"}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&SRVTarget{
+						Name:    "srv:_xmpp-server._tcp.example.com",
+						Service: "xmpp-server",
+						Proto:   "tcp",
+						Domain:  "example.com",
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "payload larger than mtu",
+			json: `{"static":[{"ip":"1.1.1.1", "payload-size":1473}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "ipv6 payload larger than mtu",
+			json: `{"static":[{"ip":"2001:db8::1", "payload-size":1453}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "ipv6 cidr payload larger than mtu",
+			json: `{"cidr":[{"prefix":"2001:db8::/126", "payload-size":1453}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "unsorted latency buckets",
+			json: `{"latency-buckets":[1, 5, 2]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "bad tcp port",
+			json: `{"tcp":[{"host":"example.com", "port":0}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "tcp defaults",
+			json: `{"tcp":[{"host":"example.com", "port":443}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&TcpTarget{
+						Name:    "tcp:example.com:443",
+						Host:    "example.com",
+						Port:    443,
+						Timeout: defaultTcpTimeout,
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "bad broadcast address",
+			json: `{"broadcast":[{"address":"2001:db8::1"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "broadcast defaults",
+			json: `{"broadcast":[{"address":"192.168.1.255"}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&BroadcastTarget{
+						Name:   "broadcast:192.168.1.255",
+						Addr:   netip.MustParseAddr("192.168.1.255"),
+						Window: defaultPingInterval / 2,
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "broadcast default window with slow pings",
+			json: `{"ping-interval":"5s","broadcast":[{"address":"192.168.1.255"}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&BroadcastTarget{
+						Name:   "broadcast:192.168.1.255",
+						Addr:   netip.MustParseAddr("192.168.1.255"),
+						Window: defaultBroadcastWindow,
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    5 * time.Second,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "broadcast negative window",
+			json: `{"broadcast":[{"address":"192.168.1.255","window":"-1s"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "broadcast window as long as the ping interval",
+			json: `{"ping-interval":"1s","broadcast":[{"address":"192.168.1.255","window":"1s"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "http defaults",
+			json: `{"http":[{"url":"https://example.com/health"}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&HttpTarget{
+						Name:           "http:https://example.com/health",
+						URL:            &url.URL{Scheme: "https", Host: "example.com", Path: "/health"},
+						Method:         "GET",
+						ExpectedStatus: 200,
+						Timeout:        defaultHttpTimeout,
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "hops with destination and host",
+			json: `{"hops":[{"name": "abc", "destination":"8.8.8.8", "host":"example.com", "hop":3}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "hops with unknown family",
+			json: `{"hops":[{"name": "abc", "host":"example.com", "family":"ip5", "hop":3}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "hops with negative min valid hops",
+			json: `{"hops":[{"name": "abc", "destination":"8.8.8.8", "hop":3, "min-valid-hops":-1}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "hops with min valid hops",
+			json: `{"hops":[{"name": "abc", "destination":"8.8.8.8", "hop":3, "min-valid-hops":2}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&TraceHops{
+						Name:         "abc",
+						Dest:         netip.MustParseAddr("8.8.8.8"),
+						Hop:          3,
+						MinValidHops: 2,
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "hops matched by name and asn",
+			json: `{"hops":[{"name": "abc", "destination":"8.8.8.8", "hop-match":"\\.isp\\.net$", "hop-asn":64500}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&TraceHops{
+						Name:          "abc",
+						Dest:          netip.MustParseAddr("8.8.8.8"),
+						HopMatchRegex: `\.isp\.net$`,
+						HopASN:        64500,
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "hops with bad hop match",
+			json: `{"hops":[{"name": "abc", "destination":"8.8.8.8", "hop-match":"("}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "hops with both index and match",
+			json: `{"hops":[{"name": "abc", "destination":"8.8.8.8", "hop":2, "hop-asn":64500}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "bad target ping interval",
+			json: `{"static":[{"ip":"1.1.1.1", "ping-interval":"abc"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "target ping interval",
+			json: `{"static":[{"ip":"1.1.1.1", "ping-interval":"200ms"}], "ping-interval":"5s"}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&StaticIP{
+						Name: "static-ip:1.1.1.1",
+						IP:   netip.MustParseAddr("1.1.1.1"),
+						Overrides: Overrides{
+							PingInterval: 200 * time.Millisecond,
+						},
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    5 * time.Second,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "target timestamp",
+			json: `{"static":[{"ip":"1.1.1.1", "timestamp":true}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&StaticIP{
+						Name: "static-ip:1.1.1.1",
+						IP:   netip.MustParseAddr("1.1.1.1"),
+						Overrides: Overrides{
+							Timestamp: true,
+						},
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "cidr",
+			json: `{"cidr":[{"prefix":"192.0.2.5/29"}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&CIDRTarget{
+						Name:   "cidr:192.0.2.0/29",
+						Prefix: netip.MustParsePrefix("192.0.2.0/29"),
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "cidr too large",
+			json: `{"cidr":[{"prefix":"192.0.2.0/23"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "route",
+			json: `{"routes":[{"destination":"8.8.8.8"}, {"name": "dns", "host":"example.com", "family":"ip6"}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&RouteTarget{
+						Name: "route:8.8.8.8",
+						Dest: netip.MustParseAddr("8.8.8.8"),
+					},
+					&RouteTarget{
+						Name:   "dns",
+						Host:   "example.com",
+						Family: FamilyIPv6,
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "route family without host",
+			json: `{"routes":[{"destination":"8.8.8.8", "family":"ip4"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "link local static",
+			json: `{"static":[{"ip":"fe80::1%eth0"}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&StaticIP{
+						Name: "static-ip:fe80::1%eth0",
+						IP:   netip.MustParseAddr("fe80::1%eth0"),
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "expanded host",
+			json: `{"hosts":[{"name":"cdn", "host":"example.com", "expand":true}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&HostnameTarget{
+						Name:   "cdn",
+						Host:   "example.com",
+						Expand: true,
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "unknown select",
+			json: `{"hosts":[{"host":"example.com", "select":"fastest"}]}`,
+			cfg:  Config{},
+			err:  true,
+		},
+		{
+			name: "select closest",
+			json: `{"hosts":[{"host":"example.com", "select":"closest"}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&HostnameTarget{
+						Name: "host:example.com",
+						Host: "example.com",
+						Overrides: Overrides{
+							Selection: SelectClosest,
+						},
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "select round robin",
+			json: `{"hosts":[{"host":"example.com", "select":"round-robin"}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&HostnameTarget{
+						Name: "host:example.com",
+						Host: "example.com",
+						Overrides: Overrides{
+							Selection: SelectRoundRobin,
+						},
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
+		{
+			name: "hops for both families",
+			json: `{"hops":[{"name": "abc", "host":"example.com", "family":"both", "hop":3}]}`,
+			cfg: Config{
+				Targets: []LatencyTarget{
+					&TraceHops{
+						Name:   "abc-ip4",
+						Host:   "example.com",
+						Family: FamilyIPv4,
+						Hop:    3,
+					},
+					&TraceHops{
+						Name:   "abc-ip6",
+						Host:   "example.com",
+						Family: FamilyIPv6,
+						Hop:    3,
+					},
+				},
+				ResolveInterval: defaultResolveInterval,
+				PingInterval:    defaultPingInterval,
+				Warmup:          defaultWarmup,
+			},
+			err: false,
+		},
 		{
 			name: "correct parsing everything",
 			json: `{
   "hops":[{"name":"isp-hop", "destination":"8.8.8.8", "hop":2}],
-  "static":[{"name":"router", "ip":"192.168.1.1"}, {"ip":"1.1.1.1"}],
+  "static":[{"name":"router", "ip":"192.168.1.1"}, {"ip":"1.1.1.1", "dont-fragment":true}],
   "hosts":[{"host":"pkg.go.dev"}, {"name": "mysite", "host":"example.com"}],
+  "http":[{"name":"health", "url":"http://example.com/", "method":"HEAD", "expected-status":204, "follow-redirects":true, "timeout":"2s"}],
   "resolve-interval":"10m",
-  "ping-interval":"5s"
+  "ping-interval":"5s",
+  "ramp-up":"1m",
+  "jitter":true,
+  "source":"wg0",
+  "latency-buckets":[0, 10, 100],
+  "warmup":3
 }`,
 			cfg: Config{
 				Targets: []LatencyTarget{
@@ -84,6 +567,9 @@ func Test_Parse(t *testing.T) {
 					&StaticIP{
 						Name: "static-ip:1.1.1.1",
 						IP:   netip.MustParseAddr("1.1.1.1"),
+						Overrides: Overrides{
+							DontFragment: true,
+						},
 					},
 					&HostnameTarget{
 						Name: "host:pkg.go.dev",
@@ -93,9 +579,22 @@ func Test_Parse(t *testing.T) {
 						Name: "mysite",
 						Host: "example.com",
 					},
+					&HttpTarget{
+						Name:            "health",
+						URL:             &url.URL{Scheme: "http", Host: "example.com", Path: "/"},
+						Method:          "HEAD",
+						ExpectedStatus:  204,
+						FollowRedirects: true,
+						Timeout:         2 * time.Second,
+					},
 				},
 				ResolveInterval: 10 * time.Minute,
 				PingInterval:    5 * time.Second,
+				RampUp:          time.Minute,
+				Jitter:          true,
+				Warmup:          3,
+				Source:          "wg0",
+				LatencyBuckets:  []float64{0, 10, 100},
 			},
 			err: false,
 		},
@@ -117,3 +616,85 @@ func Test_Parse(t *testing.T) {
 		})
 	}
 }
+
+func Test_ParseLenient(t *testing.T) {
+	json := `{
+  "abc": 1,
+  "static": [{"ip": "1.1.1.1", "weight": 3}],
+  "ping-interval": "5s"
+}`
+	c, err := ParseConfigLenient(bytes.NewBufferString(json))
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if c.PingInterval != 5*time.Second || len(c.Targets) != 1 {
+		t.Errorf("unexpected config: %v", c)
+	}
+
+	if _, err := ParseConfigLenient(bytes.NewBufferString(`{"ping-interval": "abc"}`)); err == nil {
+		t.Errorf("expected lenient parsing to still validate fields")
+	}
+}
+
+func Test_ParseEnv(t *testing.T) {
+	t.Setenv("NETMON_HOST", "example.com")
+	t.Setenv("NETMON_EMPTY", "")
+	json := `{
+  "hosts": [{"host": "${NETMON_HOST}"}],
+  "ping-interval": "${NETMON_EMPTY:-5s}",
+  "resolve-interval": "${NETMON_UNSET:-20m}"
+}`
+	c, err := ParseConfig(bytes.NewBufferString(json))
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if h := c.Targets[0].(*HostnameTarget); h.Host != "example.com" || h.Name != "host:example.com" {
+		t.Errorf("unexpected target: %v", h)
+	}
+	if c.PingInterval != 5*time.Second || c.ResolveInterval != 20*time.Minute {
+		t.Errorf("unexpected intervals: %v, %v", c.PingInterval, c.ResolveInterval)
+	}
+
+	_, err = ParseConfig(bytes.NewBufferString(`{"static": [{"ip": "${NETMON_UNSET}"}]}`))
+	if err == nil || !strings.Contains(err.Error(), "static[0].ip") {
+		t.Errorf("expected unset variable to fail, got: %v", err)
+	}
+}
+
+func Test_UnknownFields(t *testing.T) {
+	json := `{
+  "abc": 1,
+  "hops": [{"name": "a", "destination": "8.8.8.8", "hop": 1}],
+  "static": [{"ip": "1.1.1.1", "dont-fragment": true}, {"ip": "1.0.0.1", "weight": 3}],
+  "ping-interval": "5s"
+}`
+	got := unknownFields("", []byte(json), reflect.TypeOf(JsonConfig{}))
+	want := []string{"abc", "static[1].weight"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+}
+
+func Test_ConfigEqual(t *testing.T) {
+	json := `{
+  "hosts": [{"name": "a", "host": "example.com"}],
+  "http": [{"name": "b", "url": "https://example.com"}],
+  "ping-interval": "5s"
+}`
+	a, err := ParseConfig(bytes.NewBufferString(json))
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	b, err := ParseConfig(bytes.NewBufferString(json))
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if !a.Equal(*b) {
+		t.Errorf("configs parsed from the same json should be equal")
+	}
+
+	b.PingInterval = time.Second
+	if a.Equal(*b) {
+		t.Errorf("configs with different intervals should not be equal")
+	}
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"time"
+)
+
+// TargetSettings are the settings that apply to a single target, after
+// defaults, clamping, and any overrides have been applied. Everything that
+// probes a target should read its settings from here.
+type TargetSettings struct {
+	PingInterval time.Duration
+	Warmup       int
+	DontFragment bool
+	Selection    Selection
+	DSCP         int
+	PayloadSize  int
+	Timestamp    bool
+}
+
+// Settings returns the effective settings for the target.
+func (c *Config) Settings(t LatencyTarget) TargetSettings {
+	s := TargetSettings{
+		PingInterval: c.PingInterval,
+		Warmup:       c.Warmup,
+	}
+	if o, ok := t.(overridable); ok {
+		s.DontFragment = o.overrides().DontFragment
+		s.Selection = o.overrides().Selection
+		s.DSCP = o.overrides().DSCP
+		s.PayloadSize = o.overrides().PayloadSize
+		s.Timestamp = o.overrides().Timestamp
+		if i := o.overrides().PingInterval; i > 0 {
+			s.PingInterval = i
+		}
+	}
+	return s
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"errors"
+	"sync"
+)
+
+// ConfigSource provides the config to run with, and the updated config when
+// it's reloaded.
+type ConfigSource interface {
+	// Load returns the current config.
+	Load() (*Config, error)
+}
+
+// FileSource loads the config from the file named by --config, see LoadConfig.
+type FileSource struct{}
+
+var _ ConfigSource = FileSource{}
+
+func (FileSource) Load() (*Config, error) {
+	return LoadConfig()
+}
+
+// ChanSource provides the configs sent on a channel, without reading files or
+// flags. Load blocks until the first config is sent, and after that returns
+// the most recent config sent. Safe for concurrent use.
+type ChanSource struct {
+	configs <-chan Config
+
+	lock    sync.Mutex
+	current *Config
+}
+
+var _ ConfigSource = &ChanSource{}
+
+func NewChanSource(configs <-chan Config) *ChanSource {
+	return &ChanSource{configs: configs}
+}
+
+func (s *ChanSource) Load() (*Config, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.current == nil {
+		c, ok := <-s.configs
+		if !ok {
+			return nil, errors.New("config channel closed without a config")
+		}
+		s.current = &c
+	}
+	for {
+		select {
+		case c, ok := <-s.configs:
+			if !ok {
+				return s.current, nil
+			}
+			s.current = &c
+		default:
+			return s.current, nil
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ChanSource(t *testing.T) {
+	configs := make(chan Config, 2)
+	source := NewChanSource(configs)
+
+	configs <- Config{PingInterval: time.Second}
+	configs <- Config{PingInterval: 2 * time.Second}
+	c, err := source.Load()
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if c.PingInterval != 2*time.Second {
+		t.Errorf("expected the most recent config, got: %+v", c)
+	}
+
+	// Without a new config, the last one is returned again.
+	c, err = source.Load()
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if c.PingInterval != 2*time.Second {
+		t.Errorf("expected the last config again, got: %+v", c)
+	}
+
+	close(configs)
+	if _, err := source.Load(); err != nil {
+		t.Errorf("did not expect error once closed: %v", err)
+	}
+}
+
+func Test_ChanSource_ClosedWithoutConfig(t *testing.T) {
+	configs := make(chan Config)
+	close(configs)
+	if _, err := NewChanSource(configs).Load(); err == nil {
+		t.Errorf("expected error without a config")
+	}
+}
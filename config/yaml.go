@@ -0,0 +1,32 @@
+package config
+
+import (
+	"errors"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ParseConfigYAML parses a yaml config, with the same fields as the json
+// config. Unknown fields are an error.
+func ParseConfigYAML(r io.Reader) (*Config, error) {
+	return parseYAML(r, true)
+}
+
+// ParseConfigYAMLLenient parses a yaml config, ignoring unknown fields.
+func ParseConfigYAMLLenient(r io.Reader) (*Config, error) {
+	return parseYAML(r, false)
+}
+
+func parseYAML(r io.Reader, strict bool) (*Config, error) {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(strict)
+
+	// An empty document is the same as an empty json object.
+	var j JsonConfig
+	if err := decoder.Decode(&j); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return fromJson(j)
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_ParseYAML(t *testing.T) {
+	yaml := `
+hops:
+  - name: isp-hop
+    destination: 8.8.8.8
+    hop: 2
+static:
+  - name: router
+    ip: 192.168.1.1
+    dont-fragment: true
+hosts:
+  - host: example.com
+    ping-interval: 200ms
+resolve-interval: 10m
+ping-interval: 5s
+`
+	c, err := ParseConfigYAML(bytes.NewBufferString(yaml))
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	want := &Config{
+		Targets: []LatencyTarget{
+			&TraceHops{
+				Name: "isp-hop",
+				Dest: netip.MustParseAddr("8.8.8.8"),
+				Hop:  2,
+			},
+			&StaticIP{
+				Name:      "router",
+				IP:        netip.MustParseAddr("192.168.1.1"),
+				Overrides: Overrides{DontFragment: true},
+			},
+			&HostnameTarget{
+				Name:      "host:example.com",
+				Host:      "example.com",
+				Overrides: Overrides{PingInterval: 200 * time.Millisecond},
+			},
+		},
+		ResolveInterval: 10 * time.Minute,
+		PingInterval:    5 * time.Second,
+		Warmup:          defaultWarmup,
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got: %v", c)
+		t.Errorf("want: %v", want)
+	}
+}
+
+func Test_ParseYAMLUnknownFields(t *testing.T) {
+	yaml := `
+static:
+  - ip: 1.1.1.1
+    weight: 3
+`
+	if _, err := ParseConfigYAML(bytes.NewBufferString(yaml)); err == nil {
+		t.Errorf("expected unknown fields to be an error")
+	}
+	if _, err := ParseConfigYAMLLenient(bytes.NewBufferString(yaml)); err != nil {
+		t.Errorf("did not expect lenient parsing to fail: %v", err)
+	}
+}
+
+func Test_ParseYAMLEmpty(t *testing.T) {
+	c, err := ParseConfigYAML(bytes.NewBufferString(""))
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if c.PingInterval != defaultPingInterval || len(c.Targets) != 0 {
+		t.Errorf("expected the default config, got: %v", c)
+	}
+}
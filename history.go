@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/ping"
+)
+
+const (
+	// Results are written to the file in batches of this many, or once
+	// historyFlushInterval passes with results waiting.
+	historyBatch         = 100
+	historyFlushInterval = 5 * time.Second
+)
+
+var (
+	historyFileFlag = flag.String("history-file",
+		"",
+		"Append every ping result to this file as a json line, for analysis after restarts. Empty disables it.")
+	historyMaxBytesFlag = flag.Int64("history-max-bytes",
+		100<<20,
+		"Size after which the history file is rotated to <file>.1, replacing the previous one. Zero never rotates.")
+)
+
+// historyRecord is a line of the history file.
+type historyRecord struct {
+	When time.Time `json:"when"`
+	Name string    `json:"name"`
+	Dest string    `json:"dest,omitempty"`
+	// Null for lost probes.
+	RttMs      *float64 `json:"rtt_ms"`
+	Lost       bool     `json:"lost"`
+	OutOfOrder bool     `json:"out_of_order,omitempty"`
+}
+
+func newHistoryRecord(r *ping.PingResult) historyRecord {
+	h := historyRecord{
+		When:       r.Sent,
+		Name:       r.Target.MetricName(),
+		Lost:       r.Recv.IsZero(),
+		OutOfOrder: r.OutOfOrder,
+	}
+	if r.Dest.IsValid() {
+		h.Dest = r.Dest.String()
+	}
+	if !h.Lost {
+		millis := float64(r.Elapsed().Microseconds()) / 1000.0
+		h.RttMs = &millis
+	}
+	return h
+}
+
+// historyWriter appends results to the history file, rotating it once it
+// grows past --history-max-bytes.
+type historyWriter struct {
+	path string
+
+	file    *os.File
+	buf     *bufio.Writer
+	size    int64
+	pending int
+}
+
+func openHistory(path string) (*historyWriter, error) {
+	h := &historyWriter{path: path}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *historyWriter) open() error {
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("could not open history: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not open history: %w", err)
+	}
+	h.file = file
+	h.buf = bufio.NewWriter(file)
+	h.size = info.Size()
+	return nil
+}
+
+// run writes the results until the channel is closed, then flushes and
+// closes the file.
+func (h *historyWriter) run(results <-chan *ping.PingResult) {
+	defer h.close()
+
+	ticker := time.NewTicker(historyFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				return
+			}
+			h.write(r)
+			if h.pending >= historyBatch {
+				h.flush()
+			}
+		case <-ticker.C:
+			if h.pending > 0 {
+				h.flush()
+			}
+		}
+	}
+}
+
+func (h *historyWriter) write(r *ping.PingResult) {
+	if h.file == nil {
+		// Stopped after failing to rotate.
+		return
+	}
+	line, err := json.Marshal(newHistoryRecord(r))
+	if err != nil {
+		slog.Error("failed to encode history", "err", err)
+		return
+	}
+	n, _ := h.buf.Write(append(line, '\n'))
+	h.size += int64(n)
+	h.pending += 1
+}
+
+// flush writes the buffered results to the file, and rotates it if it's too
+// large.
+func (h *historyWriter) flush() {
+	h.pending = 0
+	if err := h.buf.Flush(); err != nil {
+		slog.Warn("failed to write history", "path", h.path, "err", err)
+		// Retrying a partial write would duplicate lines.
+		h.buf.Reset(h.file)
+	}
+	if max := *historyMaxBytesFlag; max <= 0 || h.size < max {
+		return
+	}
+	h.file.Close()
+	if err := os.Rename(h.path, h.path+".1"); err != nil {
+		slog.Warn("failed to rotate history", "path", h.path, "err", err)
+	}
+	if err := h.open(); err != nil {
+		// Results are still recorded everywhere else.
+		slog.Error("history stopped", "err", err)
+		h.file = nil
+	}
+}
+
+func (h *historyWriter) close() {
+	if h.file == nil {
+		return
+	}
+	if err := h.buf.Flush(); err != nil {
+		slog.Warn("failed to write history", "path", h.path, "err", err)
+	}
+	if err := h.file.Close(); err != nil {
+		slog.Warn("failed to close history", "path", h.path, "err", err)
+	}
+}
@@ -2,9 +2,13 @@ package icmp
 
 // Functions to interface with icmp without caring if the netip.Addr is 4 or 6.
 import (
+	"encoding/binary"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"net/netip"
+	"os"
 	"time"
 
 	"github.com/VolatileDream/workbench/web/network-monitor/ip"
@@ -20,6 +24,47 @@ const (
 	commonMaximumTransmissionUnit = 1500
 )
 
+var (
+	readBufferFlag = flag.Int("icmp-read-buffer", commonMaximumTransmissionUnit,
+		"size in bytes of the buffer icmp packets are read into, raise it on interfaces with jumbo frames")
+	privilegedFlag = flag.Bool("icmp-privileged", true,
+		"ping with raw icmp sockets when permitted, which also receive destination unreachable errors, instead of unprivileged ones")
+
+	// ErrTruncated is returned when a packet didn't fit in the read buffer,
+	// and couldn't be parsed because of it.
+	ErrTruncated = errors.New("packet truncated, larger than --icmp-read-buffer")
+
+	// ErrNotPermitted is returned when neither unprivileged nor privileged
+	// icmp sockets can be opened.
+	ErrNotPermitted = errors.New("not permitted to open icmp sockets, add a group of the process to the net.ipv4.ping_group_range sysctl, or grant it CAP_NET_RAW")
+
+	// ErrNotEcho is returned when reading an echo reply, but an unrelated icmp
+	// message was received. Only privileged sockets receive those.
+	ErrNotEcho = errors.New("packet is not a reply or error for an echo request")
+)
+
+// readBuffer returns a buffer to read a single packet into.
+func readBuffer() []byte {
+	size := *readBufferFlag
+	if size < commonMaximumTransmissionUnit {
+		size = commonMaximumTransmissionUnit
+	}
+	return make([]byte, size)
+}
+
+// parse parses the packet read into buf. Truncated packets are still parsed,
+// because the headers are usually all that's needed. If that fails the error
+// is ErrTruncated, to distinguish it from malformed packets.
+func parse(proto int, buf []byte, read int) (*xicmp.Message, error) {
+	msg, err := xicmp.ParseMessage(proto, buf[:read])
+	if err != nil && read == len(buf) {
+		return nil, fmt.Errorf("%w: read %d bytes: %v", ErrTruncated, read, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("bad icmp packet: %w", err)
+	}
+	return msg, nil
+}
+
 // ListenIcmp creates a packet connection to send and receive ICMP messages.
 // This *should* work without privileged access, but will only receive ICMP
 // Echo messages. That is: can be used to ping a host, but not much more.
@@ -34,6 +79,53 @@ func ListenPrivileged(ip netip.Addr) (*xicmp.PacketConn, error) {
 	return listen(ip, icmpCfg)
 }
 
+// ListenAny opens a privileged socket if permitted, which also receives the
+// errors of the echo requests, or an unprivileged one otherwise. With
+// --icmp-privileged=false, the privileged socket is only the fallback. Fails
+// with ErrNotPermitted if neither is permitted.
+func ListenAny(ip netip.Addr) (*xicmp.PacketConn, error) {
+	listens := []func(netip.Addr) (*xicmp.PacketConn, error){ListenPrivileged, Listen}
+	if !*privilegedFlag {
+		listens[0], listens[1] = listens[1], listens[0]
+	}
+
+	var errs []error
+	for _, listen := range listens {
+		conn, err := listen(ip)
+		if err == nil || !errors.Is(err, os.ErrPermission) {
+			return conn, err
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("%w: %v", ErrNotPermitted, errors.Join(errs...))
+}
+
+// ListenMode is the kind of socket a connection was opened with.
+type ListenMode int
+
+const (
+	// Unprivileged sockets only receive ICMP Echo replies.
+	Unprivileged ListenMode = iota
+	// Privileged sockets receive all ICMP messages.
+	Privileged
+)
+
+func (m ListenMode) String() string {
+	if m == Privileged {
+		return "privileged"
+	}
+	return "unprivileged"
+}
+
+// ModeOf reports which mode the connection was opened in, based on the type
+// of the local address: unprivileged sockets are bound to a udp address.
+func ModeOf(conn *xicmp.PacketConn) ListenMode {
+	if _, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return Unprivileged
+	}
+	return Privileged
+}
+
 type bindCfg struct {
 	ip4 string
 	ip6 string
@@ -51,6 +143,8 @@ var (
 )
 
 func listen(ip netip.Addr, cfg bindCfg) (*xicmp.PacketConn, error) {
+	// Includes the zone of link local addresses, which binds the socket to
+	// their interface.
 	addr := ip.String()
 	proto := cfg.ip6
 	if ip.Is4() {
@@ -75,22 +169,166 @@ func SendIcmpEcho(i *xicmp.PacketConn, e *xicmp.Echo, addr netip.Addr) error {
 		return fmt.Errorf("could not marshal packet: %w", err)
 	}
 
-	_, err = i.WriteTo(b, &net.UDPAddr{
-		IP: addr.AsSlice(),
-	})
+	_, err = i.WriteTo(b, sendAddr(i, addr))
 	return err
 }
 
+// Timestamp is the body of ICMP Timestamp requests and replies, which
+// x/net/icmp doesn't parse. Times are in milliseconds since midnight UTC, the
+// high bit is set if the host's clock can't provide that.
+type Timestamp struct {
+	ID  int
+	Seq int
+
+	// Originate is when the request was sent, echoed back in the reply.
+	Originate uint32
+	// Receive is when the destination received the request, by its clock.
+	Receive uint32
+	// Transmit is when the destination sent the reply, by its clock.
+	Transmit uint32
+}
+
+const timestampLen = 16
+
+// Len implements xicmp.MessageBody.
+func (t *Timestamp) Len(proto int) int {
+	return timestampLen
+}
+
+// Marshal implements xicmp.MessageBody.
+func (t *Timestamp) Marshal(proto int) ([]byte, error) {
+	b := make([]byte, timestampLen)
+	binary.BigEndian.PutUint16(b[0:2], uint16(t.ID))
+	binary.BigEndian.PutUint16(b[2:4], uint16(t.Seq))
+	binary.BigEndian.PutUint32(b[4:8], t.Originate)
+	binary.BigEndian.PutUint32(b[8:12], t.Receive)
+	binary.BigEndian.PutUint32(b[12:16], t.Transmit)
+	return b, nil
+}
+
+func parseTimestamp(b []byte) (*Timestamp, error) {
+	if len(b) < timestampLen {
+		return nil, fmt.Errorf("timestamp reply too short: %d bytes", len(b))
+	}
+	return &Timestamp{
+		ID:        int(binary.BigEndian.Uint16(b[0:2])),
+		Seq:       int(binary.BigEndian.Uint16(b[2:4])),
+		Originate: binary.BigEndian.Uint32(b[4:8]),
+		Receive:   binary.BigEndian.Uint32(b[8:12]),
+		Transmit:  binary.BigEndian.Uint32(b[12:16]),
+	}, nil
+}
+
+// TimestampMillis returns the time as milliseconds since midnight UTC, as
+// ICMP Timestamp messages represent it.
+func TimestampMillis(t time.Time) uint32 {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(t.Sub(midnight).Milliseconds())
+}
+
+// SendIcmpTimestamp sends an ICMP Timestamp request, which only exists for
+// ipv4. Only privileged sockets can send them, unprivileged ones are limited
+// to echo requests.
+func SendIcmpTimestamp(i *xicmp.PacketConn, t *Timestamp, addr netip.Addr) error {
+	if !addr.Is4() {
+		return fmt.Errorf("no icmp timestamp requests for ipv6: %s", addr)
+	}
+	m := xicmp.Message{
+		Type: ipv4.ICMPTypeTimestamp,
+		Code: 0,
+		Body: t,
+	}
+
+	b, err := m.Marshal(nil)
+	if err != nil {
+		return fmt.Errorf("could not marshal packet: %w", err)
+	}
+
+	_, err = i.WriteTo(b, sendAddr(i, addr))
+	return err
+}
+
+// sendAddr converts the address to send to, to the type of address the
+// connection sends to.
+func sendAddr(conn *xicmp.PacketConn, addr netip.Addr) net.Addr {
+	if ModeOf(conn) == Privileged {
+		return &net.IPAddr{
+			IP:   addr.AsSlice(),
+			Zone: addr.Zone(),
+		}
+	}
+	return udpAddr(addr)
+}
+
+// udpAddr converts the address to send to, keeping the zone that link local
+// addresses can't be reached without.
+func udpAddr(addr netip.Addr) *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   addr.AsSlice(),
+		Zone: addr.Zone(),
+	}
+}
+
 type IcmpResponse struct {
 	From netip.Addr
 	Echo *xicmp.Echo
 	When time.Time
+	// TTL (or hop limit) of the received packet, zero if unknown.
+	// Only populated if ReceiveTTL was called on the connection.
+	TTL int
+
+	// Unreachable is set if a destination unreachable error was received
+	// for the echo request instead of a reply. From is then the destination
+	// of the echo request, and Reporter the router that sent the error.
+	// Only privileged sockets receive those.
+	Unreachable bool
+	Reporter    netip.Addr
+	// FragmentationNeeded is set if the error was because the echo request
+	// was larger than the MTU of the next hop, and had don't fragment set.
+	// MTU is the one the router reported, zero if it didn't. Ipv6 reports
+	// those as packet too big errors, which also set Unreachable.
+	FragmentationNeeded bool
+	MTU                 int
+
+	// Timestamp is set if the reply was an ICMP Timestamp reply, instead of
+	// an echo reply. Echo then only has its ID and Seq.
+	Timestamp *Timestamp
+}
+
+// ReceiveTTL enables reporting the TTL (or hop limit) of received packets.
+func ReceiveTTL(conn *xicmp.PacketConn) error {
+	if p := conn.IPv4PacketConn(); p != nil {
+		return p.SetControlMessage(ipv4.FlagTTL, true)
+	} else if p := conn.IPv6PacketConn(); p != nil {
+		return p.SetControlMessage(ipv6.FlagHopLimit, true)
+	}
+	return fmt.Errorf("unknown connection type: %+v", conn)
+}
+
+// readFrom reads a packet, including the TTL of the packet if the connection
+// is setup to receive it.
+func readFrom(conn *xicmp.PacketConn, b []byte) (int, int, net.Addr, error) {
+	if p := conn.IPv4PacketConn(); p != nil {
+		n, cm, addr, err := p.ReadFrom(b)
+		if cm != nil {
+			return n, cm.TTL, addr, err
+		}
+		return n, 0, addr, err
+	} else if p := conn.IPv6PacketConn(); p != nil {
+		n, cm, addr, err := p.ReadFrom(b)
+		if cm != nil {
+			return n, cm.HopLimit, addr, err
+		}
+		return n, 0, addr, err
+	}
+	n, addr, err := conn.ReadFrom(b)
+	return n, 0, addr, err
 }
 
 func ReadIcmp(conn *xicmp.PacketConn) (netip.Addr, *xicmp.Message, error) {
-	recv := make([]byte, commonMaximumTransmissionUnit)
+	recv := readBuffer()
 	c, addr, err := conn.ReadFrom(recv)
-	recv = recv[:c]
 
 	if err != nil {
 		return netip.Addr{}, nil, err
@@ -107,32 +345,32 @@ func ReadIcmp(conn *xicmp.PacketConn) (netip.Addr, *xicmp.Message, error) {
 	if !connIsIPv4(conn) {
 		proto = 58 // Icmp6 number.
 	}
-	msg, err := xicmp.ParseMessage(proto, recv)
+	msg, err := parse(proto, recv, c)
 	if err != nil {
-		return netip.Addr{}, nil, fmt.Errorf("bad icmp packet: %w", err)
+		return netip.Addr{}, nil, err
 	}
 
 	return recvAddr, msg, nil
 }
 
 func ReadIcmpEcho(conn *xicmp.PacketConn) (*IcmpResponse, error) {
-	recv := make([]byte, commonMaximumTransmissionUnit)
-	c, addr, err := conn.ReadFrom(recv)
+	recv := readBuffer()
+	c, ttl, addr, err := readFrom(conn, recv)
 	now := time.Now()
-	recv = recv[:c]
 
 	if err != nil {
 		return nil, err
 	}
 	resp := &IcmpResponse{
 		When: now,
+		TTL:  ttl,
 	}
-	nip, err := netip.ParseAddrPort(addr.String())
-	if err == nil {
-		resp.From = nip.Addr()
-	} else {
-		return nil, fmt.Errorf("unable to parse packet source %s: %w", addr.String(), err)
+	// Privileged sockets read from ip addresses, without a port.
+	from, err := ip.Convert(addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse packet source: %w", err)
 	}
+	resp.From = from
 
 	proto := 1 // Icmp4 number.
 	// This comparison doesn't work the other way, because an ipv4
@@ -140,13 +378,38 @@ func ReadIcmpEcho(conn *xicmp.PacketConn) (*IcmpResponse, error) {
 	if !connIsIPv4(conn) {
 		proto = 58 // Icmp6 number.
 	}
-	msg, err := xicmp.ParseMessage(proto, recv)
+	msg, err := parse(proto, recv, c)
 	if err != nil {
-		return nil, fmt.Errorf("bad icmp packet: %w", err)
+		return nil, err
 	}
 
+	if msg.Type == ipv4.ICMPTypeDestinationUnreachable || msg.Type == ipv6.ICMPTypeDestinationUnreachable || msg.Type == ipv6.ICMPTypePacketTooBig {
+		dest, echo, err := QuotedEcho(msg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unreachable error not for an echo request: %v", ErrNotEcho, err)
+		}
+		resp.Reporter = resp.From
+		resp.From = dest
+		resp.Echo = echo
+		resp.Unreachable = true
+		resp.FragmentationNeeded, resp.MTU = fragmentationNeeded(msg, recv[:c])
+		return resp, nil
+	}
+	if msg.Type == ipv4.ICMPTypeTimestampReply {
+		raw, ok := msg.Body.(*xicmp.RawBody)
+		if !ok {
+			return nil, fmt.Errorf("packet type not *icmp.RawBody: %v", msg)
+		}
+		ts, err := parseTimestamp(raw.Data)
+		if err != nil {
+			return nil, err
+		}
+		resp.Timestamp = ts
+		resp.Echo = &xicmp.Echo{ID: ts.ID, Seq: ts.Seq}
+		return resp, nil
+	}
 	if msg.Type != ipv4.ICMPTypeEchoReply && msg.Type != ipv6.ICMPTypeEchoReply {
-		return nil, fmt.Errorf("packet type not echo: %d", msg.Type)
+		return nil, fmt.Errorf("%w: %v", ErrNotEcho, msg.Type)
 	}
 
 	echo, ok := msg.Body.(*xicmp.Echo)
@@ -158,7 +421,10 @@ func ReadIcmpEcho(conn *xicmp.PacketConn) (*IcmpResponse, error) {
 	return resp, nil
 }
 
+// connIsIPv4 reports if the connection was opened for ipv4. Both the "udp4" and
+// "ip4:icmp" networks have an ipv4 packet conn, and the ipv6 ones never do, so
+// this holds for privileged and unprivileged sockets. The local address can't
+// be used instead, ipv4 addresses can be embedded in ipv6 ones.
 func connIsIPv4(c *xicmp.PacketConn) bool {
 	return c.IPv4PacketConn() != nil
-	//return netip.MustParseAddrPort(conn.LocalAddr().String()).Addr().Is4()
 }
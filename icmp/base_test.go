@@ -0,0 +1,47 @@
+package icmp
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/ip"
+)
+
+func Test_udpAddr(t *testing.T) {
+	for _, s := range []string{"192.0.2.1", "2001:db8::1", "fe80::1%eth0"} {
+		addr := netip.MustParseAddr(s)
+		udp := udpAddr(addr)
+		if udp.Zone != addr.Zone() {
+			t.Errorf("expected zone %q for %s, got %q", addr.Zone(), addr, udp.Zone)
+		}
+		// Replies are matched by the address they're read from.
+		if got, err := ip.Convert(udp); err != nil || got != addr {
+			t.Errorf("expected %s to convert back, got %s (%v)", addr, got, err)
+		}
+	}
+}
+
+func Test_Timestamp(t *testing.T) {
+	ts := &Timestamp{ID: 7, Seq: 513, Originate: 1, Receive: 86399999, Transmit: 1 << 31}
+	b, err := ts.Marshal(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseTimestamp(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, ts) {
+		t.Errorf("got: %+v, want: %+v", got, ts)
+	}
+	if _, err := parseTimestamp(b[:12]); err == nil {
+		t.Errorf("expected truncated timestamp to fail")
+	}
+
+	when := time.Date(2023, 4, 5, 1, 2, 3, 4e6, time.FixedZone("", 3600))
+	if ms := TimestampMillis(when); ms != 123004 {
+		t.Errorf("expected milliseconds since midnight utc, got %d", ms)
+	}
+}
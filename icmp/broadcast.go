@@ -0,0 +1,19 @@
+package icmp
+
+import (
+	"fmt"
+	"syscall"
+
+	xicmp "golang.org/x/net/icmp"
+)
+
+// SetBroadcast allows sending to broadcast addresses from the connection.
+// Multicast addresses don't require this.
+func SetBroadcast(conn *xicmp.PacketConn) error {
+	if !connIsIPv4(conn) {
+		return fmt.Errorf("broadcast is only supported for ipv4")
+	}
+	return control(conn, func(fd int) error {
+		return syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	})
+}
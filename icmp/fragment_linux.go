@@ -0,0 +1,32 @@
+package icmp
+
+import (
+	"syscall"
+
+	xicmp "golang.org/x/net/icmp"
+)
+
+// SetDontFragment controls the don't fragment bit on packets sent from the
+// connection. With it set, sending a packet larger than the known path MTU
+// fails with EMSGSIZE, instead of the packet being fragmented. Turning it off
+// restores the kernel default.
+func SetDontFragment(conn *xicmp.PacketConn, on bool) error {
+	if connIsIPv4(conn) {
+		mode := syscall.IP_PMTUDISC_WANT
+		if on {
+			mode = syscall.IP_PMTUDISC_DO
+		}
+		return control(conn, func(fd int) error {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, mode)
+		})
+	}
+
+	// Routers never fragment ipv6, but the sending host can.
+	mode := syscall.IPV6_PMTUDISC_WANT
+	if on {
+		mode = syscall.IPV6_PMTUDISC_DO
+	}
+	return control(conn, func(fd int) error {
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, mode)
+	})
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package icmp
+
+import (
+	"errors"
+
+	xicmp "golang.org/x/net/icmp"
+)
+
+// SetDontFragment is only supported on linux.
+func SetDontFragment(conn *xicmp.PacketConn, on bool) error {
+	if !on {
+		return nil
+	}
+	return errors.New("don't fragment is not supported on this platform")
+}
@@ -0,0 +1,164 @@
+package icmp
+
+// Parsing of the packets quoted by icmp error messages, to tell which packet
+// the error is about.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	xicmp "golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	errNotTtlPacket     = errors.New("not a ttl exceeded packet")
+	errNotDstUnreachPkt = errors.New("not a destination unreachable packet")
+	errNotTooBigPkt     = errors.New("not a packet too big packet")
+	errNotQuoting       = errors.New("not an icmp error message")
+)
+
+// QuotedPacket returns the destination and the payload of the ip packet quoted
+// by a time exceeded, destination unreachable or packet too big message,
+// without the ip header. The payload is usually truncated, only the first 8 bytes of it are
+// guaranteed to be quoted.
+func QuotedPacket(m *xicmp.Message) (netip.Addr, []byte, error) {
+	var data []byte
+	if m.Type == ipv4.ICMPTypeTimeExceeded || m.Type == ipv6.ICMPTypeTimeExceeded {
+		te, ok := m.Body.(*xicmp.TimeExceeded)
+		if !ok {
+			return netip.Addr{}, nil, errNotTtlPacket
+		}
+		data = te.Data
+	} else if m.Type == ipv4.ICMPTypeDestinationUnreachable || m.Type == ipv6.ICMPTypeDestinationUnreachable {
+		du, ok := m.Body.(*xicmp.DstUnreach)
+		if !ok {
+			return netip.Addr{}, nil, errNotDstUnreachPkt
+		}
+		data = du.Data
+	} else if m.Type == ipv6.ICMPTypePacketTooBig {
+		ptb, ok := m.Body.(*xicmp.PacketTooBig)
+		if !ok {
+			return netip.Addr{}, nil, errNotTooBigPkt
+		}
+		data = ptb.Data
+	} else {
+		return netip.Addr{}, nil, fmt.Errorf("%w: %v", errNotQuoting, m.Type)
+	}
+
+	var dest netip.Addr
+	var offset int
+	switch m.Type.(type) {
+	case ipv4.ICMPType:
+		h, err := ipv4.ParseHeader(data)
+		if err != nil {
+			return netip.Addr{}, nil, fmt.Errorf("no ip4 header: %w", err)
+		}
+		dest, _ = netip.AddrFromSlice(h.Dst.To4())
+		offset = h.Len + len(h.Options)
+
+	case ipv6.ICMPType:
+		var err error
+		offset, err = ipv6PayloadOffset(data)
+		if err != nil {
+			return netip.Addr{}, nil, err
+		}
+		dest = netip.AddrFrom16([16]byte(data[24:40]))
+	}
+	if len(data) < offset {
+		return netip.Addr{}, nil, fmt.Errorf("quoted packet too short: %d bytes", len(data))
+	}
+	return dest, data[offset:], nil
+}
+
+// QuotedEcho returns the destination and the echo request quoted by a time
+// exceeded, destination unreachable or packet too big message. The data of the echo request
+// is usually truncated.
+func QuotedEcho(m *xicmp.Message) (netip.Addr, *xicmp.Echo, error) {
+	dest, data, err := QuotedPacket(m)
+	if err != nil {
+		return netip.Addr{}, nil, err
+	}
+
+	protocol := 1
+	if _, ok := m.Type.(ipv6.ICMPType); ok {
+		protocol = 58
+	}
+
+	// This message is TRUNCATED.
+	prevMsg, err := xicmp.ParseMessage(protocol, data)
+	if err != nil {
+		return netip.Addr{}, nil, fmt.Errorf("failed to parse contents: %w", err)
+	}
+
+	if prevMsg.Type != ipv4.ICMPTypeEcho && prevMsg.Type != ipv6.ICMPTypeEchoRequest {
+		return netip.Addr{}, nil, fmt.Errorf("contents not icmp echo")
+	}
+
+	return dest, prevMsg.Body.(*xicmp.Echo), nil
+}
+
+// Code of ipv4 destination unreachable messages for packets that were larger
+// than the MTU of the next hop, and had don't fragment set.
+const fragmentationNeeded4 = 4
+
+// fragmentationNeeded reports whether the message is an ipv4 fragmentation
+// needed or ipv6 packet too big error, and returns the MTU of the next hop
+// that it carries, zero if the router didn't set it. Raw is the unparsed
+// message, the parsed body of ipv4 errors skips the bytes the MTU is in
+// (RFC 1191).
+func fragmentationNeeded(m *xicmp.Message, raw []byte) (bool, int) {
+	if m.Type == ipv6.ICMPTypePacketTooBig {
+		if ptb, ok := m.Body.(*xicmp.PacketTooBig); ok {
+			return true, ptb.MTU
+		}
+		return true, 0
+	}
+	if m.Type != ipv4.ICMPTypeDestinationUnreachable || m.Code != fragmentationNeeded4 {
+		return false, 0
+	}
+	if len(raw) < 8 {
+		return true, 0
+	}
+	return true, int(binary.BigEndian.Uint16(raw[6:8]))
+}
+
+// ipv6PayloadOffset walks the extension header chain of the quoted ipv6
+// packet, and returns the offset of the upper layer protocol.
+func ipv6PayloadOffset(data []byte) (int, error) {
+	if len(data) < ipv6.HeaderLen {
+		return 0, fmt.Errorf("no ip6 header: %d bytes", len(data))
+	}
+	next := int(data[6])
+	offset := ipv6.HeaderLen
+	for {
+		var length int
+		switch next {
+		case 0, 43, 60: // Hop-by-hop, routing, destination options.
+			if len(data) < offset+2 {
+				return 0, fmt.Errorf("quoted ip6 extension header too short")
+			}
+			length = (int(data[offset+1]) + 1) * 8
+		case 44: // Fragment.
+			if len(data) < offset+8 {
+				return 0, fmt.Errorf("quoted ip6 fragment header too short")
+			}
+			if binary.BigEndian.Uint16(data[offset+2:offset+4])&^0x7 != 0 {
+				return 0, fmt.Errorf("quoted packet is not the first fragment")
+			}
+			length = 8
+		case 51: // Authentication.
+			if len(data) < offset+2 {
+				return 0, fmt.Errorf("quoted ip6 extension header too short")
+			}
+			length = (int(data[offset+1]) + 2) * 4
+		default:
+			return offset, nil
+		}
+		next = int(data[offset])
+		offset += length
+	}
+}
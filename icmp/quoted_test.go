@@ -0,0 +1,105 @@
+package icmp
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	xicmp "golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func Test_QuotedEcho(t *testing.T) {
+	dest := netip.MustParseAddr("192.0.2.10")
+	request, err := (&xicmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &xicmp.Echo{ID: 7, Seq: 42, Data: []byte("github.com/VolatileDream")},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	header, err := (&ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(request),
+		TTL:      1,
+		Protocol: 1,
+		Src:      net.ParseIP("192.0.2.1"),
+		Dst:      dest.AsSlice(),
+	}).Marshal()
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+
+	// Routers only have to quote the first 8 bytes of the request.
+	msg := &xicmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: 1,
+		Body: &xicmp.DstUnreach{Data: append(header, request[:8]...)},
+	}
+	got, echo, err := QuotedEcho(msg)
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if got != dest || echo.ID != 7 || echo.Seq != 42 {
+		t.Errorf("expected echo 7/42 to %s, got %d/%d to %s", dest, echo.ID, echo.Seq, got)
+	}
+
+	if _, _, err := QuotedEcho(&xicmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &xicmp.Echo{}}); err == nil {
+		t.Errorf("expected error for a message that doesn't quote a packet")
+	}
+}
+
+func Test_fragmentationNeeded(t *testing.T) {
+	raw, err := (&xicmp.Message{
+		Type: ipv4.ICMPTypeDestinationUnreachable,
+		Code: fragmentationNeeded4,
+		Body: &xicmp.DstUnreach{Data: make([]byte, ipv4.HeaderLen+8)},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	// The next hop MTU is in the otherwise unused bytes of the header.
+	raw[6], raw[7] = 0x05, 0xc8
+	msg, err := xicmp.ParseMessage(1, raw)
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if needed, mtu := fragmentationNeeded(msg, raw); !needed || mtu != 1480 {
+		t.Errorf("expected fragmentation needed with mtu 1480, got %v with %d", needed, mtu)
+	}
+
+	msg.Code = 1
+	if needed, _ := fragmentationNeeded(msg, raw); needed {
+		t.Errorf("expected host unreachable not to need fragmentation")
+	}
+
+	// Ipv6 has its own message type, with the MTU parsed.
+	request, err := (&xicmp.Message{
+		Type: ipv6.ICMPTypeEchoRequest,
+		Body: &xicmp.Echo{ID: 7, Seq: 42},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	dest := netip.MustParseAddr("2001:db8::10")
+	header := make([]byte, ipv6.HeaderLen)
+	header[0] = ipv6.Version << 4
+	header[6] = 58
+	copy(header[24:40], dest.AsSlice())
+	tooBig := &xicmp.Message{
+		Type: ipv6.ICMPTypePacketTooBig,
+		Body: &xicmp.PacketTooBig{MTU: 1280, Data: append(header, request...)},
+	}
+	if needed, mtu := fragmentationNeeded(tooBig, nil); !needed || mtu != 1280 {
+		t.Errorf("expected packet too big with mtu 1280, got %v with %d", needed, mtu)
+	}
+	got, echo, err := QuotedEcho(tooBig)
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if got != dest || echo.ID != 7 || echo.Seq != 42 {
+		t.Errorf("expected echo 7/42 to %s, got %d/%d to %s", dest, echo.ID, echo.Seq, got)
+	}
+}
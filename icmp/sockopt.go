@@ -0,0 +1,37 @@
+package icmp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	xicmp "golang.org/x/net/icmp"
+)
+
+// control runs fn with the file descriptor of the connection's socket, for
+// socket options that x/net doesn't expose.
+func control(conn *xicmp.PacketConn, fn func(fd int) error) error {
+	var pc net.PacketConn
+	if p := conn.IPv4PacketConn(); p != nil {
+		pc = p.PacketConn
+	} else if p := conn.IPv6PacketConn(); p != nil {
+		pc = p.PacketConn
+	}
+	sc, ok := pc.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("unable to access socket: %+v", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+	err = raw.Control(func(fd uintptr) {
+		ferr = fn(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
@@ -0,0 +1,25 @@
+package icmp
+
+import (
+	"fmt"
+
+	xicmp "golang.org/x/net/icmp"
+)
+
+// TOS returns the type of service (or traffic class) byte that marks packets
+// with the DSCP value. The low bits are used for ECN, and left unset.
+func TOS(dscp int) int {
+	return dscp << 2
+}
+
+// SetTOS sets the type of service (ipv4) or traffic class (ipv6) of packets
+// sent from the connection. Some systems require privileges to set classes
+// with a high priority.
+func SetTOS(conn *xicmp.PacketConn, tos int) error {
+	if p := conn.IPv4PacketConn(); p != nil {
+		return p.SetTOS(tos)
+	} else if p := conn.IPv6PacketConn(); p != nil {
+		return p.SetTrafficClass(tos)
+	}
+	return fmt.Errorf("unknown connection type: %+v", conn)
+}
@@ -0,0 +1,74 @@
+package ip
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+var (
+	interfaceFlag = flag.String("interface",
+		"",
+		"Network interface to send probes from. Empty uses the default route.")
+)
+
+// Source returns the local address to bind probe sockets of the given family
+// to, so that pings and traceroutes leave from the same interface.
+//
+// Returns the unspecified address when no interface is configured.
+func Source(is4 bool) (netip.Addr, error) {
+	return SourceOf("", is4)
+}
+
+// SourceOf is like Source, but source is an interface name or local address
+// to use instead of the --interface flag. An address of the other family is an
+// error, there is no source for that family.
+func SourceOf(source string, is4 bool) (netip.Addr, error) {
+	if len(source) == 0 {
+		source = *interfaceFlag
+	}
+	if len(source) == 0 {
+		if is4 {
+			return netip.IPv4Unspecified(), nil
+		}
+		return netip.IPv6Unspecified(), nil
+	}
+
+	if addr, err := netip.ParseAddr(source); err == nil {
+		if addr = addr.Unmap(); addr.Is4() != is4 {
+			return netip.Addr{}, fmt.Errorf("source %s is not an %s address", addr, family(is4))
+		}
+		return addr, nil
+	}
+
+	iface, err := net.InterfaceByName(source)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("could not find interface %s: %w", source, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("could not list addresses of %s: %w", iface.Name, err)
+	}
+
+	for _, a := range addrs {
+		prefix, err := netip.ParsePrefix(a.String())
+		if err != nil {
+			continue
+		}
+		addr := prefix.Addr().Unmap()
+		// Link local addresses need a zone, and can't reach far anyway.
+		if addr.Is4() != is4 || addr.IsLinkLocalUnicast() {
+			continue
+		}
+		return addr, nil
+	}
+	return netip.Addr{}, fmt.Errorf("interface %s has no %s address", iface.Name, family(is4))
+}
+
+func family(is4 bool) string {
+	if is4 {
+		return "ipv4"
+	}
+	return "ipv6"
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
@@ -16,28 +17,87 @@ import (
 	"github.com/VolatileDream/workbench/web/network-monitor/ping"
 	"github.com/VolatileDream/workbench/web/network-monitor/resolve"
 	"github.com/VolatileDream/workbench/web/network-monitor/telemetry"
-
-	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/metric"
-	"go.opentelemetry.io/otel/metric/global"
-	"go.opentelemetry.io/otel/metric/instrument"
-	"go.opentelemetry.io/otel/metric/unit"
 )
 
 var (
 	bindFlag = flag.String("bind",
 		"127.0.0.1:9090",
 		"Host and port to bind to for prometheus metrics export.")
+	deviationWindowFlag = flag.Duration("deviation-window",
+		time.Minute,
+		"Window of time over which the latency standard deviation is computed.")
+	percentileWindowFlag = flag.Duration("percentile-window",
+		5*time.Minute,
+		"Window of time over which latency percentiles are computed, targets without results for this long stop being reported.")
+	summaryWindowFlag = flag.Duration("summary-window",
+		time.Minute,
+		"Window of time over which the ping summary of every target (loss, min, avg, max and stddev) is computed.")
+	resultBufferFlag = flag.Int("ping-result-buffer",
+		100,
+		"Number of ping results buffered for recording, results are dropped and counted in ping/results_dropped once it's full.")
+	onceFlag = flag.Int("once",
+		0,
+		"Ping every target this many times, print a summary and exit, instead of serving metrics.")
+	checkConfigFlag = flag.Bool("check-config",
+		false,
+		"Load and validate the config, print any problems and exit, non-zero if there are any.")
+	logLevelFlag = flag.String("log-level",
+		"info",
+		"Lowest level of the messages to log: debug, info, warn or error.")
+	traceEndpointFlag = flag.Bool("trace-endpoint",
+		false,
+		"Serve /trace?dest=<address>&maxhops=<n>, which runs a traceroute on demand.")
 )
 
 func main() {
 	flag.Parse()
-	cleanup, err := telemetry.Setup()
+	if err := setupLogging(*logLevelFlag); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+	if *checkConfigFlag {
+		os.Exit(checkConfig(os.Stdout))
+	}
+	if *onceFlag > 0 {
+		os.Exit(runOnce(*onceFlag))
+	}
+	os.Exit(run(config.FileSource{}))
+}
+
+// setupLogging makes the default logger write text to stderr, dropping the
+// messages below the level.
+func setupLogging(level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("bad --log-level: %w", err)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: l})))
+	return nil
+}
+
+// run serves metrics until interrupted, and returns the exit code of the
+// process. Exiting is left to main, so that deferred cleanup runs first. The
+// config is loaded from the source, and again on SIGHUP.
+func run(source config.ConfigSource) int {
+	// The config is loaded first, the latency buckets can't change after the
+	// exporter is setup.
+	firstCfg, err := source.Load()
+	if err != nil {
+		slog.Error("could not load config", "err", err)
+		return 1
+	}
+
+	if err := checkPermissions(firstCfg); err != nil {
+		slog.Error("can not ping", "err", err)
+		return 1
+	}
+
+	cleanup, err := telemetry.Setup(firstCfg.LatencyBuckets)
 	defer cleanup()
 
 	if err != nil {
 		fmt.Printf("failed to setup telemetry: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 
 	initMeter()
@@ -46,25 +106,79 @@ func main() {
 	appCtx, appCancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer appCancel()
 
-	firstCfg, err := config.LoadConfig()
-	if err != nil {
-		log.Fatalf("could not load config: %v\n", err)
-	}
-
-	// Split the configuration channel in two:
-	// one for the Resolver, and another for the ping manager.
+	// Split the configuration channel in three: one for the Resolver,
+	// another for the ping manager, and the last for the config endpoint.
 	cfgCh := make(chan config.Config, 1)
 	cfgCh <- *firstCfg
-	c1, c2 := split(appCtx, cfgCh)
+	cfgs := split(appCtx, cfgCh, 3)
+	c1, c2 := cfgs[0], cfgs[1]
+
+	state := &configState{}
+	go state.run(appCtx, cfgs[2])
+	http.Handle("/debug/config", state)
+
+	go signalHandler(appCtx, appCancel, source, cfgCh)
+	if *watchConfigFlag {
+		if err := watchConfig(appCtx, source, config.FilePath(), *firstCfg, cfgCh); err != nil {
+			slog.Error("could not watch config, only reloading on SIGHUP", "err", err)
+		}
+	}
 
-	go signalHandler(appCtx, appCancel, cfgCh)
+	routes := resolve.NewRoutes()
+	http.Handle("/debug/routes", routes)
 
-	resolver, resultCh := resolve.NewService(c1, resolve.DefaultResolver())
+	annotator, err := resolve.FlagAnnotator()
+	if err != nil {
+		slog.Error("could not create as annotator", "err", err)
+		return 1
+	}
+	if *traceEndpointFlag {
+		http.Handle("/trace", resolve.NewTraceHandler(annotator, state.source))
+	}
+	lookup, err := resolve.FlagResolver(routes, annotator)
+	if err != nil {
+		slog.Error("could not create resolver", "err", err)
+		return 1
+	}
+	resolver, resultCh := resolve.NewService(c1, lookup)
 	go resolver.Run(appCtx)
+	http.Handle("/debug/targets", resolver)
 
-	manager, results := ping.NewManager(100, c2, resultCh)
+	manager, results := ping.NewManager(*resultBufferFlag, c2, resultCh)
 	go manager.Run(appCtx)
-	go printResults(appCtx, results)
+	metrics, err := newResultMetrics(state.pingInterval)
+	if err != nil {
+		// Don't silently discard every result, at least make them visible.
+		slog.Error("failed to setup metrics, falling back to logging results", "err", err)
+	}
+	// Results of specific targets can be handled in process by subscribing.
+	subs := ping.NewSubscribers(100)
+	go subs.Run(appCtx)
+	// Every result is recorded, and also streamed to the clients of /stream.
+	fanout := ping.NewFanout(results)
+	recorded := fanout.Listen()
+	// Drains the results left when the fanout stops, before exiting.
+	historyDone := make(chan struct{})
+	if *historyFileFlag != "" {
+		history, err := openHistory(*historyFileFlag)
+		if err != nil {
+			slog.Error("could not write history", "err", err)
+			return 1
+		}
+		saved := fanout.Listen()
+		go func() {
+			history.run(saved)
+			close(historyDone)
+		}()
+	} else {
+		close(historyDone)
+	}
+	go fanout.Run(appCtx)
+	go printResults(appCtx, metrics, subs, recorded)
+	if metrics != nil {
+		http.Handle("/stats", &summaryHandler{summary: metrics.summary})
+	}
+	http.Handle("/stream", ping.NewStreamHandler(fanout))
 
 	server := &http.Server{
 		Addr:    *bindFlag,
@@ -74,15 +188,43 @@ func main() {
 			return appCtx
 		},
 	}
-	go killserver(appCtx, server)
+	stopped := make(chan struct{})
+	go func() {
+		killserver(appCtx, server)
+		close(stopped)
+	}()
 
 	fmt.Printf("running...\n")
-	log.Fatal(server.ListenAndServe())
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server failed", "err", err)
+		return 1
+	}
+	// Let open connections finish before metrics are shut down.
+	<-stopped
+	<-historyDone
+	return 0
+}
+
+// checkPermissions fails if the targets of the config are pinged, but icmp
+// sockets can't be opened. Http and tcp probes don't need them.
+func checkPermissions(cfg *config.Config) error {
+	for _, t := range cfg.Targets {
+		switch t.(type) {
+		case *config.HttpTarget, *config.TcpTarget:
+			continue
+		}
+		return ping.CheckPermissions()
+	}
+	return nil
 }
 
-func split(ctx context.Context, c <-chan config.Config) (<-chan config.Config, <-chan config.Config) {
-	one := make(chan config.Config, 1)
-	two := make(chan config.Config, 1)
+func split(ctx context.Context, c <-chan config.Config, n int) []<-chan config.Config {
+	outs := make([]chan config.Config, n)
+	result := make([]<-chan config.Config, n)
+	for i := range outs {
+		outs[i] = make(chan config.Config, 1)
+		result[i] = outs[i]
+	}
 
 	go func() {
 		for {
@@ -90,16 +232,17 @@ func split(ctx context.Context, c <-chan config.Config) (<-chan config.Config, <
 			case <-ctx.Done():
 				return
 			case cfg := <-c:
-				one <- cfg
-				two <- cfg
+				for _, out := range outs {
+					out <- cfg
+				}
 			}
 		}
 	}()
 
-	return one, two
+	return result
 }
 
-func signalHandler(appCtx context.Context, cancel func(), cfgCh chan config.Config) {
+func signalHandler(appCtx context.Context, cancel func(), source config.ConfigSource, cfgCh chan config.Config) {
 	// this lives for the life of the application.
 	signals := make(chan os.Signal, 2)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGHUP)
@@ -114,14 +257,14 @@ signal_loop:
 		case sig = <-signals:
 		}
 
-		log.Printf("got signal: %s\n", sig)
+		slog.Info("got signal", "signal", sig)
 
 		if sig == syscall.SIGHUP {
 			// reload cfg
-			log.Printf("reloading config...\n")
-			c, err := config.LoadConfig()
+			slog.Info("reloading config")
+			c, err := source.Load()
 			if err != nil {
-				log.Printf("failed to load config: %v", err)
+				slog.Error("failed to load config", "err", err)
 			} else {
 				cfgCh <- *c
 			}
@@ -146,54 +289,3 @@ func killserver(ctx context.Context, s *http.Server) {
 	s.Shutdown(c)
 	s.Close()
 }
-
-var meter metric.Meter = metric.NewNoopMeter()
-
-const (
-	addrKey = attribute.Key("remote")
-	nameKey = attribute.Key("name")
-)
-
-func initMeter() {
-	meter = global.Meter("netmon")
-}
-
-func printResults(ctx context.Context, r <-chan *ping.PingResult) {
-	latency, err := meter.SyncFloat64().Histogram(
-		"network/latency",
-		instrument.WithUnit(unit.Milliseconds),
-		instrument.WithDescription("Latency from this host to the specified target."))
-	if err != nil {
-		log.Fatalf("failed to create metric: %v\n", err)
-	}
-	// Without a lost packet counter, the histogram gets polluted with +Inf values.
-	// This is possibly because of the poor support for out-of-order packets, but
-	// given the orders of magnitude between network latency & packet frequency,
-	// it's more likely just disappearing packets.
-	lost, err := meter.SyncInt64().Counter(
-		"network/latency/lost-packets",
-		instrument.WithDescription("Count of packets that failed to deliver."))
-	if err != nil {
-		log.Fatalf("failed to create metric: %v\n", err)
-	}
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case result := <-r:
-			if !result.Recv.IsZero() {
-				millis := float64(result.Elapsed().Microseconds()) / 1000.0
-				//log.Printf("ping result %s: %f\n", result.Dest, millis)
-				latency.Record(ctx,
-					millis,
-					addrKey.String(result.Dest.String()),
-					nameKey.String(result.Target.MetricName()))
-			} else {
-				lost.Add(ctx, 1,
-					addrKey.String(result.Dest.String()),
-					nameKey.String(result.Target.MetricName()))
-			}
-		}
-	}
-}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/ping"
+	"github.com/VolatileDream/workbench/web/network-monitor/stats"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/asyncfloat64"
+	"go.opentelemetry.io/otel/metric/instrument/syncfloat64"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/unit"
+)
+
+var meter metric.Meter = metric.NewNoopMeter()
+
+// How long a reply ttl continues to be reported after the last reply.
+const replyTTLExpiry = 5 * time.Minute
+
+// How long jitter continues to be reported after the last reply. Replies
+// further apart than this aren't considered consecutive.
+const jitterExpiry = 5 * time.Minute
+
+// Latency samples kept per target to compute percentiles from.
+const maxPercentileSamples = 10000
+
+// Targets are reachable if they replied within this many ping intervals.
+const reachableIntervals = 5
+
+// How long reachability continues to be reported after the last result.
+const reachableExpiry = 5 * time.Minute
+
+const (
+	addrKey       = attribute.Key("remote")
+	remoteNameKey = attribute.Key("remote_name")
+	nameKey       = attribute.Key("name")
+	payloadKey    = attribute.Key("payload_size")
+	reasonKey     = attribute.Key("reason")
+	statusKey     = attribute.Key("status")
+	successKey    = attribute.Key("success")
+)
+
+func initMeter() {
+	meter = global.Meter("netmon")
+}
+
+// resultMetrics are the instruments that ping results get recorded into.
+type resultMetrics struct {
+	latency   syncfloat64.Histogram
+	lost      syncint64.Counter
+	loss      syncint64.UpDownCounter
+	reordered syncint64.Counter
+	responses syncint64.Counter
+	flaps     syncint64.Counter
+
+	deviation   *stats.Deviation
+	percentiles *stats.Quantiles
+	replyTTL    *stats.Latest
+	clockOffset *stats.Latest
+	pathMTU     *stats.Latest
+	jitter      *stats.Jitter
+	reachable   *stats.Reachable
+	flapping    *stats.Flaps
+	summary     *stats.Summary
+
+	// Returns the ping interval of a target, zero if it's unknown.
+	interval func(config.LatencyTarget) time.Duration
+}
+
+// newResultMetrics creates all of the instruments up front, so that failing to
+// create one is noticed at startup instead of once results start flowing.
+func newResultMetrics(interval func(config.LatencyTarget) time.Duration) (*resultMetrics, error) {
+	m := &resultMetrics{
+		interval: interval,
+	}
+
+	var err error
+	m.latency, err = meter.SyncFloat64().Histogram(
+		"network/latency",
+		instrument.WithUnit(unit.Milliseconds),
+		instrument.WithDescription("Latency from this host to the specified target."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	// Without a lost packet counter, the histogram gets polluted with +Inf values.
+	// This is possibly because of the poor support for out-of-order packets, but
+	// given the orders of magnitude between network latency & packet frequency,
+	// it's more likely just disappearing packets.
+	m.lost, err = meter.SyncInt64().Counter(
+		"network/latency/lost-packets",
+		instrument.WithDescription("Count of packets that failed to deliver."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	// Lost packets, without the ones that were later answered out of order,
+	// labeled like the latency. Goes down again when a late reply arrives.
+	m.loss, err = meter.SyncInt64().UpDownCounter(
+		"network/packet_loss",
+		instrument.WithDescription("Count of packets that were lost, and not answered out of order later."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	// Packets are reported lost as soon as a later packet is answered, so
+	// some of the lost packets are only out of order. The difference between
+	// the counters is the number of packets that were actually lost, which
+	// packet_loss counts.
+	m.reordered, err = meter.SyncInt64().Counter(
+		"network/latency/reordered-packets",
+		instrument.WithDescription("Count of packets counted as lost, that were later answered out of order."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	// Intermittent outages hide in the loss rate, count the transitions.
+	m.flapping = stats.NewFlaps(reachableExpiry)
+	m.flaps, err = meter.SyncInt64().Counter(
+		"network/flaps",
+		instrument.WithDescription("Count of times the target went from reachable to unreachable, or back."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	m.responses, err = meter.SyncInt64().Counter(
+		"network/http/responses",
+		instrument.WithDescription("Count of HTTP probe responses, by status class and if the status was expected."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+
+	// The histogram doesn't provide a single number to alert on for latency
+	// consistency, so separately track the deviation over a sliding window.
+	m.deviation = stats.NewDeviation(*deviationWindowFlag)
+	stddev, err := meter.AsyncFloat64().Gauge(
+		"network/latency_stddev",
+		instrument.WithUnit(unit.Milliseconds),
+		instrument.WithDescription("Standard deviation of latency to the specified target."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	err = meter.RegisterCallback([]instrument.Asynchronous{stddev}, func(ctx context.Context) {
+		for name, value := range m.deviation.Snapshot(time.Now()) {
+			stddev.Observe(ctx, value, nameKey.String(name))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metric callback: %w", err)
+	}
+
+	// Percentiles per target, without needing histogram_quantile over the
+	// histogram buckets.
+	m.percentiles = stats.NewQuantiles(*percentileWindowFlag, maxPercentileSamples)
+	var gauges []asyncfloat64.Gauge
+	var instruments []instrument.Asynchronous
+	quantiles := []float64{0.5, 0.95, 0.99}
+	for _, name := range []string{"network/latency_p50", "network/latency_p95", "network/latency_p99"} {
+		g, err := meter.AsyncFloat64().Gauge(
+			name,
+			instrument.WithUnit(unit.Milliseconds),
+			instrument.WithDescription("Percentile of latency to the specified target, over a sliding window."))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create metric: %w", err)
+		}
+		gauges = append(gauges, g)
+		instruments = append(instruments, g)
+	}
+	err = meter.RegisterCallback(instruments, func(ctx context.Context) {
+		for name, values := range m.percentiles.Snapshot(time.Now(), quantiles...) {
+			for i, value := range values {
+				gauges[i].Observe(ctx, value, nameKey.String(name))
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metric callback: %w", err)
+	}
+
+	// A change in the ttl of replies indicates that the return path changed,
+	// even if the latency didn't.
+	m.replyTTL = stats.NewLatest(replyTTLExpiry)
+	ttl, err := meter.AsyncInt64().Gauge(
+		"network/reply_ttl",
+		instrument.WithDescription("TTL (or hop limit) of the last echo reply from the target."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	err = meter.RegisterCallback([]instrument.Asynchronous{ttl}, func(ctx context.Context) {
+		for k, value := range m.replyTTL.Snapshot(time.Now()) {
+			ttl.Observe(ctx, int64(value), addrKey.String(k.Remote), nameKey.String(k.Name))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metric callback: %w", err)
+	}
+
+	// Only targets pinged with timestamp requests have a clock offset.
+	m.clockOffset = stats.NewLatest(replyTTLExpiry)
+	offset, err := meter.AsyncFloat64().Gauge(
+		"network/clock_offset",
+		instrument.WithUnit(unit.Milliseconds),
+		instrument.WithDescription("How far the clock of the target is ahead, from the last timestamp reply."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	err = meter.RegisterCallback([]instrument.Asynchronous{offset}, func(ctx context.Context) {
+		for k, value := range m.clockOffset.Snapshot(time.Now()) {
+			offset.Observe(ctx, value, addrKey.String(k.Remote), nameKey.String(k.Name))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metric callback: %w", err)
+	}
+
+	// Only known once a router drops a probe sent with don't fragment.
+	m.pathMTU = stats.NewLatest(replyTTLExpiry)
+	mtu, err := meter.AsyncInt64().Gauge(
+		"network/path_mtu",
+		instrument.WithUnit(unit.Bytes),
+		instrument.WithDescription("MTU of the path to the target, from the last fragmentation needed error a router sent for a probe."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	err = meter.RegisterCallback([]instrument.Asynchronous{mtu}, func(ctx context.Context) {
+		for k, value := range m.pathMTU.Snapshot(time.Now()) {
+			mtu.Observe(ctx, int64(value), addrKey.String(k.Remote), nameKey.String(k.Name))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metric callback: %w", err)
+	}
+
+	m.jitter = stats.NewJitter(jitterExpiry)
+	jitter, err := meter.AsyncFloat64().Gauge(
+		"network/jitter",
+		instrument.WithUnit(unit.Milliseconds),
+		instrument.WithDescription("Mean difference in latency between consecutive replies from the target, as in RFC 3550."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	err = meter.RegisterCallback([]instrument.Asynchronous{jitter}, func(ctx context.Context) {
+		for k, value := range m.jitter.Snapshot(time.Now()) {
+			jitter.Observe(ctx, value, addrKey.String(k.Remote), nameKey.String(k.Name))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metric callback: %w", err)
+	}
+
+	// A single signal to alert on, without working out loss rates.
+	m.reachable = stats.NewReachable(reachableExpiry)
+	reachable, err := meter.AsyncInt64().Gauge(
+		"network/reachable",
+		instrument.WithDescription("1 if any address of the target replied recently, otherwise 0."))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metric: %w", err)
+	}
+	err = meter.RegisterCallback([]instrument.Asynchronous{reachable}, func(ctx context.Context) {
+		for name, value := range m.reachable.Snapshot(time.Now()) {
+			reachable.Observe(ctx, int64(value), nameKey.String(name))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register metric callback: %w", err)
+	}
+
+	// The classic summary of ping, over a window.
+	m.summary = stats.NewSummary(*summaryWindowFlag)
+	if err := m.registerSummary(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// registerSummary creates the gauges that report the summary of every target.
+func (m *resultMetrics) registerSummary() error {
+	count, err := meter.AsyncInt64().Gauge(
+		"network/summary/count",
+		instrument.WithDescription("Number of probes sent to the target, over the summary window."))
+	if err != nil {
+		return fmt.Errorf("failed to create metric: %w", err)
+	}
+	loss, err := meter.AsyncFloat64().Gauge(
+		"network/summary/loss_percent",
+		instrument.WithDescription("Percentage of probes to the target that were lost, over the summary window."))
+	if err != nil {
+		return fmt.Errorf("failed to create metric: %w", err)
+	}
+	var latency []asyncfloat64.Gauge
+	instruments := []instrument.Asynchronous{count, loss}
+	for _, name := range []string{"min", "avg", "max", "stddev"} {
+		g, err := meter.AsyncFloat64().Gauge(
+			"network/summary/latency_"+name,
+			instrument.WithUnit(unit.Milliseconds),
+			instrument.WithDescription("Latency to the target, over the summary window."))
+		if err != nil {
+			return fmt.Errorf("failed to create metric: %w", err)
+		}
+		latency = append(latency, g)
+		instruments = append(instruments, g)
+	}
+	err = meter.RegisterCallback(instruments, func(ctx context.Context) {
+		for name, s := range m.summary.Snapshot(time.Now()) {
+			count.Observe(ctx, int64(s.Count), nameKey.String(name))
+			loss.Observe(ctx, s.LossPercent(), nameKey.String(name))
+			if s.Count == s.Lost {
+				// No latency to report.
+				continue
+			}
+			for i, value := range []float64{s.Min, s.Avg, s.Max, s.StdDev} {
+				latency[i].Observe(ctx, value, nameKey.String(name))
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register metric callback: %w", err)
+	}
+	return nil
+}
+
+func (m *resultMetrics) record(ctx context.Context, result *ping.PingResult) {
+	if t, ok := result.Target.(*config.HttpTarget); ok {
+		m.responses.Add(ctx, 1,
+			nameKey.String(t.MetricName()),
+			statusKey.String(result.StatusClass()),
+			successKey.Bool(result.Status == t.ExpectedStatus))
+	}
+	if interval := m.interval(result.Target); interval > 0 {
+		// Warmup replies still show the target is reachable.
+		when := result.Recv
+		if when.IsZero() {
+			when = result.Sent
+		}
+		m.reachable.Record(result.Target.MetricName(), when, !result.Recv.IsZero(), reachableIntervals*interval)
+		if m.flapping.Record(result.Target.MetricName(), when, !result.Recv.IsZero(), reachableIntervals*interval) {
+			m.flaps.Add(ctx, 1, nameKey.String(result.Target.MetricName()))
+		}
+	}
+	if result.Warmup {
+		// Not representative of the latency, but also not lost.
+		return
+	}
+	if result.OutOfOrder {
+		m.reordered.Add(ctx, 1,
+			addrKey.String(result.Dest.String()),
+			nameKey.String(result.Target.MetricName()))
+		// No longer lost after all.
+		m.loss.Add(ctx, -1, remoteAttrs(result)...)
+		// Late replies were already recorded as lost, recording their
+		// latency as well would count the packet twice.
+		return
+	}
+	if !result.Recv.IsZero() {
+		millis := float64(result.Elapsed().Microseconds()) / 1000.0
+		m.summary.Record(result.Target.MetricName(), result.Recv, millis)
+		m.latency.Record(ctx, millis, remoteAttrs(result)...)
+		m.deviation.Record(result.Target.MetricName(), result.Recv, millis)
+		m.percentiles.Record(result.Target.MetricName(), result.Recv, millis)
+		m.jitter.Record(stats.Key{
+			Name:   result.Target.MetricName(),
+			Remote: result.Dest.String(),
+		}, result.Recv, millis)
+		if result.TTL > 0 {
+			m.replyTTL.Record(stats.Key{
+				Name:   result.Target.MetricName(),
+				Remote: result.Dest.String(),
+			}, result.Recv, float64(result.TTL))
+		}
+		if result.OneWay != nil {
+			m.clockOffset.Record(stats.Key{
+				Name:   result.Target.MetricName(),
+				Remote: result.Dest.String(),
+			}, result.Recv, float64(result.OneWay.ClockOffset().Microseconds())/1000.0)
+		}
+	} else {
+		reason := string(result.Failure)
+		if result.Failure == ping.FailureUnknown {
+			reason = "lost"
+		}
+		m.lost.Add(ctx, 1, append(remoteAttrs(result), reasonKey.String(reason))...)
+		m.loss.Add(ctx, 1, remoteAttrs(result)...)
+		m.summary.RecordLost(result.Target.MetricName(), result.Sent)
+		if result.PathMTU > 0 {
+			m.pathMTU.Record(stats.Key{
+				Name:   result.Target.MetricName(),
+				Remote: result.Dest.String(),
+			}, result.Sent, float64(result.PathMTU))
+		}
+	}
+}
+
+// remoteAttrs are the attributes that identify the target and remote address
+// of the result. Includes the reverse DNS name of the remote, for hops targets
+// where the address alone doesn't say much.
+func remoteAttrs(result *ping.PingResult) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		addrKey.String(result.Dest.String()),
+		nameKey.String(result.Target.MetricName()),
+	}
+	if result.RemoteName != "" {
+		attrs = append(attrs, remoteNameKey.String(result.RemoteName))
+	}
+	if result.PayloadSize > 0 {
+		// Only labeled when configured, to not split existing series.
+		attrs = append(attrs, payloadKey.Int(result.PayloadSize))
+	}
+	return attrs
+}
+
+// printResults records results into metrics, or logs them if there are no
+// metrics to record them into.
+func printResults(ctx context.Context, m *resultMetrics, subs *ping.Subscribers, r <-chan *ping.PingResult) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case result, ok := <-r:
+			if !ok {
+				return
+			}
+			subs.Publish(result)
+			if m != nil {
+				m.record(ctx, result)
+			} else if !result.Recv.IsZero() {
+				slog.Info("ping result", "target", result.Target.MetricName(), "addr", result.Dest, "elapsed", result.Elapsed())
+			} else {
+				slog.Info("ping result", "target", result.Target.MetricName(), "addr", result.Dest, "lost", true)
+			}
+		}
+	}
+}
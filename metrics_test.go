@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/ping"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// latencyCount returns the number of results recorded in the latency
+// histogram.
+func latencyCount(t *testing.T, reader sdkmetric.Reader) uint64 {
+	t.Helper()
+	data, err := reader.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count uint64
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != "network/latency" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Histogram).DataPoints {
+				count += dp.Count
+			}
+		}
+	}
+	return count
+}
+
+// counterValue returns the sum of the counter over all of its attributes.
+func counterValue(t *testing.T, reader sdkmetric.Reader, name string) int64 {
+	t.Helper()
+	data, err := reader.Collect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int64
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != name {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				value += dp.Value
+			}
+		}
+	}
+	return value
+}
+
+func Test_resultMetrics_PacketLoss(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	m, err := newResultMetrics(func(config.LatencyTarget) time.Duration { return time.Second })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := &config.StaticIP{Name: "static", IP: netip.MustParseAddr("192.0.2.1")}
+	sent := time.Now()
+	lost := &ping.PingResult{Sent: sent, Dest: target.IP, Target: target}
+	m.record(context.Background(), lost)
+	m.record(context.Background(), &ping.PingResult{Sent: sent.Add(time.Second), Dest: target.IP, Target: target})
+	if got := counterValue(t, reader, "network/packet_loss"); got != 2 {
+		t.Fatalf("expected both packets to be lost, got %d", got)
+	}
+
+	// The first one was only out of order.
+	late := *lost
+	late.Recv = sent.Add(10 * time.Second)
+	late.OutOfOrder = true
+	m.record(context.Background(), &late)
+	if got := counterValue(t, reader, "network/packet_loss"); got != 1 {
+		t.Errorf("expected only the packet that stayed lost, got %d", got)
+	}
+	if got := counterValue(t, reader, "network/latency/reordered-packets"); got != 1 {
+		t.Errorf("expected the late reply to be reordered, got %d", got)
+	}
+}
+
+func Test_resultMetrics_OutOfOrder(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+	m, err := newResultMetrics(func(config.LatencyTarget) time.Duration { return time.Second })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := &config.StaticIP{Name: "static", IP: netip.MustParseAddr("192.0.2.1")}
+	sent := time.Now()
+	result := &ping.PingResult{
+		Sent:   sent,
+		Recv:   sent.Add(10 * time.Millisecond),
+		Dest:   target.IP,
+		Target: target,
+	}
+	m.record(context.Background(), result)
+	if got := latencyCount(t, reader); got != 1 {
+		t.Fatalf("expected the reply to be recorded, got %d", got)
+	}
+
+	// Already recorded as lost, the late reply only counts as reordered.
+	late := *result
+	late.Recv = sent.Add(10 * time.Second)
+	late.OutOfOrder = true
+	m.record(context.Background(), &late)
+	if got := latencyCount(t, reader); got != 1 {
+		t.Errorf("expected the late reply to be left out of the latency, got %d recorded", got)
+	}
+}
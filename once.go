@@ -0,0 +1,168 @@
+package main
+
+// One shot mode: ping every target a few times, print a summary and exit.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/ping"
+	"github.com/VolatileDream/workbench/web/network-monitor/resolve"
+)
+
+// Time to wait for replies after the last round, before they're lost. Longer
+// if the config waits longer for replies.
+const onceGrace = 3 * time.Second
+
+// onceStats summarizes the results of a single target.
+type onceStats struct {
+	sent int
+	lost int
+	recv int
+
+	min, max, sum time.Duration
+}
+
+func (s *onceStats) record(r *ping.PingResult) {
+	if r.Warmup {
+		// Not representative, same as for metrics.
+		return
+	}
+	if r.OutOfOrder {
+		// Was already counted as sent and lost.
+		s.lost -= 1
+	} else {
+		s.sent += 1
+		if r.Recv.IsZero() {
+			s.lost += 1
+			return
+		}
+	}
+
+	elapsed := r.Elapsed()
+	if s.recv == 0 || elapsed < s.min {
+		s.min = elapsed
+	}
+	if elapsed > s.max {
+		s.max = elapsed
+	}
+	s.sum += elapsed
+	s.recv += 1
+}
+
+// runOnce pings the targets of the config for the number of rounds, and
+// prints a summary of the results. Returns the exit code of the process.
+func runOnce(rounds int) int {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		slog.Error("could not load config", "err", err)
+		return 1
+	}
+
+	if err := checkPermissions(cfg); err != nil {
+		slog.Error("can not ping", "err", err)
+		return 1
+	}
+
+	// Targets with a longer ping interval would otherwise get fewer rounds.
+	interval := cfg.PingInterval
+	for _, t := range cfg.Targets {
+		if i := cfg.Settings(t).PingInterval; i > interval {
+			interval = i
+		}
+	}
+
+	lookup, err := resolve.FlagResolver(nil, nil)
+	if err != nil {
+		slog.Error("could not create resolver", "err", err)
+		return 1
+	}
+
+	cfgCh := make(chan config.Config, 1)
+	cfgCh <- *cfg
+	resolver, resultCh := resolve.NewServiceWithStaticConfig(lookup, *cfg)
+	go resolver.Run(ctx)
+	manager, results := ping.NewManager(*resultBufferFlag, cfgCh, resultCh)
+	go manager.Run(ctx)
+
+	duration := time.Duration(rounds) * interval
+	grace := onceGrace
+	if cfg.PingTimeout > grace {
+		grace = cfg.PingTimeout
+	}
+	// Resolving can take up to half the resolve interval, stop waiting for
+	// results after that.
+	deadline := time.NewTimer(cfg.ResolveInterval/2 + duration + grace)
+	defer deadline.Stop()
+
+	summary := make(map[string]*onceStats)
+	var done <-chan time.Time
+	// Probes sent after the rounds are over are ignored, the pingers keep
+	// sending while waiting for the replies of the last round.
+	var end time.Time
+collect:
+	for {
+		select {
+		case <-ctx.Done():
+			break collect
+		case <-deadline.C:
+			break collect
+		case <-done:
+			break collect
+		case r := <-results:
+			if done == nil {
+				// Rounds start once the targets are resolved.
+				end = r.Sent.Add(duration)
+				done = time.After(duration + grace)
+			}
+			if !r.Sent.Before(end) {
+				continue
+			}
+			name := r.Target.MetricName()
+			if summary[name] == nil {
+				summary[name] = &onceStats{}
+			}
+			summary[name].record(r)
+		}
+	}
+
+	printSummary(os.Stdout, summary)
+	return 0
+}
+
+func printSummary(out io.Writer, summary map[string]*onceStats) {
+	names := make([]string, 0, len(summary))
+	for name := range summary {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "TARGET\tSENT\tLOST\tLOSS\tMIN\tAVG\tMAX\n")
+	for _, name := range names {
+		s := summary[name]
+		loss := 0.0
+		if s.sent > 0 {
+			loss = 100 * float64(s.lost) / float64(s.sent)
+		}
+		if s.recv == 0 {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t-\t-\t-\n", name, s.sent, s.lost, loss)
+			continue
+		}
+		avg := s.sum / time.Duration(s.recv)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t%s\t%s\t%s\n", name, s.sent, s.lost, loss,
+			s.min.Round(time.Microsecond), avg.Round(time.Microsecond), s.max.Round(time.Microsecond))
+	}
+	w.Flush()
+}
@@ -0,0 +1,200 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/icmp"
+	"github.com/VolatileDream/workbench/web/network-monitor/ip"
+
+	xicmp "golang.org/x/net/icmp"
+)
+
+var (
+	broadcastFlag = flag.Bool("allow-broadcast",
+		false,
+		"Allow probing broadcast and multicast targets. Every host on the segment receives these probes.")
+)
+
+// broadcaster periodically sends an echo request to each BroadcastTarget, and
+// counts the distinct hosts that reply.
+type broadcaster struct {
+	lock     sync.Mutex
+	interval time.Duration
+	// Interface name or local address to probe from, see ip.SourceOf.
+	source  string
+	targets []*config.BroadcastTarget
+
+	// Number of distinct responders in the last window, by target name.
+	responders map[string]int
+	// Targets with a probe still waiting for responses, by target name.
+	probing map[string]struct{}
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{
+		responders: make(map[string]int),
+		probing:    make(map[string]struct{}),
+	}
+}
+
+func (b *broadcaster) update(c config.Config) {
+	targets := make([]*config.BroadcastTarget, 0)
+	for _, t := range c.Targets {
+		if bt, ok := t.(*config.BroadcastTarget); ok {
+			targets = append(targets, bt)
+		}
+	}
+	if len(targets) > 0 && !*broadcastFlag {
+		slog.Warn("ignoring broadcast targets, enable with -allow-broadcast", "count", len(targets))
+		targets = nil
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.interval = c.PingInterval
+	b.source = c.Source
+	b.targets = targets
+
+	// Forget targets that were removed.
+	names := make(map[string]struct{}, len(targets))
+	for _, t := range targets {
+		names[t.MetricName()] = struct{}{}
+	}
+	for name := range b.responders {
+		if _, ok := names[name]; !ok {
+			delete(b.responders, name)
+		}
+	}
+}
+
+// begin marks a probe of the target as in flight, and reports false if the
+// previous one hasn't finished yet.
+func (b *broadcaster) begin(t *config.BroadcastTarget) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.probing[t.MetricName()]; ok {
+		return false
+	}
+	b.probing[t.MetricName()] = struct{}{}
+	return true
+}
+
+// end records the result of the probe started by begin.
+func (b *broadcaster) end(t *config.BroadcastTarget, count int, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.probing, t.MetricName())
+	if err != nil {
+		slog.Warn("broadcast probe failed", "target", t.MetricName(), "err", err)
+		return
+	}
+	b.responders[t.MetricName()] = count
+}
+
+// snapshot returns the most recent count of responders per target name.
+func (b *broadcaster) snapshot() map[string]int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	result := make(map[string]int, len(b.responders))
+	for name, count := range b.responders {
+		result[name] = count
+	}
+	return result
+}
+
+func (b *broadcaster) run(ctx context.Context) {
+	b.lock.Lock()
+	timer := time.NewTimer(b.interval)
+	b.lock.Unlock()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		b.lock.Lock()
+		timer.Reset(b.interval)
+		source := b.source
+		targets := b.targets
+		b.lock.Unlock()
+
+		for _, t := range targets {
+			if !b.begin(t) {
+				slog.Debug("skipping broadcast probe, previous one is still running", "target", t.MetricName())
+				continue
+			}
+			go func(t *config.BroadcastTarget) {
+				count, err := b.probe(ctx, source, t)
+				b.end(t, count, err)
+			}(t)
+		}
+	}
+}
+
+// probe sends a single echo request, and counts the distinct responders.
+// Each probe gets its own socket, so replies from hosts that aren't otherwise
+// monitored don't reach the pingers.
+func (b *broadcaster) probe(ctx context.Context, source string, t *config.BroadcastTarget) (int, error) {
+	src, err := ip.SourceOf(source, t.Addr.Is4())
+	if err != nil {
+		return 0, err
+	}
+	conn, err := icmp.Listen(src)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if !t.Addr.IsMulticast() {
+		if err := icmp.SetBroadcast(conn); err != nil {
+			return 0, err
+		}
+	}
+
+	echo := xicmp.Echo{
+		ID:   0, // can't be set by us.
+		Seq:  1,
+		Data: []byte("github.com/VolatileDream"),
+	}
+	if err := icmp.SendIcmpEcho(conn, &echo, t.Addr); err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(t.Window)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetReadDeadline(deadline)
+
+	responders := make(map[netip.Addr]struct{})
+	for {
+		resp, err := icmp.ReadIcmpEcho(conn)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		} else if errors.Is(err, net.ErrClosed) {
+			return 0, err
+		} else if err != nil {
+			slog.Debug("broadcast receive error", "err", err)
+			continue
+		}
+		if resp.Echo.Seq == echo.Seq {
+			responders[resp.From] = struct{}{}
+		}
+	}
+	return len(responders), nil
+}
@@ -0,0 +1,51 @@
+package ping
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+)
+
+func Test_broadcaster_SkipsInFlight(t *testing.T) {
+	b := newBroadcaster()
+	target := &config.BroadcastTarget{
+		Name:   "broadcast",
+		Addr:   netip.MustParseAddr("192.0.2.255"),
+		Window: 500 * time.Millisecond,
+	}
+	other := &config.BroadcastTarget{
+		Name:   "other",
+		Addr:   netip.MustParseAddr("198.51.100.255"),
+		Window: 500 * time.Millisecond,
+	}
+
+	if !b.begin(target) {
+		t.Fatalf("expected the first probe to start")
+	}
+	if b.begin(target) {
+		t.Errorf("expected a second probe to be skipped while the first is in flight")
+	}
+	if !b.begin(other) {
+		t.Errorf("expected other targets to be probed")
+	}
+
+	b.end(target, 3, nil)
+	if got := b.snapshot()[target.MetricName()]; got != 3 {
+		t.Errorf("got %d responders, want 3", got)
+	}
+	if !b.begin(target) {
+		t.Errorf("expected a probe to start after the previous one finished")
+	}
+
+	// A failed probe keeps the last count, and still lets the next one start.
+	b.end(target, 0, errors.New("failed"))
+	if got := b.snapshot()[target.MetricName()]; got != 3 {
+		t.Errorf("got %d responders after a failure, want 3", got)
+	}
+	if !b.begin(target) {
+		t.Errorf("expected a probe to start after a failed one")
+	}
+}
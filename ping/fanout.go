@@ -0,0 +1,131 @@
+package ping
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// Fanout copies the results of a single channel, like the one returned by
+// NewManager, to any number of readers.
+//
+// Listeners see every result, and the fanout waits for them. Taps are for
+// readers that come and go, like http clients: they have their own buffer, and
+// drop results when it's full instead of holding up the other readers.
+type Fanout struct {
+	in <-chan *PingResult
+
+	lock      sync.Mutex
+	listeners []chan *PingResult
+	taps      map[*tap]struct{}
+	stopped   bool
+}
+
+type tap struct {
+	out     chan *PingResult
+	dropped int
+}
+
+func NewFanout(in <-chan *PingResult) *Fanout {
+	return &Fanout{
+		in:   in,
+		taps: make(map[*tap]struct{}),
+	}
+}
+
+// Listen returns a channel that receives every result, it must be read from
+// until the fanout stops. Listeners should be added before Run, results that
+// arrive earlier are missed.
+func (f *Fanout) Listen() <-chan *PingResult {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	out := make(chan *PingResult)
+	if f.stopped {
+		close(out)
+		return out
+	}
+	f.listeners = append(f.listeners, out)
+	return out
+}
+
+// Tap returns a channel that receives the results from now on, dropping them
+// while bufsz results are waiting to be read. The channel is closed when the
+// returned function is called, or when the fanout stops.
+func (f *Fanout) Tap(bufsz int) (<-chan *PingResult, func()) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	t := &tap{out: make(chan *PingResult, bufsz)}
+	if f.stopped {
+		close(t.out)
+		return t.out, func() {}
+	}
+	f.taps[t] = struct{}{}
+	return t.out, func() { f.untap(t) }
+}
+
+func (f *Fanout) untap(t *tap) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if _, ok := f.taps[t]; !ok {
+		// Already closed by the fanout stopping.
+		return
+	}
+	delete(f.taps, t)
+	close(t.out)
+	if t.dropped > 0 {
+		slog.Warn("tap fell behind, dropped results", "dropped", t.dropped)
+	}
+}
+
+// Run copies the results to the readers until the context is cancelled, then
+// closes the channels of all readers.
+func (f *Fanout) Run(ctx context.Context) {
+	defer f.stop()
+	for {
+		var r *PingResult
+		select {
+		case <-ctx.Done():
+			return
+		case r = <-f.in:
+		}
+
+		f.lock.Lock()
+		listeners := f.listeners
+		for t := range f.taps {
+			select {
+			case t.out <- r:
+			default:
+				t.dropped += 1
+			}
+		}
+		f.lock.Unlock()
+
+		// Outside the lock, waiting on a listener mustn't block taps from
+		// being added or removed.
+		for _, l := range listeners {
+			select {
+			case l <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (f *Fanout) stop() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.stopped = true
+	for _, l := range f.listeners {
+		close(l)
+	}
+	f.listeners = nil
+	for t := range f.taps {
+		close(t.out)
+	}
+	f.taps = make(map[*tap]struct{})
+}
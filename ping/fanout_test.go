@@ -0,0 +1,93 @@
+package ping
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+)
+
+func Test_Fanout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan *PingResult)
+	f := NewFanout(in)
+	all := f.Listen()
+	tapped, untap := f.Tap(1)
+	go f.Run(ctx)
+
+	target := &config.StaticIP{Name: "static", IP: netip.MustParseAddr("192.0.2.1")}
+	for i := 0; i < 3; i++ {
+		r := &PingResult{Target: target, Sent: time.Unix(int64(i), 0)}
+		in <- r
+		if got := <-all; got != r {
+			t.Errorf("expected the listener to get every result, got: %+v", got)
+		}
+	}
+
+	// Only the first result fit the buffer of the tap, the others dropped.
+	if r := <-tapped; r.Sent != time.Unix(0, 0) {
+		t.Errorf("expected the first result, got: %+v", r)
+	}
+	untap()
+	if _, ok := <-tapped; ok {
+		t.Errorf("expected the tap to be closed")
+	}
+
+	cancel()
+	if _, ok := <-all; ok {
+		t.Errorf("expected the listener to be closed")
+	}
+}
+
+func Test_StreamHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan *PingResult)
+	f := NewFanout(in)
+	go f.Run(ctx)
+
+	server := httptest.NewServer(NewStreamHandler(f))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type: %s", ct)
+	}
+
+	sent := time.Unix(1000, 0)
+	in <- &PingResult{
+		Sent:   sent,
+		Recv:   sent.Add(15 * time.Millisecond),
+		Dest:   netip.MustParseAddr("192.0.2.1"),
+		Target: &config.StaticIP{Name: "static", IP: netip.MustParseAddr("192.0.2.1")},
+	}
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	data, ok := strings.CutPrefix(strings.TrimSpace(line), "data: ")
+	if !ok {
+		t.Fatalf("expected a data line, got: %q", line)
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(data), &got); err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if got["name"] != "static" || got["dest"] != "192.0.2.1" || got["elapsed_ms"] != 15.0 {
+		t.Errorf("unexpected event: %s", data)
+	}
+}
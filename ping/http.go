@@ -0,0 +1,131 @@
+package ping
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/ip"
+)
+
+// httpProber periodically issues requests to the configured HttpTargets.
+// Unlike the pinger, it doesn't need resolved addresses: the http client does
+// its own name resolution as part of the request.
+type httpProber struct {
+	result chan<- *PingResult
+	// Shared by every probe. Each probe still gets a fresh connection,
+	// otherwise connection reuse would hide the cost of connection setup
+	// from the measurement.
+	transport *http.Transport
+
+	lock     sync.Mutex
+	interval time.Duration
+	targets  []*config.HttpTarget
+}
+
+func newHttpProber(result chan<- *PingResult) *httpProber {
+	return &httpProber{
+		result: result,
+		transport: &http.Transport{
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+func (h *httpProber) update(c config.Config) {
+	targets := make([]*config.HttpTarget, 0)
+	for _, t := range c.Targets {
+		if ht, ok := t.(*config.HttpTarget); ok {
+			targets = append(targets, ht)
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.interval = c.PingInterval
+	h.targets = targets
+}
+
+func (h *httpProber) run(ctx context.Context) {
+	h.lock.Lock()
+	timer := time.NewTimer(h.interval)
+	h.lock.Unlock()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		h.lock.Lock()
+		timer.Reset(h.interval)
+		targets := h.targets
+		h.lock.Unlock()
+
+		for _, t := range targets {
+			go h.probe(ctx, t)
+		}
+	}
+}
+
+func (h *httpProber) probe(ctx context.Context, t *config.HttpTarget) {
+	// The timeout bounds the request, not handing off the result: a timed out
+	// probe is still a result.
+	reqCtx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+
+	R := &PingResult{
+		Target: t,
+	}
+
+	// Capture the address actually connected to, for the metric labels.
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if addr, err := ip.Convert(info.Conn.RemoteAddr()); err == nil {
+				R.Dest = addr.Unmap()
+			}
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(reqCtx, trace), t.Method, t.URL.String(), nil)
+	if err != nil {
+		slog.Error("failed to create http probe request", "target", t.MetricName(), "err", err)
+		return
+	}
+
+	client := &http.Client{
+		Transport: h.transport,
+	}
+	if !t.FollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	R.Sent = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.Debug("http probe failed", "target", t.MetricName(), "err", err)
+	} else {
+		// Latency includes reading the body, the whole request is the point.
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		R.Recv = time.Now()
+		R.Status = resp.StatusCode
+	}
+	if !R.Dest.IsValid() {
+		R.Dest = netip.IPv4Unspecified()
+	}
+
+	select {
+	case h.result <- R:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,85 @@
+package ping
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+)
+
+func newTestHttpTarget(t *testing.T, raw string, follow bool, timeout time.Duration) *config.HttpTarget {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &config.HttpTarget{
+		Name:            "http",
+		URL:             u,
+		Method:          http.MethodGet,
+		FollowRedirects: follow,
+		Timeout:         timeout,
+	}
+}
+
+func Test_httpProber_probe(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ok", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		path    string
+		follow  bool
+		timeout time.Duration
+		status  int
+	}{
+		{name: "success", path: "/ok", timeout: 50 * time.Millisecond, status: http.StatusNoContent},
+		{name: "redirect", path: "/redirect", timeout: 50 * time.Millisecond, status: http.StatusFound},
+		{name: "follow redirect", path: "/redirect", follow: true, timeout: 50 * time.Millisecond, status: http.StatusNoContent},
+		// No status, the probe timed out.
+		{name: "timeout", path: "/slow", timeout: 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := make(chan *PingResult)
+			h := newHttpProber(results)
+			target := newTestHttpTarget(t, server.URL+tt.path, tt.follow, tt.timeout)
+
+			go h.probe(context.Background(), target)
+
+			// Receive after the probe timeout has passed, the result must still
+			// be handed off.
+			time.Sleep(2 * tt.timeout)
+			var R *PingResult
+			select {
+			case R = <-results:
+			case <-time.After(time.Second):
+				t.Fatalf("expected a result from the probe")
+			}
+			if R.Target != target || R.Status != tt.status {
+				t.Errorf("got target %v status %d, want %v status %d", R.Target, R.Status, target, tt.status)
+			}
+			if got := R.Recv.IsZero(); got != (tt.status == 0) {
+				t.Errorf("expected a lost probe only on timeout, got: %+v", R)
+			}
+			if want := netip.MustParseAddr("127.0.0.1"); R.Dest != want {
+				t.Errorf("got dest %v, want %v", R.Dest, want)
+			}
+		})
+	}
+}
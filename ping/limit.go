@@ -0,0 +1,64 @@
+package ping
+
+import (
+	"sync"
+	"time"
+)
+
+// Tokens the limiter holds at most. One spaces the probes evenly, instead of
+// letting them go out in bursts after idle periods.
+const limiterBurst = 1
+
+// limiter is a token bucket shared by the pingers, which limits the combined
+// rate of their probes. Sends reserve a token, and wait until it's available.
+// A nil limiter permits everything. Safe for concurrent use.
+type limiter struct {
+	rate  float64 // Tokens per second.
+	clock Clock
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newLimiter creates a limiter of rate packets per second, or nil if the rate
+// isn't positive.
+func newLimiter(rate float64, clock Clock) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &limiter{
+		rate:   rate,
+		clock:  clock,
+		tokens: limiterBurst,
+		last:   clock.Now(),
+	}
+}
+
+// reserve takes a token, and returns how long to wait until it's available.
+// If that's not before within, no token is taken and it returns false instead.
+func (l *limiter) reserve(within time.Duration) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.clock.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > limiterBurst {
+		l.tokens = limiterBurst
+	}
+	l.last = now
+
+	var wait time.Duration
+	if l.tokens < 1 {
+		// Tokens go negative for the sends that are already waiting.
+		wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	}
+	if wait >= within {
+		return wait, false
+	}
+	l.tokens -= 1
+	return wait, true
+}
@@ -0,0 +1,41 @@
+package ping
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_limiter(t *testing.T) {
+	clock := newFakeClock()
+	l := newLimiter(10, clock)
+
+	// Every reservation waits 100ms longer than the last.
+	for i := 0; i < 10; i++ {
+		wait, ok := l.reserve(time.Second)
+		if want := time.Duration(i) * 100 * time.Millisecond; !ok || (wait-want).Abs() > time.Microsecond {
+			t.Fatalf("expected reservation %d to wait %s, got %s (%v)", i, want, wait, ok)
+		}
+	}
+	// A second out, past the interval.
+	if wait, ok := l.reserve(time.Second); ok {
+		t.Errorf("expected reservation to be refused, waits %s", wait)
+	}
+
+	// Doesn't accumulate more than the burst while idle.
+	clock.Advance(time.Minute)
+	if wait, ok := l.reserve(time.Second); !ok || wait != 0 {
+		t.Errorf("expected an immediate reservation, waits %s", wait)
+	}
+	if wait, ok := l.reserve(time.Second); !ok || (wait-100*time.Millisecond).Abs() > time.Microsecond {
+		t.Errorf("expected the next reservation to wait, waits %s", wait)
+	}
+}
+
+func Test_limiter_Unlimited(t *testing.T) {
+	l := newLimiter(0, newFakeClock())
+	for i := 0; i < 1000; i++ {
+		if wait, ok := l.reserve(time.Millisecond); !ok || wait != 0 {
+			t.Fatalf("expected no limit, waits %s", wait)
+		}
+	}
+}
@@ -2,10 +2,14 @@ package ping
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"net/netip"
+	"sync"
 
 	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/icmp"
+	"github.com/VolatileDream/workbench/web/network-monitor/ip"
 	"github.com/VolatileDream/workbench/web/network-monitor/resolve"
 )
 
@@ -18,8 +22,28 @@ type ProbeRequest struct {
 // Manager manages the ping workers, and sockets required to monitor
 // network latency.
 type Manager struct {
+	// Protects the pinger pointers, which change if a pinger is restarted.
+	lock     sync.Mutex
 	pingerV4 *pinger
 	pingerV6 *pinger
+	http     *httpProber
+	tcp      *tcpProber
+	bcast    *broadcaster
+
+	// Number of monitored addresses by family, see registerMetrics.
+	active map[string]int
+	// Number of targets with addresses of a family without a running pinger,
+	// by family.
+	unmonitored map[string]int
+	// The targets that were logged as unmonitored, to only warn once.
+	dropped map[config.LatencyTarget]struct{}
+
+	// The config currently applied.
+	config config.Config
+
+	metrics *pingMetrics
+	log     *slog.Logger
+	clock   Clock
 
 	configCh  <-chan config.Config
 	resolveCh <-chan resolve.Result
@@ -34,6 +58,9 @@ func NewManager(bufsz int, configCh <-chan config.Config, resolveCh <-chan resol
 		configCh:  configCh,
 		resolveCh: resolveCh,
 		results:   make(chan *PingResult, bufsz),
+		metrics:   newPingMetrics(),
+		log:       slog.Default(),
+		clock:     realClock{},
 	}
 	return m, m.results
 }
@@ -52,7 +79,7 @@ func (m *Manager) Run(ctx context.Context) error {
 			return ctx.Err()
 
 		case c := <-m.configCh:
-			m.updateConfig(c)
+			m.updateConfig(ctx, c)
 
 		case r := <-m.resolveCh:
 			m.updateTargets(r)
@@ -60,18 +87,239 @@ func (m *Manager) Run(ctx context.Context) error {
 	}
 }
 
-func (m *Manager) updateConfig(c config.Config) {
-	m.pingerV4.interval = c.PingInterval
-	m.pingerV6.interval = c.PingInterval
+// CheckPermissions opens an icmp socket of every enabled family, to fail at
+// startup if pinging isn't permitted at all, instead of running without ever
+// producing a result. Families that fail for other reasons, like on hosts
+// without ipv6, are left to the pingers to report.
+func CheckPermissions() error {
+	for _, is4 := range []bool{true, false} {
+		if !resolve.AllowedFamily(is4) {
+			continue
+		}
+		addr := netip.IPv6Unspecified()
+		if is4 {
+			addr = netip.IPv4Unspecified()
+		}
+		conn, err := icmp.ListenAny(addr)
+		if errors.Is(err, icmp.ErrNotPermitted) {
+			return err
+		} else if err == nil {
+			conn.Close()
+		}
+	}
+	return nil
+}
+
+// merge returns the current resolutions, with the target of each update
+// replaced or added. Updates of expanded targets contain every address of the
+// parent, so addresses of the parent missing from the updates are removed.
+func merge(current, updates []resolve.Resolution) []resolve.Resolution {
+	result := make([]resolve.Resolution, 0, len(current)+len(updates))
+	updated := make(map[config.LatencyTarget]resolve.Resolution, len(updates))
+	parents := make(map[config.LatencyTarget]struct{})
+	for _, u := range updates {
+		updated[u.Target] = u
+		if a, ok := u.Target.(*config.AddressTarget); ok {
+			parents[a.Parent] = struct{}{}
+		}
+	}
+	for _, c := range current {
+		_, replaced := updated[c.Target]
+		if a, ok := c.Target.(*config.AddressTarget); ok && !replaced {
+			if _, ok := parents[a.Parent]; ok {
+				continue
+			}
+		}
+		if u, ok := updated[c.Target]; ok {
+			result = append(result, u)
+			delete(updated, c.Target)
+		} else {
+			result = append(result, c)
+		}
+	}
+	for _, u := range updates {
+		if _, ok := updated[u.Target]; ok {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// updateConfig applies the config to the running pingers, changing settings in
+// place where possible, and restarting pingers that need a new socket.
+func (m *Manager) updateConfig(ctx context.Context, c config.Config) {
+	prev := m.config
+	m.config = c
+
+	if prev.Equal(c) {
+		// The sources may have changed regardless, so the pingers are
+		// still reloaded below.
+		m.log.Info("config unchanged, only checking ping sources")
+	} else {
+		if prev.PingInterval != c.PingInterval {
+			m.log.Info("ping interval changed", "from", prev.PingInterval, "to", c.PingInterval)
+		}
+		m.pingerV4.configure(c)
+		m.pingerV6.configure(c)
+		m.http.update(c)
+		m.tcp.update(c)
+		m.bcast.update(c)
+	}
+
+	// Address changes on the interface (eg: a new DHCP lease) are picked up
+	// here, and require the socket to be bound again.
+	v4 := m.reloadPinger(ctx, m.pingerV4, true)
+	v6 := m.reloadPinger(ctx, m.pingerV6, false)
+
+	m.lock.Lock()
+	m.pingerV4 = v4
+	m.pingerV6 = v6
+	m.lock.Unlock()
+
+	m.checkFamilies()
+}
+
+// checkFamilies reports the targets with addresses that aren't pinged,
+// because the pinger of their family isn't running. Either it failed to start,
+// or there is no source address of the family.
+func (m *Manager) checkFamilies() {
+	dropped := unmonitored(m.targets, m.pingerV4.socket != nil, m.pingerV6.socket != nil)
+	counts := make(map[string]int)
+	for t, f := range dropped {
+		counts[f] += 1
+		if _, ok := m.dropped[t]; !ok {
+			m.log.Warn("target not monitored, no pinger is running for its addresses", "target", t.MetricName(), "family", f)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dropped = make(map[config.LatencyTarget]struct{}, len(dropped))
+	for t := range dropped {
+		m.dropped[t] = struct{}{}
+	}
+	m.unmonitored = counts
+}
+
+// unmonitored returns the family of every target with addresses of a family
+// whose pinger isn't running.
+func unmonitored(targets []resolve.Resolution, running4, running6 bool) map[config.LatencyTarget]string {
+	result := make(map[config.LatencyTarget]string)
+	for _, t := range targets {
+		for _, addr := range t.Addrs {
+			running := running6
+			if addr.Is4() {
+				running = running4
+			}
+			if !running {
+				result[t.Target] = family(addr)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// reloadPinger returns a pinger bound to the current source address for the
+// family. If the running pinger is already bound to it, that pinger is
+// returned, otherwise a new pinger is started to replace it. Pingers of
+// families disabled with --allow-ip4 or --allow-ip6 are never started.
+func (m *Manager) reloadPinger(ctx context.Context, current *pinger, is4 bool) *pinger {
+	name := "ipv6"
+	if is4 {
+		name = "ipv4"
+	}
+
+	if !resolve.AllowedFamily(is4) {
+		// Nothing of the family is resolved, so there would be nothing to
+		// send, and the host may not even support it. The flags don't
+		// change, so the pinger was never started either.
+		return current
+	}
+
+	src, err := ip.SourceOf(m.config.Source, is4)
+	if err != nil {
+		m.log.Warn("no source for pinger", "family", name, "err", err)
+		if current.socket == nil {
+			return current
+		}
+		// The source used to exist, don't keep sending from the old one.
+		current.cancel()
+		m.log.Info("stopped pinger", "family", name, "source", current.source)
+		return m.replacement(current)
+	}
+	if current.socket != nil && current.source == src {
+		return current
+	}
+
+	next := m.replacement(current)
+	if err := next.start(ctx, src); err != nil {
+		m.log.Error("failed to start pinger", "family", name, "err", err)
+		return current
+	}
+
+	if current.socket != nil {
+		current.cancel()
+		m.log.Info("restarted pinger, source changed", "family", name, "from", current.source, "to", src)
+
+		// The path from the new source is new, same as a new address would be.
+		for _, t := range m.targets {
+			warmup := m.config.Settings(t.Target).Warmup
+			for _, addr := range t.Addrs {
+				if warmup > 0 && addr.Is4() == is4 {
+					next.warmup(addr, warmup)
+				}
+			}
+		}
+	}
+	return next
+}
+
+// replacement creates an unstarted pinger with the settings of current.
+func (m *Manager) replacement(current *pinger) *pinger {
+	next := newPinger(m.results, m.metrics, m.log, m.clock)
+	next.settings.Store(current.current())
+	next.limit = current.limit
+	return next
+}
+
+// resolved returns the targets to ping after the result. Partial results are
+// merged into the current targets, and the merged targets are held to the
+// address limit like complete results are.
+func (m *Manager) resolved(r resolve.Result) []resolve.Resolution {
+	if !r.Partial {
+		return r.Resolved
+	}
+	return resolve.LimitAddrs(merge(m.targets, r.Resolved), m.config.MaxAddresses)
 }
 
 func (m *Manager) updateTargets(r resolve.Result) {
-	newAddrs := make(map[netip.Addr]struct{})
-	targets := make([]resolve.Resolution, 0, len(r.Resolved))
-	for _, resolution := range r.Resolved {
+	resolved := m.resolved(r)
+
+	// Address to the number of warmup results for it.
+	newAddrs := make(map[netip.Addr]int)
+	targets := make([]resolve.Resolution, 0, len(resolved))
+	for _, resolution := range resolved {
 		targets = append(targets, resolution)
+		warmup := m.config.Settings(resolution.Target).Warmup
+		for _, ip := range resolution.Addrs {
+			newAddrs[ip] = warmup
+		}
+	}
+
+	// Addresses that were looked up again give destinations skipped after
+	// send errors another chance. Only the update is fresh, not what it
+	// was merged with.
+	for _, resolution := range r.Resolved {
+		if !resolution.Fresh {
+			continue
+		}
 		for _, ip := range resolution.Addrs {
-			newAddrs[ip] = struct{}{}
+			if ip.Is4() {
+				m.pingerV4.readmit(ip)
+			} else {
+				m.pingerV6.readmit(ip)
+			}
 		}
 	}
 
@@ -87,43 +335,71 @@ func (m *Manager) updateTargets(r resolve.Result) {
 	}
 
 	add := 0
-	for ip, _ := range newAddrs {
+	active := make(map[string]int)
+	for ip, warmup := range newAddrs {
+		active[family(ip)] += 1
 		if _, ok := addrs[ip]; !ok {
 			add += 1
+			m.metrics.churn.Add(context.Background(), 1, familyKey.String(family(ip)))
+			if warmup > 0 && ip.Is4() {
+				m.pingerV4.warmup(ip, warmup)
+			} else if warmup > 0 {
+				m.pingerV6.warmup(ip, warmup)
+			}
 		}
 	}
 
+	// Only addresses that disappeared are removed, monitors of the others
+	// keep tracking their outstanding packets across the update.
 	remove := 0
 	for ip, _ := range addrs {
-		if _, ok := newAddrs[ip]; !ok {
-			remove += 1
+		if _, ok := newAddrs[ip]; ok {
+			continue
+		}
+		remove += 1
+		m.metrics.churn.Add(context.Background(), 1, familyKey.String(family(ip)))
+		if ip.Is4() {
+			m.pingerV4.remove(ip)
+		} else {
+			m.pingerV6.remove(ip)
 		}
-		m.pingerV4.remove(ip)
-		m.pingerV6.remove(ip)
 	}
 
-	m.pingerV4.targets = targets
-	m.pingerV6.targets = targets
+	m.pingerV4.setTargets(targets)
+	m.pingerV6.setTargets(targets)
+	// Addresses may have changed, so the closest one needs to be found again.
+	m.pingerV4.reselect(targets)
+	m.pingerV6.reselect(targets)
 
-	log.Printf("updated %d probe endpoints\n", remove+add)
+	m.lock.Lock()
+	m.active = active
+	m.lock.Unlock()
+
+	m.log.Info("updated probe endpoints", "added", add, "removed", remove)
+	m.checkFamilies()
 }
 
 func (m *Manager) initPinger(ctx context.Context, c config.Config, r resolve.Result) {
-	m.pingerV4 = &pinger{
-		result:   m.results,
-		monitors: make(map[netip.Addr]*monitor),
-	}
-	m.pingerV6 = &pinger{
-		result:   m.results,
-		monitors: make(map[netip.Addr]*monitor),
+	// Pingers are started by updateConfig.
+	m.pingerV4 = newPinger(m.results, m.metrics, m.log, m.clock)
+	m.pingerV6 = newPinger(m.results, m.metrics, m.log, m.clock)
+	// Both families share the limit.
+	limit := newLimiter(*maxPacketRateFlag, m.clock)
+	m.pingerV4.limit = limit
+	m.pingerV6.limit = limit
+	m.http = newHttpProber(m.results)
+	m.tcp = &tcpProber{
+		result: m.results,
 	}
-	m.updateConfig(c)
+	m.bcast = newBroadcaster()
+	m.updateConfig(ctx, c)
 	m.updateTargets(r)
 
-	if err := m.pingerV4.start(ctx, netip.IPv4Unspecified()); err != nil {
-		log.Printf("failed to start ipv4 pinger: %v", err)
-	}
-	if err := m.pingerV6.start(ctx, netip.IPv6Unspecified()); err != nil {
-		log.Printf("failed to start ipv6 pinger: %v", err)
+	go m.http.run(ctx)
+	go m.tcp.run(ctx)
+	go m.bcast.run(ctx)
+
+	if err := m.registerMetrics(); err != nil {
+		m.log.Error("failed to register ping metrics", "err", err)
 	}
 }
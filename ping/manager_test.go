@@ -0,0 +1,173 @@
+package ping
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/resolve"
+)
+
+func Test_unmonitored(t *testing.T) {
+	v4 := &config.StaticIP{Name: "v4", IP: netip.MustParseAddr("192.0.2.1")}
+	v6 := &config.StaticIP{Name: "v6", IP: netip.MustParseAddr("2001:db8::1")}
+	both := &config.HostnameTarget{Name: "both", Host: "example.com"}
+	http := &config.HttpTarget{Name: "http"}
+	targets := []resolve.Resolution{
+		{Target: v4, Addrs: []netip.Addr{v4.IP}},
+		{Target: v6, Addrs: []netip.Addr{v6.IP}},
+		{Target: both, Addrs: []netip.Addr{v4.IP, v6.IP}},
+		// Probed without a pinger.
+		{Target: http},
+	}
+
+	if got := unmonitored(targets, true, true); len(got) != 0 {
+		t.Errorf("expected every target to be monitored, got: %v", got)
+	}
+	got := unmonitored(targets, true, false)
+	want := map[config.LatencyTarget]string{v6: "ip6", both: "ip6"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+}
+
+func Test_Manager_resolved_LimitsPartial(t *testing.T) {
+	a := &config.StaticIP{Name: "a", IP: netip.MustParseAddr("192.0.2.1")}
+	b := &config.HostnameTarget{Name: "b", Host: "example.com"}
+	m := &Manager{
+		config:  config.Config{MaxAddresses: 2},
+		targets: []resolve.Resolution{{Target: a, Addrs: []netip.Addr{a.IP}}},
+	}
+
+	got := m.resolved(resolve.Result{
+		Partial:  true,
+		Resolved: []resolve.Resolution{{Target: b, Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.3")}}},
+	})
+	want := []resolve.Resolution{
+		{Target: a, Addrs: []netip.Addr{a.IP}},
+		{Target: b, Addrs: []netip.Addr{netip.MustParseAddr("192.0.2.2")}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+}
+
+// newTestManager creates a manager with pingers that aren't started, like
+// newTestPinger. The ipv6 pinger has a source, so that it can receive.
+func newTestManager(clock *fakeClock) *Manager {
+	results := make(chan *PingResult, 100)
+	m := &Manager{
+		metrics: newPingMetrics(),
+		log:     slog.Default(),
+		clock:   clock,
+		results: results,
+		http:    newHttpProber(results),
+		tcp:     &tcpProber{result: results},
+		bcast:   newBroadcaster(),
+	}
+	m.pingerV4 = newPinger(results, m.metrics, m.log, clock)
+	m.pingerV4.source = netip.MustParseAddr("192.0.2.1")
+	m.pingerV6 = newPinger(results, m.metrics, m.log, clock)
+	m.pingerV6.source = netip.MustParseAddr("2001:db8::100")
+	return m
+}
+
+func Test_Manager_updateTargets_KeepsWire(t *testing.T) {
+	clock := newFakeClock()
+	m := newTestManager(clock)
+	target := &config.HostnameTarget{Name: "host", Host: "monitor.example."}
+	kept := netip.MustParseAddr("192.0.2.10")
+	changed := netip.MustParseAddr("192.0.2.20")
+
+	m.updateTargets(resolve.Result{Resolved: []resolve.Resolution{{Target: target, Addrs: []netip.Addr{kept, changed}}}})
+	seq := m.pingerV4.sent(kept, target)
+
+	// Resolved again without the other address, the packet to the kept one
+	// is still outstanding.
+	m.updateTargets(resolve.Result{Resolved: []resolve.Resolution{{Target: target, Addrs: []netip.Addr{kept}, Fresh: true}}})
+	if err := m.pingerV4.handleReceive(reply(kept, seq, clock.Now().Add(time.Millisecond))); err != nil {
+		t.Fatalf("expected the reply to the kept address to be handled, got: %v", err)
+	}
+	if R := nextResult(t, m.results); R.Recv.IsZero() || R.Seq != seq || R.Dest != kept {
+		t.Errorf("expected the reply to be measured across the update, got: %+v", R)
+	}
+}
+
+func Test_Manager_updateTargets_RemovesAfterGrace(t *testing.T) {
+	clock := newFakeClock()
+	m := newTestManager(clock)
+	p := m.pingerV4
+	target := &config.HostnameTarget{Name: "host", Host: "monitor.example."}
+	gone := netip.MustParseAddr("192.0.2.10")
+
+	m.updateTargets(resolve.Result{Resolved: []resolve.Resolution{{Target: target, Addrs: []netip.Addr{gone}}}})
+	seq := p.sent(gone, target)
+	m.updateTargets(resolve.Result{Resolved: []resolve.Resolution{{Target: target, Addrs: []netip.Addr{}, Fresh: true}}})
+
+	p.lock.Lock()
+	mon, ok := p.monitors[gone]
+	removed := ok && !mon.removed.IsZero()
+	p.lock.Unlock()
+	if !removed {
+		t.Fatalf("expected the vanished address to be removed")
+	}
+
+	// Replies in flight are still measured during the grace period.
+	grace := removalGraceTimeouts * p.current().timeout
+	p.expire(p.current(), clock.Now().Add(grace/2))
+	if err := p.handleReceive(reply(gone, seq, clock.Now().Add(time.Millisecond))); err != nil {
+		t.Fatalf("expected the reply to be handled during the grace period, got: %v", err)
+	}
+	if R := nextResult(t, m.results); R.Recv.IsZero() || R.Seq != seq {
+		t.Errorf("expected the reply to be measured, got: %+v", R)
+	}
+
+	p.expire(p.current(), clock.Now().Add(grace+time.Second))
+	p.lock.Lock()
+	_, ok = p.monitors[gone]
+	p.lock.Unlock()
+	if ok {
+		t.Errorf("expected the monitor to be deleted after the grace period")
+	}
+}
+
+func Test_Manager_updateConfig_RestartsChangedFamily(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clock := newFakeClock()
+	m := newTestManager(clock)
+	// Neither pinger is started yet.
+	m.pingerV4.source = netip.Addr{}
+	m.pingerV6.source = netip.Addr{}
+
+	m.updateConfig(ctx, config.Config{PingInterval: time.Second, Source: "127.0.0.1"})
+	if m.pingerV4.socket == nil {
+		t.Skip("can not open icmp sockets")
+	}
+	v4, v6 := m.pingerV4, m.pingerV6
+	if v6.socket != nil {
+		t.Fatalf("expected no ipv6 pinger for an ipv4 source")
+	}
+
+	// Reloading the same source keeps both pingers.
+	m.updateConfig(ctx, config.Config{PingInterval: 2 * time.Second, Source: "127.0.0.1"})
+	if m.pingerV4 != v4 || m.pingerV6 != v6 {
+		t.Errorf("expected the pingers to be kept when the source didn't change")
+	}
+
+	m.updateConfig(ctx, config.Config{PingInterval: 2 * time.Second, Source: "127.0.0.2"})
+	if m.pingerV4 == v4 || m.pingerV4.source != netip.MustParseAddr("127.0.0.2") {
+		t.Errorf("expected the ipv4 pinger to be restarted from the new source, got source %v", m.pingerV4.source)
+	}
+	if m.pingerV6 != v6 {
+		t.Errorf("expected the ipv6 pinger to be left alone")
+	}
+	// The replacement keeps the settings.
+	if got := m.pingerV4.current().interval; got != 2*time.Second {
+		t.Errorf("expected the replacement to keep the interval, got %v", got)
+	}
+}
@@ -0,0 +1,191 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/icmp"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+)
+
+const (
+	familyKey = attribute.Key("family")
+	modeKey   = attribute.Key("mode")
+	nameKey   = attribute.Key("name")
+)
+
+func family(a netip.Addr) string {
+	if a.Is4() {
+		return "ip4"
+	}
+	return "ip6"
+}
+
+// pingMetrics are the instruments the pingers record into.
+type pingMetrics struct {
+	// Replies received from addresses that aren't being monitored. Either
+	// the target was removed while packets were in flight, or there's
+	// cross-talk with another process.
+	orphans syncint64.Counter
+
+	// Sends that were skipped, because sending to the destination keeps
+	// failing.
+	skipped syncint64.Counter
+
+	// Packets that could not be sent, by target.
+	sendErrors syncint64.Counter
+
+	// Addresses that started or stopped being monitored.
+	churn syncint64.Counter
+
+	// Results dropped, because the consumer fell behind.
+	dropped syncint64.Counter
+
+	// Probes skipped, because the rate limit didn't permit sending them
+	// before their next interval.
+	throttled syncint64.Counter
+}
+
+func newPingMetrics() *pingMetrics {
+	meter := global.Meter("netmon")
+	orphans, err := meter.SyncInt64().Counter(
+		"network/orphan_replies",
+		instrument.WithDescription("Count of echo replies received from addresses that are not monitored."))
+	if err != nil {
+		slog.Error("failed to create ping metrics", "err", err)
+		orphans, _ = metric.NewNoopMeter().SyncInt64().Counter("network/orphan_replies")
+	}
+	skipped, err := meter.SyncInt64().Counter(
+		"network/skipped_sends",
+		instrument.WithDescription("Count of probes not sent, because of repeated send errors to the destination."))
+	if err != nil {
+		slog.Error("failed to create ping metrics", "err", err)
+		skipped, _ = metric.NewNoopMeter().SyncInt64().Counter("network/skipped_sends")
+	}
+	sendErrors, err := meter.SyncInt64().Counter(
+		"ping/send_errors",
+		instrument.WithDescription("Count of echo requests that could not be sent, by target."))
+	if err != nil {
+		slog.Error("failed to create ping metrics", "err", err)
+		sendErrors, _ = metric.NewNoopMeter().SyncInt64().Counter("ping/send_errors")
+	}
+	churn, err := meter.SyncInt64().Counter(
+		"ping/monitor_churn",
+		instrument.WithDescription("Count of addresses added to or removed from monitoring."))
+	if err != nil {
+		slog.Error("failed to create ping metrics", "err", err)
+		churn, _ = metric.NewNoopMeter().SyncInt64().Counter("ping/monitor_churn")
+	}
+	dropped, err := meter.SyncInt64().Counter(
+		"ping/results_dropped",
+		instrument.WithDescription("Count of ping results dropped, because the consumer of the results fell behind."))
+	if err != nil {
+		slog.Error("failed to create ping metrics", "err", err)
+		dropped, _ = metric.NewNoopMeter().SyncInt64().Counter("ping/results_dropped")
+	}
+	throttled, err := meter.SyncInt64().Counter(
+		"ping/throttled",
+		instrument.WithDescription("Count of probes skipped, because --max-packet-rate did not permit sending them before the next one."))
+	if err != nil {
+		slog.Error("failed to create ping metrics", "err", err)
+		throttled, _ = metric.NewNoopMeter().SyncInt64().Counter("ping/throttled")
+	}
+	return &pingMetrics{
+		orphans:    orphans,
+		skipped:    skipped,
+		sendErrors: sendErrors,
+		churn:      churn,
+		dropped:    dropped,
+		throttled:  throttled,
+	}
+}
+
+// registerMetrics sets up the metrics that report on the state of the manager.
+func (m *Manager) registerMetrics() error {
+	meter := global.Meter("netmon")
+
+	privileged, err := meter.AsyncInt64().Gauge(
+		"ping/privileged",
+		instrument.WithDescription("1 if the pinger socket for the address family is privileged, 0 if not."))
+	if err != nil {
+		return fmt.Errorf("failed to create metric: %w", err)
+	}
+
+	active, err := meter.AsyncInt64().Gauge(
+		"ping/active_monitors",
+		instrument.WithDescription("Number of addresses currently monitored, by family."))
+	if err != nil {
+		return fmt.Errorf("failed to create metric: %w", err)
+	}
+	err = meter.RegisterCallback([]instrument.Asynchronous{active}, func(ctx context.Context) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		for _, f := range []string{"ip4", "ip6"} {
+			active.Observe(ctx, int64(m.active[f]), familyKey.String(f))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register metric callback: %w", err)
+	}
+
+	// Targets that vanished because their family can't be pinged would
+	// otherwise only show up as missing series.
+	unmonitored, err := meter.AsyncInt64().Gauge(
+		"ping/unmonitored_targets",
+		instrument.WithDescription("Number of targets with addresses of a family that no pinger is running for, by family."))
+	if err != nil {
+		return fmt.Errorf("failed to create metric: %w", err)
+	}
+	err = meter.RegisterCallback([]instrument.Asynchronous{unmonitored}, func(ctx context.Context) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		for _, f := range []string{"ip4", "ip6"} {
+			unmonitored.Observe(ctx, int64(m.unmonitored[f]), familyKey.String(f))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register metric callback: %w", err)
+	}
+
+	responders, err := meter.AsyncInt64().Gauge(
+		"network/broadcast/responders",
+		instrument.WithDescription("Count of distinct hosts that responded to the last broadcast echo request."))
+	if err != nil {
+		return fmt.Errorf("failed to create metric: %w", err)
+	}
+	err = meter.RegisterCallback([]instrument.Asynchronous{responders}, func(ctx context.Context) {
+		for name, count := range m.bcast.snapshot() {
+			responders.Observe(ctx, int64(count), nameKey.String(name))
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register metric callback: %w", err)
+	}
+
+	return meter.RegisterCallback([]instrument.Asynchronous{privileged}, func(ctx context.Context) {
+		m.lock.Lock()
+		pingers := []*pinger{m.pingerV4, m.pingerV6}
+		m.lock.Unlock()
+
+		for _, p := range pingers {
+			if p == nil || p.socket == nil {
+				// Not running, there's no mode to report.
+				continue
+			}
+			var value int64
+			if p.mode == icmp.Privileged {
+				value = 1
+			}
+			privileged.Observe(ctx, value,
+				familyKey.String(family(p.source)),
+				modeKey.String(p.mode.String()))
+		}
+	})
+}
@@ -3,11 +3,15 @@ package ping
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"hash/maphash"
+	"log/slog"
 	"net/netip"
 	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/VolatileDream/workbench/web/network-monitor/config"
@@ -19,41 +23,208 @@ import (
 
 const (
 	maxPendingPackets = 100
+
+	// How long to wait for a reply before a packet is presumed lost, until
+	// a config sets it.
+	defaultProbeTimeout = 5 * time.Second
+	// Packets are presumed lost after this many ping intervals of the
+	// target, but never sooner than minProbeTimeout.
+	lostAfterIntervals = 3
+	minProbeTimeout    = time.Second
+	// Removed monitors are kept for this many probe timeouts, so that
+	// replies still in flight are measured instead of becoming orphans.
+	removalGraceTimeouts = 2
+
+	// The fraction of the configured rate that ramp up starts at.
+	rampUpStartFraction = 0.1
+
+	// Longest time a destination with send errors is skipped for.
+	maxSendBackoff = 5 * time.Minute
+
+	// With jitter, the sender checks for packets to send this many times
+	// per interval, so that sends can be spread between them.
+	jitterSteps = 10
+
+	// Addresses are pinged with echo requests instead, after this many
+	// consecutive timestamp requests are lost. Many hosts ignore them.
+	timestampFallbackLosses = 3
+)
+
+var (
+	sendErrorThresholdFlag = flag.Int("send-error-threshold",
+		5,
+		"Consecutive send errors after which a destination is skipped for a while. Zero never skips.")
+	maxPacketRateFlag = flag.Float64("max-packet-rate",
+		0,
+		"Most icmp probes sent per second, by all pingers combined. Probes are delayed to stay under it, or skipped if they can't be sent before their next interval. Zero is unlimited.")
 )
 
 var (
 	errNoMonitor = errors.New("monitor not found")
+	errSkipped   = errors.New("destination skipped after send errors")
+	errOtherID   = errors.New("reply to another process")
 )
 
+// Identifies the echo requests of privileged pingers, which receive the
+// replies to every process.
+var echoID = os.Getpid() & 0xffff
+
 type pinger struct {
-	cancel   func()
-	interval time.Duration
-	targets  []resolve.Resolution
+	cancel func()
+	// Replaced by the manager when the config or the targets change, see
+	// configure and setTargets.
+	settings atomic.Pointer[pingerSettings]
 
 	source netip.Addr
 	socket *xicmp.PacketConn
-
-	result chan<- *PingResult
+	mode   icmp.ListenMode
+	// Current state of the don't fragment option on the socket.
+	dontFragment bool
+	// Type of service the socket currently marks packets with.
+	tos int
+
+	// Picks the offset of every address with jitter, see splay.
+	seed maphash.Seed
+
+	result  chan<- *PingResult
+	metrics *pingMetrics
+	log     *slog.Logger
+	clock   Clock
+	// Shared by the pingers of both families, nil if unlimited.
+	limit *limiter
 
 	lock sync.Mutex
 	// Map of destination to id
 	monitors map[netip.Addr]*monitor
+	// Warmup results to apply to monitors when they are next created.
+	warmups map[netip.Addr]int
+	// Address selection of targets that only ping their closest address.
+	selections map[config.LatencyTarget]*selection
+	// Rotation of targets that ping one address at a time.
+	robins map[config.LatencyTarget]*roundRobin
+}
 
-	// next seq
-	sequence uint16
+// pingerSettings are the settings of a pinger that change with the config and
+// the targets. They are never modified once stored, so that the sender and the
+// reaper can load them once per tick while the manager replaces them.
+type pingerSettings struct {
+	interval time.Duration
+	rampUp   time.Duration
+	// How long to wait for replies, unless targets with longer ping
+	// intervals wait longer, see lostAfter.
+	timeout time.Duration
+	targets []resolve.Resolution
+	// Used to look up per-target settings.
+	cfg config.Config
 }
 
 type monitor struct {
 	target config.LatencyTarget
-	wire   []outstandingPacket
+	// Reverse DNS name of the address, if known.
+	hostname string
+	wire     []outstandingPacket
+	// Packets reported as lost because a later packet was answered first.
+	// Kept to tell when their replies were only out of order.
+	missed []outstandingPacket
+	// Configured payload size of the packets sent to the address.
+	size int
+
+	// Number of packets sent to the address, the low 16 bits are the
+	// sequence number on the wire. Every address has its own, so a reply
+	// maps to exactly one outstanding packet. Kept whole so that replies
+	// can't match packets sent before the sequence number wrapped around.
+	sequence uint64
+
+	// Consecutive send errors, once past the threshold the destination is
+	// skipped until skipUntil, which grows with every further error.
+	sendErrs  int
+	skipUntil time.Time
+
+	// Number of received results remaining that are marked as warmup.
+	warmup int
+
+	// Consecutive timestamp requests without a reply, once past the
+	// fallback threshold echoOnly is set and echo requests are sent instead.
+	timestampLost int
+	echoOnly      bool
+
+	// When the next packet should be sent, targets can have their own ping
+	// interval.
+	nextSend time.Time
+
+	// When the monitor was removed, zero if it's active. Removed monitors
+	// still receive, but are deleted after a grace period.
+	removed time.Time
+}
 
-	// We count send errors to possibly ignore the ip.
-	sendErrs int
+// miss remembers a packet that was reported as lost, in case its reply
+// arrives late.
+func (m *monitor) miss(pkt outstandingPacket) {
+	if pkt.Timestamp {
+		m.timestampLost += 1
+	}
+	if len(m.missed) >= maxPendingPackets {
+		m.missed = append(m.missed[:0], m.missed[1:]...)
+	}
+	m.missed = append(m.missed, pkt)
 }
 
 type outstandingPacket struct {
-	Seq  int // actually uint16
+	Seq  uint64 // see monitor.sequence
 	Sent time.Time
+	// Sent as an ICMP Timestamp request, instead of an echo request.
+	Timestamp bool
+}
+
+func newPinger(result chan<- *PingResult, metrics *pingMetrics, log *slog.Logger, clock Clock) *pinger {
+	p := &pinger{
+		result:     result,
+		metrics:    metrics,
+		log:        log,
+		clock:      clock,
+		seed:       maphash.MakeSeed(),
+		monitors:   make(map[netip.Addr]*monitor),
+		warmups:    make(map[netip.Addr]int),
+		selections: make(map[config.LatencyTarget]*selection),
+		robins:     make(map[config.LatencyTarget]*roundRobin),
+	}
+	p.settings.Store(&pingerSettings{
+		timeout: defaultProbeTimeout,
+	})
+	return p
+}
+
+// current returns the settings the pinger currently runs with.
+func (p *pinger) current() *pingerSettings {
+	return p.settings.Load()
+}
+
+// update stores a copy of the current settings, changed by the function.
+// Updates hold the lock, so that concurrent ones aren't lost.
+func (p *pinger) update(change func(s *pingerSettings)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	next := *p.current()
+	change(&next)
+	p.settings.Store(&next)
+}
+
+// configure applies the settings of the config to the pinger.
+func (p *pinger) configure(c config.Config) {
+	p.update(func(s *pingerSettings) {
+		s.interval = c.PingInterval
+		s.rampUp = c.RampUp
+		s.timeout = configTimeout(c)
+		s.cfg = c
+	})
+}
+
+// setTargets replaces the targets the pinger sends to.
+func (p *pinger) setTargets(targets []resolve.Resolution) {
+	p.update(func(s *pingerSettings) {
+		s.targets = targets
+	})
 }
 
 // start creates and starts both the send and receive portions of the
@@ -63,93 +234,626 @@ func (p *pinger) start(ctx context.Context, source netip.Addr) error {
 	p.cancel = cancel
 
 	p.source = source
-	socket, err := icmp.Listen(source)
+	p.log = p.log.With("source", source)
+	socket, err := icmp.ListenAny(source)
 	if err != nil {
 		return fmt.Errorf("could not listen: %w", err)
 	}
 	p.socket = socket
+	p.mode = icmp.ModeOf(socket)
+	if err := icmp.ReceiveTTL(socket); err != nil {
+		p.log.Warn("pinger can not observe reply ttl", "err", err)
+	}
+	p.log.Info("started pinger", "mode", p.mode)
 
 	go p.sender(ctx)
 	go p.receiver(ctx)
+	go p.reaper(ctx)
 
 	return nil
 }
 
+// warmup marks the next n results for the address as warmup results.
+func (p *pinger) warmup(addr netip.Addr, n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if mon, ok := p.monitors[addr]; ok {
+		mon.warmup = n
+	} else {
+		p.warmups[addr] = n
+	}
+}
+
+// readmit sends to the address again, if it was skipped after send errors.
+func (p *pinger) readmit(addr netip.Addr) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	mon, ok := p.monitors[addr]
+	if !ok || mon.sendErrs == 0 {
+		return
+	}
+	if p.clock.Now().Before(mon.skipUntil) {
+		p.log.Info("readmitting destination after resolving it", "addr", addr, "errors", mon.sendErrs)
+	}
+	mon.sendErrs = 0
+	mon.skipUntil = time.Time{}
+}
+
+// remove stops monitoring the address. The monitor is kept around for a grace
+// period to receive replies that are still in flight, see expire.
 func (p *pinger) remove(addr netip.Addr) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	if _, ok := p.monitors[addr]; ok {
-		delete(p.monitors, addr)
+	if mon, ok := p.monitors[addr]; ok && mon.removed.IsZero() {
+		mon.removed = p.clock.Now()
+	}
+	delete(p.warmups, addr)
+}
+
+// expire deletes removed monitors whose grace period is over.
+func (p *pinger) expire(s *pingerSettings, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	grace := removalGraceTimeouts * s.timeout
+	for addr, mon := range p.monitors {
+		if !mon.removed.IsZero() && now.Sub(mon.removed) > grace {
+			delete(p.monitors, addr)
+		}
 	}
 }
 
 func (p *pinger) sender(ctx context.Context) {
-	timer := time.NewTimer(p.interval)
+	started := p.clock.Now()
+	s := p.current()
+	timer := p.clock.NewTimer(s.rampTick(0))
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-timer.C:
+		case <-timer.C():
 		}
 
 		// Reset the timer. This is when we pick up changes.
-		timer.Reset(p.interval)
-
-		targets := p.targets
-		for _, t := range targets {
-			for _, dest := range t.Addrs {
+		s := p.current()
+		now := p.clock.Now()
+		elapsed := now.Sub(started)
+		tick := s.rampTick(elapsed)
+		timer.Reset(tick)
+		p.expire(s, now)
+
+		for _, t := range s.targets {
+			interval := rampInterval(s.cfg.Settings(t.Target).PingInterval, s.rampUp, elapsed)
+			for _, dest := range p.destinations(s, t, now, tick, interval) {
 				if dest.Is4() != p.source.Is4() {
 					continue
 				}
-				err := p.send(ctx, dest, t.Target)
-				if err != nil {
-					log.Printf("error sending packet: %v\n", err)
+				if !p.due(s, dest, t, now, tick, interval) {
+					continue
+				}
+				if !p.throttle(ctx, interval) {
+					p.metrics.throttled.Add(ctx, 1, nameKey.String(t.Target.MetricName()))
+					continue
+				}
+				err := p.send(ctx, s, dest, t.Target)
+				if errors.Is(err, syscall.EMSGSIZE) {
+					// Only happens with don't fragment set, but isn't lost.
+					p.report(&PingResult{
+						Sent:    p.clock.Now(),
+						Src:     p.source,
+						Dest:    dest,
+						Target:  t.Target,
+						Failure: FailureFragmentationNeeded,
+
+						PayloadSize: payloadSize(s.cfg.Settings(t.Target).PayloadSize, dest),
+					})
+				} else if errors.Is(err, errSkipped) {
+					p.metrics.skipped.Add(ctx, 1, nameKey.String(t.Target.MetricName()))
+				} else if err != nil {
+					p.log.Debug("error sending packet", "target", t.Target.MetricName(), "addr", dest, "err", err)
+				} else {
+					p.sentTo(t.Target, dest)
 				}
 			}
 		}
 	}
 }
 
-func (p *pinger) send(ctx context.Context, dest netip.Addr, t config.LatencyTarget) error {
+// throttle waits until the rate limit permits sending a packet. Reports false
+// if the packet should be skipped instead, because it can't be sent before the
+// next one is due.
+func (p *pinger) throttle(ctx context.Context, interval time.Duration) bool {
+	wait, ok := p.limit.reserve(interval)
+	if !ok {
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := p.clock.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C():
+		return true
+	}
+}
+
+// tick returns the time between checks for packets to send, which is the
+// shortest ping interval of any target, or a fraction of it with jitter.
+func (s *pingerSettings) tick() time.Duration {
+	tick := s.interval
+	for _, t := range s.targets {
+		if i := s.cfg.Settings(t.Target).PingInterval; i > 0 && i < tick {
+			tick = i
+		}
+	}
+	if s.cfg.Jitter {
+		tick /= jitterSteps
+		if tick < config.SmallestPingInterval {
+			tick = config.SmallestPingInterval
+		}
+	}
+	return tick
+}
+
+// rampTick returns the tick once the sender ran for elapsed. During ramp up
+// it's stretched like the intervals are, and divided like with jitter, so
+// that the splayed first sends are spread over the interval instead of
+// rounded to a few ticks.
+func (s *pingerSettings) rampTick(elapsed time.Duration) time.Duration {
+	tick := rampInterval(s.tick(), s.rampUp, elapsed)
+	if elapsed < s.rampUp && !s.cfg.Jitter {
+		tick /= jitterSteps
+		if tick < config.SmallestPingInterval {
+			tick = config.SmallestPingInterval
+		}
+	}
+	return tick
+}
+
+// splayed reports whether the first send to an address waits for its offset
+// within the interval, see splay. With ramp up, that keeps every address from
+// starting at once, which is only a slower burst otherwise.
+func (s *pingerSettings) splayed() bool {
+	return s.cfg.Jitter || s.rampUp > 0
+}
+
+// splay returns the offset of the sends to the address within the interval.
+// Offsets are spread uniformly over the interval, and stay the same for as
+// long as the pinger runs.
+func (p *pinger) splay(dest netip.Addr, interval time.Duration) time.Duration {
+	fraction := float64(maphash.Bytes(p.seed, dest.AsSlice())>>11) / (1 << 53)
+	return time.Duration(fraction * float64(interval))
+}
+
+// due reports whether a packet should be sent to the address now, and if so
+// schedules the next one. Packets due before the next tick are sent early,
+// otherwise the timer jitter would push them back by a whole tick.
+func (p *pinger) due(s *pingerSettings, dest netip.Addr, r resolve.Resolution, now time.Time, tick, interval time.Duration) bool {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
+	mon := p.monitor(dest, r.Target)
+	mon.hostname = r.Hostname
+	// Round robin targets splay their rotation instead, see rotate.
+	if mon.nextSend.IsZero() && s.splayed() && s.cfg.Settings(r.Target).Selection != config.SelectRoundRobin {
+		// Later sends keep the offset of the first.
+		mon.nextSend = now.Add(p.splay(dest, interval))
+	}
+	if now.Add(tick / 2).Before(mon.nextSend) {
+		return false
+	}
+	mon.nextSend = now.Add(interval)
+	return true
+}
+
+// monitor returns the monitor of the address, creating it if it doesn't exist.
+// Must be called with the lock held.
+func (p *pinger) monitor(dest netip.Addr, t config.LatencyTarget) *monitor {
 	mon, ok := p.monitors[dest]
 	if !ok {
 		mon = &monitor{
 			target: t,
 			wire:   make([]outstandingPacket, 0, maxPendingPackets),
+			warmup: p.warmups[dest],
 		}
 		p.monitors[dest] = mon
+		delete(p.warmups, dest)
 	}
+	return mon
+}
+
+// defaultPayload is the data of echo requests, unless a size is configured.
+var defaultPayload = []byte("github.com/VolatileDream")
 
-	p.sequence += 1
-	echo := xicmp.Echo{
-		ID:   0, // can't be set by us.
-		Seq:  int(p.sequence),
-		Data: []byte("github.com/VolatileDream"),
+// payload returns echo data of the size, which starts with the default
+// payload so that the packets are still recognizable.
+func payload(size int) []byte {
+	if size == 0 {
+		return defaultPayload
+	}
+	data := make([]byte, size)
+	copy(data, defaultPayload)
+	return data
+}
+
+// payloadSize returns the size of the echo data sent to the address. Targets
+// that aren't an address may resolve to ipv6 addresses, whose larger header
+// leaves less of the MTU, so their payload is cut down to fit instead of
+// fragmenting.
+func payloadSize(size int, dest netip.Addr) int {
+	if dest.Is6() && size > config.MaxPayloadSize6 {
+		return config.MaxPayloadSize6
+	}
+	return size
+}
+
+// rampInterval scales the interval so that the send rate increases linearly
+// from a fraction of the full rate to the full rate over the ramp duration.
+func rampInterval(interval, ramp, elapsed time.Duration) time.Duration {
+	if ramp <= 0 || elapsed >= ramp {
+		return interval
+	}
+	fraction := float64(elapsed) / float64(ramp)
+	if fraction < rampUpStartFraction {
+		fraction = rampUpStartFraction
+	}
+	return time.Duration(float64(interval) / fraction)
+}
+
+func (p *pinger) send(ctx context.Context, s *pingerSettings, dest netip.Addr, t config.LatencyTarget) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	mon := p.monitor(dest, t)
+	// The target was added back before the monitor expired.
+	mon.removed = time.Time{}
+
+	if p.clock.Now().Before(mon.skipUntil) {
+		return errSkipped
+	}
+
+	if df := s.cfg.Settings(t).DontFragment; df != p.dontFragment {
+		if err := icmp.SetDontFragment(p.socket, df); err != nil {
+			return fmt.Errorf("could not set don't fragment: %w", err)
+		}
+		p.dontFragment = df
+	}
+	if tos := icmp.TOS(s.cfg.Settings(t).DSCP); tos != p.tos {
+		if err := icmp.SetTOS(p.socket, tos); err != nil {
+			return fmt.Errorf("could not set tos: %w", err)
+		}
+		p.tos = tos
 	}
 
-	now := time.Now()
-	if err := icmp.SendIcmpEcho(p.socket, &echo, dest); err != nil {
+	mon.size = payloadSize(s.cfg.Settings(t).PayloadSize, dest)
+	mon.sequence += 1
+	now := p.clock.Now()
+	timestamp := p.useTimestamp(s, dest, mon)
+	var err error
+	if timestamp {
+		err = icmp.SendIcmpTimestamp(p.socket, &icmp.Timestamp{
+			ID:        echoID,
+			Seq:       int(uint16(mon.sequence)),
+			Originate: icmp.TimestampMillis(now),
+		}, dest)
+	} else {
+		echo := xicmp.Echo{
+			// Unprivileged sockets replace it with their own.
+			ID:   echoID,
+			Seq:  int(uint16(mon.sequence)),
+			Data: payload(mon.size),
+		}
+		err = icmp.SendIcmpEcho(p.socket, &echo, dest)
+	}
+	if err != nil {
+		if !errors.Is(err, syscall.EMSGSIZE) {
+			p.sendFailed(s, dest, mon, now)
+		}
 		return err
 	}
+	if mon.sendErrs >= *sendErrorThresholdFlag && *sendErrorThresholdFlag > 0 {
+		p.log.Info("sending recovered after errors", "addr", dest, "errors", mon.sendErrs)
+	}
+	mon.sendErrs = 0
+
+	p.outstanding(dest, mon, outstandingPacket{
+		Seq:       mon.sequence,
+		Sent:      now,
+		Timestamp: timestamp,
+	})
 
+	return nil
+}
+
+// outstanding records a packet as sent to the address, to wait for its reply.
+// Must be called with the lock held.
+func (p *pinger) outstanding(dest netip.Addr, mon *monitor, pkt outstandingPacket) {
 	if len(mon.wire) >= maxPendingPackets {
-		// Instead of removing one or two items, remove a quarter so that
-		// we amortize the removal across multiple items.
+		// Short intervals with long timeouts fill the wire before the reaper
+		// gets to it. Instead of removing one or two items, remove a quarter
+		// so that we amortize the removal across multiple items. They are
+		// the oldest, report them as lost instead of forgetting them.
 		q := maxPendingPackets / 4
+		for _, evicted := range mon.wire[:q] {
+			p.lost(dest, mon, evicted)
+		}
 		mon.wire = append(mon.wire[:0], mon.wire[q:]...)
 	}
+	mon.wire = append(mon.wire, pkt)
+}
 
-	mon.wire = append(mon.wire, outstandingPacket{
-		Seq:  int(p.sequence),
-		Sent: now,
+// lost reports an outstanding packet as lost. Must be called with the lock
+// held.
+func (p *pinger) lost(dest netip.Addr, mon *monitor, pkt outstandingPacket) {
+	p.report(&PingResult{
+		Sent:        pkt.Sent,
+		Seq:         pkt.Seq,
+		Src:         p.source,
+		Dest:        dest,
+		Target:      mon.target,
+		RemoteName:  mon.hostname,
+		PayloadSize: mon.size,
 	})
+	mon.miss(pkt)
+}
 
-	return nil
+// useTimestamp reports whether to send an ICMP Timestamp request to the
+// address, instead of an echo request. Only ipv4 has them, and only privileged
+// sockets can send them. Must be called with the lock held.
+func (p *pinger) useTimestamp(s *pingerSettings, dest netip.Addr, mon *monitor) bool {
+	if !s.cfg.Settings(mon.target).Timestamp || !dest.Is4() || p.mode != icmp.Privileged || mon.echoOnly {
+		return false
+	}
+	if mon.timestampLost >= timestampFallbackLosses {
+		p.log.Info("no timestamp replies, falling back to echo requests", "target", mon.target.MetricName(), "addr", dest, "lost", mon.timestampLost)
+		mon.echoOnly = true
+		return false
+	}
+	return true
+}
+
+// oneWay splits the latency of a timestamp reply into each direction, if the
+// destination's clock is in the standard format.
+func oneWay(sent time.Time, echo *icmp.IcmpResponse) *OneWay {
+	ts := echo.Timestamp
+	if ts == nil {
+		return nil
+	}
+	received, ok := timestampTime(ts.Receive, sent)
+	if !ok {
+		return nil
+	}
+	transmitted, ok := timestampTime(ts.Transmit, sent)
+	if !ok {
+		return nil
+	}
+	return &OneWay{
+		Outbound: received.Sub(sent),
+		Return:   echo.When.Sub(transmitted),
+	}
+}
+
+// timestampTime converts milliseconds since midnight UTC to the time closest
+// to near, so that probes around midnight get the right day. Fails if the
+// high bit is set, which marks non-standard times.
+func timestampTime(millis uint32, near time.Time) (time.Time, bool) {
+	const day = 24 * time.Hour
+	if millis >= uint32(day/time.Millisecond) {
+		return time.Time{}, false
+	}
+	t := near.UTC().Truncate(day).Add(time.Duration(millis) * time.Millisecond)
+	if d := t.Sub(near); d > day/2 {
+		t = t.Add(-day)
+	} else if d < -day/2 {
+		t = t.Add(day)
+	}
+	return t, true
+}
+
+// report sends the result to the consumer. Results are dropped and counted
+// when the consumer falls behind, instead of stalling the pinger, which is
+// usually holding the lock. The consumer may also be gone once the pinger is
+// stopped.
+func (p *pinger) report(r *PingResult) {
+	select {
+	case p.result <- r:
+	default:
+		p.metrics.dropped.Add(context.Background(), 1, nameKey.String(r.Target.MetricName()))
+	}
+}
+
+// sendFailed counts a send error for the monitor, and skips the destination
+// with exponential backoff once there are too many. Must be called with the
+// lock held.
+func (p *pinger) sendFailed(s *pingerSettings, dest netip.Addr, mon *monitor, now time.Time) {
+	mon.sendErrs += 1
+	p.metrics.sendErrors.Add(context.Background(), 1, nameKey.String(mon.target.MetricName()))
+	threshold := *sendErrorThresholdFlag
+	if threshold <= 0 || mon.sendErrs < threshold {
+		return
+	}
+
+	// Skipped for at least an interval of the target, which may be longer or
+	// shorter than the global one.
+	backoff := s.cfg.Settings(mon.target).PingInterval
+	for i := threshold; i < mon.sendErrs && backoff < maxSendBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxSendBackoff {
+		backoff = maxSendBackoff
+	}
+	mon.skipUntil = now.Add(backoff)
+	p.log.Warn("skipping destination after send errors", "addr", dest, "for", backoff, "errors", mon.sendErrs)
+}
+
+// unreachable reports the packet that a destination unreachable error was
+// received for as failed. Must be called with the lock held.
+func (p *pinger) unreachable(monitor *monitor, echo *icmp.IcmpResponse, seq uint64) error {
+	for i, outstanding := range monitor.wire {
+		if outstanding.Seq != seq {
+			continue
+		}
+		R := &PingResult{
+			Sent:        outstanding.Sent,
+			Seq:         outstanding.Seq,
+			Src:         p.source,
+			Dest:        echo.From,
+			Target:      monitor.target,
+			RemoteName:  monitor.hostname,
+			Failure:     FailureUnreachable,
+			PayloadSize: monitor.size,
+		}
+		if echo.FragmentationNeeded {
+			p.log.Debug("fragmentation needed", "target", monitor.target.MetricName(), "addr", echo.From, "reporter", echo.Reporter, "mtu", echo.MTU)
+			R.Failure = FailureFragmentationNeeded
+			R.PathMTU = echo.MTU
+		} else {
+			p.log.Debug("destination unreachable", "target", monitor.target.MetricName(), "addr", echo.From, "reporter", echo.Reporter)
+		}
+		p.report(R)
+		monitor.wire = append(monitor.wire[:i], monitor.wire[i+1:]...)
+		return nil
+	}
+	// Already reported as lost, which it was.
+	return fmt.Errorf("unreachable error for a packet that is not outstanding: %s seq %d", echo.From, seq)
+}
+
+// receivedMissed reports a reply to a packet that was already reported as
+// lost as out of order. Must be called with the lock held.
+func (p *pinger) receivedMissed(monitor *monitor, echo *icmp.IcmpResponse, seq uint64) bool {
+	for i, missed := range monitor.missed {
+		if missed.Seq != seq {
+			continue
+		}
+		p.report(&PingResult{
+			Sent:        missed.Sent,
+			Recv:        echo.When,
+			Seq:         missed.Seq,
+			Src:         p.source,
+			Dest:        echo.From,
+			Target:      monitor.target,
+			RemoteName:  monitor.hostname,
+			PayloadSize: monitor.size,
+			TTL:         echo.TTL,
+			OutOfOrder:  true,
+			OneWay:      oneWay(missed.Sent, echo),
+		})
+		monitor.missed = append(monitor.missed[:i], monitor.missed[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// unwrapSequence returns the most recently sent sequence, up to last, that
+// has the 16 bit sequence number of a reply.
+func unwrapSequence(last uint64, wire int) uint64 {
+	behind := uint16(last) - uint16(wire)
+	if uint64(behind) > last {
+		// Before the first packet, can't be ours.
+		return 0
+	}
+	return last - uint64(behind)
+}
+
+// probeTimeout returns how long to wait for replies from pings sent every
+// interval, before presuming they're lost.
+func probeTimeout(interval time.Duration) time.Duration {
+	timeout := lostAfterIntervals * interval
+	if timeout < minProbeTimeout {
+		return minProbeTimeout
+	}
+	return timeout
+}
+
+// expireOlder reports the packets sent before the one that was replied to as
+// lost, if they have also timed out. Packets that haven't may only be
+// reordered, and are left to the reaper. Must be called with the lock held.
+func (p *pinger) expireOlder(s *pingerSettings, monitor *monitor, echo *icmp.IcmpResponse, seq uint64) {
+	timeout := s.lostAfter(monitor.target)
+	kept := monitor.wire[:0]
+	for _, outstanding := range monitor.wire {
+		if outstanding.Seq > seq || echo.When.Sub(outstanding.Sent) <= timeout {
+			kept = append(kept, outstanding)
+			continue
+		}
+		p.report(&PingResult{
+			Sent:        outstanding.Sent,
+			Seq:         outstanding.Seq,
+			Src:         p.source,
+			Dest:        echo.From,
+			Target:      monitor.target,
+			RemoteName:  monitor.hostname,
+			PayloadSize: monitor.size,
+		})
+		monitor.miss(outstanding)
+	}
+	monitor.wire = kept
+}
+
+// configTimeout returns how long the pingers wait for replies, unless targets
+// with longer ping intervals wait longer, see lostAfter.
+func configTimeout(c config.Config) time.Duration {
+	if c.PingTimeout > 0 {
+		return c.PingTimeout
+	}
+	return probeTimeout(c.PingInterval)
+}
+
+// lostAfter returns how long packets sent to the target wait for a reply,
+// before they're presumed lost.
+func (s *pingerSettings) lostAfter(t config.LatencyTarget) time.Duration {
+	if s.cfg.PingTimeout > 0 {
+		return s.cfg.PingTimeout
+	}
+	timeout := probeTimeout(s.cfg.Settings(t).PingInterval)
+	if timeout < s.timeout {
+		timeout = s.timeout
+	}
+	return timeout
+}
+
+// reaper reports packets without a reply as lost once they time out, so that
+// a target that stops replying entirely is noticed.
+func (p *pinger) reaper(ctx context.Context) {
+	timer := p.clock.NewTimer(p.current().timeout / 2)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C():
+		}
+		s := p.current()
+		timer.Reset(s.timeout / 2)
+		p.reap(s, p.clock.Now())
+	}
+}
+
+// reap reports every packet that has timed out as lost.
+func (p *pinger) reap(s *pingerSettings, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for addr, mon := range p.monitors {
+		timeout := s.lostAfter(mon.target)
+
+		// Packets are in the order they were sent.
+		i := 0
+		for i < len(mon.wire) && now.Sub(mon.wire[i].Sent) > timeout {
+			p.lost(addr, mon, mon.wire[i])
+			i++
+		}
+		mon.wire = append(mon.wire[:0], mon.wire[i:]...)
+	}
 }
 
 func (p *pinger) receiver(ctx context.Context) {
@@ -169,63 +873,95 @@ func (p *pinger) receiver(ctx context.Context) {
 		if err != nil {
 			if errors.Is(err, os.ErrDeadlineExceeded) {
 				continue
+			} else if errors.Is(err, icmp.ErrNotEcho) {
+				// Privileged sockets receive every icmp message.
+				p.log.Debug("ignored icmp message", "err", err)
+				continue
 			} else if errors.Is(err, os.ErrClosed) {
 				// unexpected!
 				// Receiver is responsible for closing the socket when exiting.
-				log.Printf("icmp socket closed: %v", err)
+				p.log.Error("icmp socket closed", "err", err)
 				return
 			}
 			// TODO: classify and do something better.
-			log.Printf("receiver socket error on read: %v", err)
+			p.log.Warn("receiver socket error on read", "err", err)
 			continue
 		}
 
 		if err := p.handleReceive(echo); err != nil {
-			log.Printf("error handling received packet: %v", err)
+			p.log.Debug("error handling received packet", "err", err)
 		}
 	}
 }
 func (p *pinger) handleReceive(echo *icmp.IcmpResponse) error {
+	s := p.current()
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
+	if p.mode == icmp.Privileged && echo.Echo.ID != echoID {
+		// Unprivileged sockets only receive their own replies.
+		return errOtherID
+	}
+
 	monitor, ok := p.monitors[echo.From]
 	if !ok {
-		// Should have been created on send.
-		return fmt.Errorf("monitor not found for: %s", echo.From)
+		// Should have been created on send, so either the target was removed
+		// or the reply isn't ours. Without the send time there is no latency
+		// to compute, so only count it.
+		p.metrics.orphans.Add(context.Background(), 1, familyKey.String(family(echo.From)))
+		return fmt.Errorf("%w for: %s", errNoMonitor, echo.From)
 	}
 
-	// Try to find the the number in the outstanding packet list.
+	// Try to find the the number in the outstanding packet list. Sequences
+	// are per address and the list is in the order sent, so packets past the
+	// number were sent later and are still outstanding.
+	seq := unwrapSequence(monitor.sequence, echo.Echo.Seq)
+	if echo.Unreachable {
+		return p.unreachable(monitor, echo, seq)
+	}
+	if echo.Timestamp != nil {
+		monitor.timestampLost = 0
+	}
 	found := false
 	for i, outstanding := range monitor.wire {
-		if outstanding.Seq == echo.Echo.Seq {
+		if outstanding.Seq > seq {
+			break
+		}
+		if outstanding.Seq == seq {
 			R := &PingResult{
-				Sent:   outstanding.Sent,
-				Recv:   echo.When,
-				Src:    p.source,
-				Dest:   echo.From,
-				Target: monitor.target,
+				Sent:        outstanding.Sent,
+				Recv:        echo.When,
+				Seq:         outstanding.Seq,
+				Src:         p.source,
+				Dest:        echo.From,
+				Target:      monitor.target,
+				RemoteName:  monitor.hostname,
+				PayloadSize: monitor.size,
+				TTL:         echo.TTL,
+				Warmup:      monitor.warmup > 0,
+				OneWay:      oneWay(outstanding.Sent, echo),
+			}
+			if monitor.warmup > 0 {
+				monitor.warmup -= 1
 			}
-			p.result <- R
+			p.measured(monitor.target, echo.From, R.Elapsed())
+			p.report(R)
 			found = true
-			monitor.wire = append(monitor.wire[:0], monitor.wire[i+1:]...)
+			monitor.wire = append(monitor.wire[:i], monitor.wire[i+1:]...)
 			break
 		}
-
-		// missing packet...
-		R := &PingResult{
-			Sent:   outstanding.Sent,
-			Src:    p.source,
-			Dest:   echo.From,
-			Target: monitor.target,
-		}
-		p.result <- R
+	}
+	if found {
+		p.expireOlder(s, monitor, echo, seq)
 	}
 
+	if !found {
+		found = p.receivedMissed(monitor, echo, seq)
+	}
 	if !found {
 		// Not clear if we should drop the contents of wire here or not?
 		// monitor.wire = monitor.wire[:0]
-		log.Printf("did not find packet for %v seq: %d", echo.From, echo.Echo.Seq)
+		p.log.Debug("did not find packet", "target", monitor.target.MetricName(), "addr", echo.From, "seq", echo.Echo.Seq)
 	}
 
 	return nil
@@ -0,0 +1,708 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/icmp"
+	"github.com/VolatileDream/workbench/web/network-monitor/resolve"
+
+	xicmp "golang.org/x/net/icmp"
+)
+
+// fakeClock only moves when advanced, firing the timers that are due.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+var _ Clock = &fakeClock{}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTimer{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		when:   c.now.Add(d),
+		active: true,
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward, and fires the timers that are due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.when.After(c.now) {
+			t.active = false
+			select {
+			case t.c <- c.now:
+			default:
+			}
+		}
+	}
+}
+
+// WaitArmed blocks until n timers are waiting to fire, so that advancing the
+// clock doesn't race with a goroutine that has yet to reset its timer.
+func (c *fakeClock) WaitArmed(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.lock.Lock()
+		armed := 0
+		for _, timer := range c.timers {
+			if timer.active {
+				armed++
+			}
+		}
+		c.lock.Unlock()
+		if armed >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d timers", n)
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	when   time.Time
+	active bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	was := t.active
+	t.when = t.clock.now.Add(d)
+	t.active = true
+	return was
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+// newTestPinger creates a pinger without a socket, that can receive and reap
+// but not send.
+func newTestPinger(clock Clock) (*pinger, <-chan *PingResult) {
+	results := make(chan *PingResult, 100)
+	p := newPinger(results, newPingMetrics(), slog.Default(), clock)
+	p.source = netip.MustParseAddr("192.0.2.1")
+	return p, results
+}
+
+// sent records a packet as sent to the address now, as send does.
+func (p *pinger) sent(addr netip.Addr, t config.LatencyTarget) uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	mon := p.monitor(addr, t)
+	mon.sequence += 1
+	p.outstanding(addr, mon, outstandingPacket{Seq: mon.sequence, Sent: p.clock.Now()})
+	return mon.sequence
+}
+
+func reply(addr netip.Addr, seq uint64, when time.Time) *icmp.IcmpResponse {
+	return &icmp.IcmpResponse{
+		From: addr,
+		Echo: &xicmp.Echo{Seq: int(uint16(seq))},
+		When: when,
+	}
+}
+
+func nextResult(t *testing.T, results <-chan *PingResult) *PingResult {
+	select {
+	case r := <-results:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a result")
+		return nil
+	}
+}
+
+func expectNoResult(t *testing.T, results <-chan *PingResult) {
+	select {
+	case r := <-results:
+		t.Errorf("unexpected result: %+v", r)
+	default:
+	}
+}
+
+func Test_pinger_Reaper(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	p, results := newTestPinger(clock)
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+	start := clock.Now()
+	seq := p.sent(addr, target)
+
+	go p.reaper(ctx)
+	// Reaps every half timeout, the packet times out after the second.
+	for i := 0; i < 3; i++ {
+		clock.WaitArmed(t, 1)
+		clock.Advance(p.current().timeout / 2)
+	}
+
+	R := nextResult(t, results)
+	if !R.Recv.IsZero() || !R.Sent.Equal(start) || R.Dest != addr || R.Target != target || R.Seq != seq {
+		t.Errorf("expected lost packet sent at %v, got: %+v", start, R)
+	}
+	expectNoResult(t, results)
+}
+
+func Test_pinger_ReloadWhileRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	clock := newFakeClock()
+	p, _ := newTestPinger(clock)
+	p.configure(config.Config{PingInterval: time.Second})
+	go p.sender(ctx)
+	go p.reaper(ctx)
+
+	// The pinger has no socket, addresses of the other family are skipped
+	// before sending.
+	r := resolve.Resolution{
+		Target: &config.HostnameTarget{Host: "monitor.example."},
+		Addrs:  []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+	}
+	for i := 0; i < 20; i++ {
+		clock.WaitArmed(t, 2)
+		// Races with the sender and reaper reading the settings, if
+		// they weren't replaced as a whole.
+		p.configure(config.Config{PingInterval: time.Duration(i+1) * time.Second, Jitter: i%2 == 0})
+		p.setTargets([]resolve.Resolution{r})
+		clock.Advance(time.Minute)
+	}
+}
+
+func Test_pinger_SilentTargetAtMinimumInterval(t *testing.T) {
+	clock := newFakeClock()
+	p, results := newTestPinger(clock)
+	// Far more packets are sent within the timeout than the wire holds.
+	p.configure(config.Config{PingInterval: config.SmallestPingInterval, PingTimeout: 10 * time.Second})
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+
+	var lost []uint64
+	const sends = 3 * maxPendingPackets
+	for i := 0; i < sends; i++ {
+		p.sent(addr, target)
+		clock.Advance(config.SmallestPingInterval)
+		for len(results) > 0 {
+			R := <-results
+			if !R.Recv.IsZero() || R.Dest != addr {
+				t.Fatalf("expected a lost packet, got: %+v", R)
+			}
+			lost = append(lost, R.Seq)
+		}
+	}
+
+	// Every packet is either still outstanding or reported lost, in order.
+	p.lock.Lock()
+	mon := p.monitors[addr]
+	outstanding := len(mon.wire)
+	missed := len(mon.missed)
+	p.lock.Unlock()
+	if len(lost)+outstanding != sends {
+		t.Errorf("expected %d packets, got %d lost and %d outstanding", sends, len(lost), outstanding)
+	}
+	for i, seq := range lost {
+		if seq != uint64(i+1) {
+			t.Fatalf("expected lost packet %d to have sequence %d, got %d", i, i+1, seq)
+		}
+	}
+	if missed == 0 {
+		t.Errorf("expected evicted packets to be remembered as missed")
+	}
+}
+
+func Test_pinger_PingTimeout(t *testing.T) {
+	clock := newFakeClock()
+	p, results := newTestPinger(clock)
+	p.configure(config.Config{PingInterval: 10 * time.Second})
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+	seq := p.sent(addr, target)
+
+	// Presumed lost after 3 intervals by default.
+	p.reap(p.current(), clock.Now().Add(2*time.Second))
+	expectNoResult(t, results)
+
+	p.configure(config.Config{PingInterval: 10 * time.Second, PingTimeout: time.Second})
+	p.reap(p.current(), clock.Now().Add(2*time.Second))
+	if R := nextResult(t, results); !R.Recv.IsZero() || R.Seq != seq {
+		t.Errorf("expected the packet to be lost after the ping timeout, got: %+v", R)
+	}
+}
+
+func Test_pinger_HandleReceive(t *testing.T) {
+	clock := newFakeClock()
+	p, results := newTestPinger(clock)
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+
+	first := p.sent(addr, target)
+	clock.Advance(time.Second)
+	second := p.sent(addr, target)
+	clock.Advance(time.Second)
+
+	// Answered out of order, but the first packet hasn't timed out yet.
+	if err := p.handleReceive(reply(addr, second, clock.Now())); err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if R := nextResult(t, results); R.Elapsed() != time.Second || R.OutOfOrder || R.Seq != second {
+		t.Errorf("expected reply to the second packet, got: %+v", R)
+	}
+	expectNoResult(t, results)
+
+	if err := p.handleReceive(reply(addr, first, clock.Now())); err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if R := nextResult(t, results); R.Elapsed() != 2*time.Second || R.OutOfOrder || R.Seq != first {
+		t.Errorf("expected reply to the first packet, got: %+v", R)
+	}
+	expectNoResult(t, results)
+}
+
+func Test_pinger_HandleReceive_LateReply(t *testing.T) {
+	clock := newFakeClock()
+	p, results := newTestPinger(clock)
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+
+	first := p.sent(addr, target)
+	clock.Advance(p.current().timeout + time.Second)
+	second := p.sent(addr, target)
+
+	// The first packet timed out by the time the second was answered.
+	if err := p.handleReceive(reply(addr, second, clock.Now())); err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if R := nextResult(t, results); R.Recv.IsZero() || R.Elapsed() != 0 {
+		t.Errorf("expected reply to the second packet, got: %+v", R)
+	}
+	if R := nextResult(t, results); !R.Recv.IsZero() || R.Seq != first {
+		t.Errorf("expected the first packet to be lost, got: %+v", R)
+	}
+
+	clock.Advance(time.Second)
+	if err := p.handleReceive(reply(addr, first, clock.Now())); err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if R := nextResult(t, results); !R.OutOfOrder || R.Elapsed() != p.current().timeout+2*time.Second || R.Seq != first {
+		t.Errorf("expected out of order reply to the first packet, got: %+v", R)
+	}
+	expectNoResult(t, results)
+}
+
+func Test_pinger_HandleReceive_Orphan(t *testing.T) {
+	p, results := newTestPinger(newFakeClock())
+	addr := netip.MustParseAddr("192.0.2.10")
+
+	if err := p.handleReceive(reply(addr, 1, time.Now())); err == nil {
+		t.Errorf("expected error for a reply without a monitor")
+	}
+	expectNoResult(t, results)
+}
+
+func Test_unwrapSequence(t *testing.T) {
+	tests := []struct {
+		last uint64
+		wire int
+		want uint64
+	}{
+		{last: 5, wire: 5, want: 5},
+		{last: 5, wire: 3, want: 3},
+		{last: 1 << 16, wire: 0, want: 1 << 16},
+		{last: 1<<16 + 2, wire: 65535, want: 65535},
+		// Replies from before the first packet.
+		{last: 2, wire: 65535, want: 0},
+	}
+	for _, test := range tests {
+		if got := unwrapSequence(test.last, test.wire); got != test.want {
+			t.Errorf("unwrapSequence(%d, %d) = %d, want %d", test.last, test.wire, got, test.want)
+		}
+	}
+}
+
+func Test_pinger_JitterSpreadsSends(t *testing.T) {
+	clock := newFakeClock()
+	p, _ := newTestPinger(clock)
+	p.configure(config.Config{PingInterval: time.Second, Jitter: true})
+	r := resolve.Resolution{Target: &config.HostnameTarget{Host: "monitor.example."}}
+
+	tick := p.current().tick()
+	if tick != time.Second/jitterSteps {
+		t.Fatalf("expected the tick to be divided by the steps, got %v", tick)
+	}
+
+	var addrs []netip.Addr
+	for i := 0; i < 100; i++ {
+		addrs = append(addrs, netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}))
+	}
+	sends := make(map[netip.Addr]int)
+	busiest := 0
+	// Offsets at the very end of the first interval are sent at the start
+	// of the second, only count sends once every address was sent to.
+	for step := 0; step < 2*jitterSteps; step++ {
+		sent := 0
+		for _, addr := range addrs {
+			if p.due(p.current(), addr, r, clock.Now(), tick, time.Second) && step >= jitterSteps {
+				sends[addr] += 1
+				sent += 1
+			}
+		}
+		if sent > busiest {
+			busiest = sent
+		}
+		clock.Advance(tick)
+	}
+
+	// Every address is sent to once per interval, but not all at once.
+	for _, addr := range addrs {
+		if sends[addr] != 1 {
+			t.Errorf("expected one send to %s per interval, got %d", addr, sends[addr])
+		}
+	}
+	if busiest == len(addrs) {
+		t.Errorf("expected sends to be spread over the interval")
+	}
+}
+
+func Test_payloadSize(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.1")
+	v6 := netip.MustParseAddr("2001:db8::1")
+	tests := []struct {
+		size int
+		dest netip.Addr
+		want int
+	}{
+		{size: 0, dest: v6, want: 0},
+		{size: config.MaxPayloadSize, dest: v4, want: config.MaxPayloadSize},
+		{size: config.MaxPayloadSize6, dest: v6, want: config.MaxPayloadSize6},
+		// Fits ipv4, but ipv6 needs to cut it down.
+		{size: config.MaxPayloadSize, dest: v6, want: config.MaxPayloadSize6},
+	}
+	for _, tt := range tests {
+		if got := payloadSize(tt.size, tt.dest); got != tt.want {
+			t.Errorf("payloadSize(%d, %s) = %d, want %d", tt.size, tt.dest, got, tt.want)
+		}
+	}
+}
+
+func Test_rampInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		ramp     time.Duration
+		elapsed  time.Duration
+		interval time.Duration
+	}{
+		{name: "no ramp up", ramp: 0, elapsed: 0, interval: time.Second},
+		{name: "start", ramp: 100 * time.Second, elapsed: 0, interval: 10 * time.Second},
+		{name: "before the start fraction", ramp: 100 * time.Second, elapsed: 5 * time.Second, interval: 10 * time.Second},
+		{name: "quarter", ramp: 100 * time.Second, elapsed: 25 * time.Second, interval: 4 * time.Second},
+		{name: "half", ramp: 100 * time.Second, elapsed: 50 * time.Second, interval: 2 * time.Second},
+		{name: "done", ramp: 100 * time.Second, elapsed: 100 * time.Second, interval: time.Second},
+		{name: "after", ramp: 100 * time.Second, elapsed: time.Hour, interval: time.Second},
+	}
+	for _, tt := range tests {
+		if got := rampInterval(time.Second, tt.ramp, tt.elapsed); got != tt.interval {
+			t.Errorf("%s: got interval %v, want %v", tt.name, got, tt.interval)
+		}
+	}
+}
+
+func Test_pinger_RampUpSpreadsSends(t *testing.T) {
+	clock := newFakeClock()
+	p, _ := newTestPinger(clock)
+	p.configure(config.Config{PingInterval: time.Second, RampUp: time.Minute})
+	s := p.current()
+	r := resolve.Resolution{Target: &config.HostnameTarget{Host: "monitor.example."}}
+
+	var addrs []netip.Addr
+	for i := 0; i < 100; i++ {
+		addrs = append(addrs, netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}))
+	}
+	// Like the sender, over the first ramped interval. Only the first send
+	// to every address counts, sends due soon after the interval are sent
+	// early.
+	started := clock.Now()
+	interval := rampInterval(time.Second, s.rampUp, 0)
+	sent := make(map[netip.Addr]bool)
+	busiest := 0
+	for clock.Now().Before(started.Add(interval)) {
+		tick := s.rampTick(clock.Now().Sub(started))
+		first := 0
+		for _, addr := range addrs {
+			if p.due(s, addr, r, clock.Now(), tick, interval) && !sent[addr] {
+				sent[addr] = true
+				first += 1
+			}
+		}
+		if first > busiest {
+			busiest = first
+		}
+		clock.Advance(tick)
+	}
+
+	for _, addr := range addrs {
+		if !sent[addr] {
+			t.Errorf("expected a send to %s in the first interval", addr)
+		}
+	}
+	if busiest > len(addrs)/2 {
+		t.Errorf("expected the first sends to be spread over the interval, %d were sent at once", busiest)
+	}
+}
+
+func Test_pinger_Splay(t *testing.T) {
+	p, _ := newTestPinger(newFakeClock())
+	addr := netip.MustParseAddr("192.0.2.10")
+
+	offset := p.splay(addr, time.Second)
+	if offset < 0 || offset >= time.Second {
+		t.Errorf("expected offset within the interval, got %v", offset)
+	}
+	if again := p.splay(addr, time.Second); again != offset {
+		t.Errorf("expected the offset of an address to stay the same, got %v and %v", offset, again)
+	}
+}
+
+func Test_pinger_SkipsForTargetInterval(t *testing.T) {
+	clock := newFakeClock()
+	p, _ := newTestPinger(clock)
+	p.configure(config.Config{PingInterval: time.Second})
+	target := &config.HostnameTarget{Host: "monitor.example.", Overrides: config.Overrides{PingInterval: 10 * time.Second}}
+	addr := netip.MustParseAddr("192.0.2.10")
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	mon := p.monitor(addr, target)
+	for i := 0; i < *sendErrorThresholdFlag; i++ {
+		p.sendFailed(p.current(), addr, mon, clock.Now())
+	}
+	if got := mon.skipUntil.Sub(clock.Now()); got != 10*time.Second {
+		t.Errorf("expected to skip the destination for an interval of the target, got %v", got)
+	}
+	p.sendFailed(p.current(), addr, mon, clock.Now())
+	if got := mon.skipUntil.Sub(clock.Now()); got != 20*time.Second {
+		t.Errorf("expected the skip to double from the interval of the target, got %v", got)
+	}
+}
+
+func Test_pinger_ReadmitsSkipped(t *testing.T) {
+	clock := newFakeClock()
+	p, _ := newTestPinger(clock)
+	p.configure(config.Config{PingInterval: time.Second})
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+
+	p.lock.Lock()
+	mon := p.monitor(addr, target)
+	for i := 0; i < *sendErrorThresholdFlag; i++ {
+		p.sendFailed(p.current(), addr, mon, clock.Now())
+	}
+	p.lock.Unlock()
+	if !clock.Now().Before(mon.skipUntil) {
+		t.Fatalf("expected the destination to be skipped after %d errors", mon.sendErrs)
+	}
+	if err := p.send(context.Background(), p.current(), addr, target); !errors.Is(err, errSkipped) {
+		t.Errorf("expected send to be skipped, got: %v", err)
+	}
+
+	p.readmit(addr)
+	if mon.sendErrs != 0 || !mon.skipUntil.IsZero() {
+		t.Errorf("expected the destination to be readmitted, got %d errors until %v", mon.sendErrs, mon.skipUntil)
+	}
+}
+
+func Test_pinger_HandleReceive_OtherProcess(t *testing.T) {
+	clock := newFakeClock()
+	p, results := newTestPinger(clock)
+	p.mode = icmp.Privileged
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+	seq := p.sent(addr, target)
+
+	// Privileged sockets also receive the replies to other processes.
+	other := reply(addr, seq, clock.Now())
+	other.Echo.ID = echoID + 1
+	if err := p.handleReceive(other); !errors.Is(err, errOtherID) {
+		t.Errorf("expected the reply of another process to be ignored, got: %v", err)
+	}
+	expectNoResult(t, results)
+
+	ours := reply(addr, seq, clock.Now())
+	ours.Echo.ID = echoID
+	if err := p.handleReceive(ours); err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if R := nextResult(t, results); R.Recv.IsZero() || R.Seq != seq {
+		t.Errorf("expected the reply to be ours, got: %+v", R)
+	}
+}
+
+func Test_pinger_HandleReceive_Unreachable(t *testing.T) {
+	clock := newFakeClock()
+	p, results := newTestPinger(clock)
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+	seq := p.sent(addr, target)
+
+	unreachable := reply(addr, seq, clock.Now())
+	unreachable.Unreachable = true
+	unreachable.Reporter = netip.MustParseAddr("198.51.100.1")
+	if err := p.handleReceive(unreachable); err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if R := nextResult(t, results); !R.Recv.IsZero() || R.Failure != FailureUnreachable || R.Seq != seq {
+		t.Errorf("expected the packet to be unreachable, got: %+v", R)
+	}
+
+	// The packet isn't outstanding anymore, and doesn't time out later.
+	if err := p.handleReceive(unreachable); err == nil {
+		t.Errorf("expected error for an error about a packet that is not outstanding")
+	}
+	p.reap(p.current(), clock.Now().Add(p.current().timeout+time.Second))
+	expectNoResult(t, results)
+}
+
+func Test_pinger_HandleReceive_FragmentationNeeded(t *testing.T) {
+	clock := newFakeClock()
+	p, results := newTestPinger(clock)
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+	seq := p.sent(addr, target)
+
+	tooBig := reply(addr, seq, clock.Now())
+	tooBig.Unreachable = true
+	tooBig.FragmentationNeeded = true
+	tooBig.MTU = 1400
+	tooBig.Reporter = netip.MustParseAddr("198.51.100.1")
+	if err := p.handleReceive(tooBig); err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if R := nextResult(t, results); R.Failure != FailureFragmentationNeeded || R.PathMTU != 1400 || R.Seq != seq {
+		t.Errorf("expected fragmentation needed with mtu 1400, got: %+v", R)
+	}
+}
+
+func Test_pinger_ReportDropsWhenFull(t *testing.T) {
+	results := make(chan *PingResult, 1)
+	p := newPinger(results, newPingMetrics(), slog.Default(), newFakeClock())
+	target := &config.HostnameTarget{Host: "monitor.example."}
+
+	// Doesn't block once the consumer is behind.
+	p.report(&PingResult{Target: target, Seq: 1})
+	p.report(&PingResult{Target: target, Seq: 2})
+
+	if R := nextResult(t, results); R.Seq != 1 {
+		t.Errorf("expected the first result, got: %+v", R)
+	}
+	expectNoResult(t, results)
+}
+
+func Test_pinger_HandleReceive_Timestamp(t *testing.T) {
+	clock := newFakeClock()
+	p, results := newTestPinger(clock)
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+	seq := p.sent(addr, target)
+	sent := icmp.TimestampMillis(clock.Now())
+
+	// The destination's clock is 10ms ahead, and the path is 20ms one way.
+	clock.Advance(40 * time.Millisecond)
+	echo := reply(addr, seq, clock.Now())
+	echo.Timestamp = &icmp.Timestamp{Seq: int(seq), Originate: sent, Receive: sent + 30, Transmit: sent + 30}
+	if err := p.handleReceive(echo); err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	R := nextResult(t, results)
+	want := OneWay{Outbound: 30 * time.Millisecond, Return: 10 * time.Millisecond}
+	if R.OneWay == nil || *R.OneWay != want || R.Elapsed() != 40*time.Millisecond {
+		t.Fatalf("expected one way latencies %+v, got: %+v", want, R)
+	}
+	if offset := R.OneWay.ClockOffset(); offset != 10*time.Millisecond {
+		t.Errorf("expected a clock offset of 10ms, got %s", offset)
+	}
+}
+
+func Test_timestampTime(t *testing.T) {
+	beforeMidnight := time.Date(2023, 4, 5, 23, 59, 59, 990e6, time.UTC)
+	if got, ok := timestampTime(5, beforeMidnight); !ok || got.Sub(beforeMidnight) != 15*time.Millisecond {
+		t.Errorf("expected a time after midnight, got %v", got)
+	}
+	afterMidnight := time.Date(2023, 4, 6, 0, 0, 0, 5e6, time.UTC)
+	if got, ok := timestampTime(86399990, afterMidnight); !ok || afterMidnight.Sub(got) != 15*time.Millisecond {
+		t.Errorf("expected a time before midnight, got %v", got)
+	}
+	if _, ok := timestampTime(1<<31|5, beforeMidnight); ok {
+		t.Errorf("expected non-standard time to fail")
+	}
+}
+
+func Test_pinger_TimestampFallsBackToEcho(t *testing.T) {
+	clock := newFakeClock()
+	p, results := newTestPinger(clock)
+	p.mode = icmp.Privileged
+	target := &config.StaticIP{IP: netip.MustParseAddr("192.0.2.10"), Overrides: config.Overrides{Timestamp: true}}
+	addr := target.IP
+
+	// Single goroutine, reap takes the lock itself.
+	mon := p.monitor(addr, target)
+	if p.useTimestamp(p.current(), netip.MustParseAddr("2001:db8::1"), mon) {
+		t.Errorf("expected echo requests for ipv6")
+	}
+	for i := 0; i < timestampFallbackLosses; i++ {
+		if !p.useTimestamp(p.current(), addr, mon) {
+			t.Fatalf("expected timestamp request after %d losses", i)
+		}
+		mon.sequence += 1
+		mon.wire = append(mon.wire, outstandingPacket{Seq: mon.sequence, Sent: clock.Now(), Timestamp: true})
+		clock.Advance(p.current().timeout + time.Second)
+		p.reap(p.current(), clock.Now())
+		nextResult(t, results)
+	}
+	if p.useTimestamp(p.current(), addr, mon) {
+		t.Errorf("expected echo requests after %d losses", timestampFallbackLosses)
+	}
+	// Stays on echo requests, which the address does reply to.
+	mon.timestampLost = 0
+	if p.useTimestamp(p.current(), addr, mon) {
+		t.Errorf("expected echo requests to stay")
+	}
+}
@@ -1,12 +1,27 @@
 package ping
 
 import (
+	"fmt"
 	"net/netip"
 	"time"
 
 	"github.com/VolatileDream/workbench/web/network-monitor/config"
 )
 
+// Failure describes why a probe has no latency, when it's known.
+type Failure string
+
+const (
+	// The reason is unknown, most likely the packet was lost.
+	FailureUnknown Failure = ""
+	// The probe was larger than the path MTU, and was sent with don't
+	// fragment set.
+	FailureFragmentationNeeded Failure = "fragmentation-needed"
+	// A router reported the destination as unreachable. Only known with
+	// privileged sockets.
+	FailureUnreachable Failure = "unreachable"
+)
+
 type PingResult struct {
 	Sent time.Time
 	// optional time, recv is 0 when the packet was never received,
@@ -15,8 +30,65 @@ type PingResult struct {
 	Src  netip.Addr // TODO: remove?
 	Dest netip.Addr
 
+	// Seq numbers the echo requests sent to Dest, starting at 1. Its low 16
+	// bits are the sequence number on the wire. Zero if unknown, like for
+	// tcp and http probes.
+	Seq uint64
+
 	// Target associated with this ping request.
 	Target config.LatencyTarget
+	// RemoteName is the reverse DNS name of Dest, for hops targets. Empty
+	// if unknown.
+	RemoteName string
+
+	// Failure is the reason the probe failed, only meaningful if Recv is zero.
+	Failure Failure
+
+	// PathMTU is the MTU a router reported for the path, when the probe
+	// failed with FailureFragmentationNeeded. Zero if unknown, including
+	// when sending failed locally because the MTU was already known.
+	PathMTU int
+
+	// Status is the response status code of HTTP probes, zero otherwise.
+	Status int
+
+	// PayloadSize is the configured size of the echo data, zero if the
+	// default payload was sent.
+	PayloadSize int
+
+	// TTL of the echo reply, zero if unknown or not received.
+	// A change in TTL indicates a change in the return path.
+	TTL int
+
+	// Warmup is set for the first few results after an address starts being
+	// monitored, their latency is not representative.
+	Warmup bool
+
+	// OutOfOrder is set when the reply arrived after the probe was already
+	// reported as lost, because a later probe was answered first or it timed
+	// out. This result corrects that report.
+	OutOfOrder bool
+
+	// OneWay splits the latency into each direction, for replies to ICMP
+	// Timestamp requests. Nil for echo replies, or if the destination's
+	// clock isn't in the standard format.
+	OneWay *OneWay
+}
+
+// OneWay are the latencies in each direction, measured against the clock of
+// the destination, which only has millisecond resolution. Both include the
+// offset of the destination's clock, with opposite signs.
+type OneWay struct {
+	// Outbound is from sending the request until the destination received it.
+	Outbound time.Duration
+	// Return is from the destination sending the reply until it was received.
+	Return time.Duration
+}
+
+// ClockOffset estimates how far the destination's clock is ahead of ours,
+// presuming that the path is symmetric.
+func (o *OneWay) ClockOffset() time.Duration {
+	return (o.Outbound - o.Return) / 2
 }
 
 // Elapsed returns a negative duration if PingResult.recv was zero.
@@ -26,3 +98,12 @@ func (pr *PingResult) Elapsed() time.Duration {
 	}
 	return pr.Recv.Sub(pr.Sent)
 }
+
+// StatusClass buckets the HTTP status code into its class, eg: "2xx", to
+// keep the number of distinct metric labels low.
+func (pr *PingResult) StatusClass() string {
+	if pr.Status < 100 || pr.Status > 599 {
+		return "none"
+	}
+	return fmt.Sprintf("%dxx", pr.Status/100)
+}
@@ -0,0 +1,180 @@
+package ping
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/resolve"
+)
+
+// Number of times every address of a target is pinged before the closest
+// address is selected.
+const selectionRounds = 3
+
+// selection tracks the latency of each address of a target, to find the
+// closest address for config.SelectClosest.
+type selection struct {
+	// The addresses being evaluated, the target resolved to them.
+	addrs []netip.Addr
+	// Pings sent to each address.
+	sent map[netip.Addr]int
+	// Lowest latency seen for each address.
+	best map[netip.Addr]time.Duration
+}
+
+// closest returns the address with the lowest latency, if the selection is
+// done evaluating all of the addresses.
+func (s *selection) closest() (netip.Addr, bool) {
+	for _, a := range s.addrs {
+		if s.sent[a] < selectionRounds {
+			return netip.Addr{}, false
+		}
+	}
+	var addr netip.Addr
+	var latency time.Duration
+	for a, l := range s.best {
+		if !addr.IsValid() || l < latency || (l == latency && a.Less(addr)) {
+			addr, latency = a, l
+		}
+	}
+	return addr, addr.IsValid()
+}
+
+// roundRobin rotates through the addresses of a target, for
+// config.SelectRoundRobin.
+type roundRobin struct {
+	// Index of the next address to ping, wraps around when the target
+	// resolves to fewer addresses.
+	next int
+	// When the next address should be pinged, the interval is shared by
+	// all the addresses of the target.
+	nextSend time.Time
+}
+
+// destinations returns the addresses of the resolution to send to this round.
+func (p *pinger) destinations(s *pingerSettings, r resolve.Resolution, now time.Time, tick, interval time.Duration) []netip.Addr {
+	switch s.cfg.Settings(r.Target).Selection {
+	case config.SelectClosest:
+		return p.closest(r)
+	case config.SelectRoundRobin:
+		return p.rotate(s, r, now, tick, interval)
+	}
+	return r.Addrs
+}
+
+// ownFamily returns the addresses of the family this pinger sends to.
+func (p *pinger) ownFamily(addrs []netip.Addr) []netip.Addr {
+	var own []netip.Addr
+	for _, a := range addrs {
+		if a.Is4() == p.source.Is4() {
+			own = append(own, a)
+		}
+	}
+	return own
+}
+
+// rotate returns the next address of the resolution once the interval of the
+// target has passed, like due does for the addresses of other targets. When
+// splayed, the first address is splayed instead of each address on its turn,
+// so that no turn is spent waiting for the offset of an address.
+func (p *pinger) rotate(s *pingerSettings, r resolve.Resolution, now time.Time, tick, interval time.Duration) []netip.Addr {
+	// Only rotate through the addresses this pinger can send to.
+	addrs := p.ownFamily(r.Addrs)
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	rr, ok := p.robins[r.Target]
+	if !ok {
+		rr = &roundRobin{}
+		if s.splayed() {
+			rr.nextSend = now.Add(p.splay(addrs[0], interval))
+		}
+		p.robins[r.Target] = rr
+	}
+	if now.Add(tick / 2).Before(rr.nextSend) {
+		return nil
+	}
+	rr.nextSend = now.Add(interval)
+	addr := addrs[rr.next%len(addrs)]
+	rr.next = (rr.next + 1) % len(addrs)
+	return []netip.Addr{addr}
+}
+
+// closest returns the closest address of the resolution once it's known,
+// otherwise all of them.
+func (p *pinger) closest(r resolve.Resolution) []netip.Addr {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s, ok := p.selections[r.Target]
+	if !ok {
+		// Only the addresses this pinger can send to are evaluated.
+		s = &selection{
+			addrs: p.ownFamily(r.Addrs),
+			sent:  make(map[netip.Addr]int),
+			best:  make(map[netip.Addr]time.Duration),
+		}
+		p.selections[r.Target] = s
+	}
+	if addr, ok := s.closest(); ok {
+		return []netip.Addr{addr}
+	}
+	// Until an address has replied, keep trying all of them.
+	return r.Addrs
+}
+
+// sentTo counts a ping sent to the address towards the selection of the
+// target, if it has one. Only pings that are actually sent count, addresses
+// that aren't due yet are still being evaluated.
+func (p *pinger) sentTo(t config.LatencyTarget, addr netip.Addr) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if s, ok := p.selections[t]; ok {
+		s.sent[addr] += 1
+	}
+}
+
+// reselect discards the selected addresses of the targets that were resolved
+// again, so that they are evaluated again, and forgets the targets that were
+// removed. Anycast addresses stay the same while the path to them changes, so
+// every fresh resolution is evaluated again, not only changed addresses.
+func (p *pinger) reselect(targets []resolve.Resolution) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	active := make(map[config.LatencyTarget]struct{}, len(targets))
+	for _, r := range targets {
+		active[r.Target] = struct{}{}
+		if r.Fresh {
+			delete(p.selections, r.Target)
+		}
+	}
+	for t := range p.selections {
+		if _, ok := active[t]; !ok {
+			delete(p.selections, t)
+		}
+	}
+	for t := range p.robins {
+		if _, ok := active[t]; !ok {
+			delete(p.robins, t)
+		}
+	}
+}
+
+// measured records the latency of a reply for the selection of the target, if
+// it has one. Must be called with the lock held.
+func (p *pinger) measured(t config.LatencyTarget, addr netip.Addr, latency time.Duration) {
+	s, ok := p.selections[t]
+	if !ok {
+		return
+	}
+	if best, ok := s.best[addr]; !ok || latency < best {
+		s.best[addr] = latency
+	}
+}
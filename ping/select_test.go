@@ -0,0 +1,223 @@
+package ping
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/resolve"
+)
+
+// selectClosest sends every round of the selection of the resolution, with
+// the latency of each address.
+func selectClosest(p *pinger, r resolve.Resolution, latency map[netip.Addr]time.Duration) {
+	for i := 0; i < selectionRounds; i++ {
+		for _, addr := range p.closest(r) {
+			p.sentTo(r.Target, addr)
+			if l, ok := latency[addr]; ok {
+				p.lock.Lock()
+				p.measured(r.Target, addr, l)
+				p.lock.Unlock()
+			}
+		}
+	}
+}
+
+func Test_pinger_closest(t *testing.T) {
+	p, _ := newTestPinger(newFakeClock())
+	near := netip.MustParseAddr("192.0.2.10")
+	far := netip.MustParseAddr("192.0.2.20")
+	r := resolve.Resolution{
+		Target: &config.HostnameTarget{Host: "monitor.example."},
+		// The ipv6 address is the other pinger's to evaluate.
+		Addrs: []netip.Addr{near, far, netip.MustParseAddr("2001:db8::1")},
+	}
+
+	// Rounds only count the pings that were sent.
+	for i := 0; i < 2*selectionRounds; i++ {
+		if got := p.closest(r); !reflect.DeepEqual(got, r.Addrs) {
+			t.Fatalf("expected every address until they were pinged, got: %v", got)
+		}
+	}
+
+	selectClosest(p, r, map[netip.Addr]time.Duration{near: time.Millisecond, far: time.Second})
+	if got := p.closest(r); !reflect.DeepEqual(got, []netip.Addr{near}) {
+		t.Errorf("expected the closest address, got: %v", got)
+	}
+}
+
+func Test_pinger_closest_NoReplies(t *testing.T) {
+	p, _ := newTestPinger(newFakeClock())
+	r := resolve.Resolution{
+		Target: &config.HostnameTarget{Host: "monitor.example."},
+		Addrs:  []netip.Addr{netip.MustParseAddr("192.0.2.10"), netip.MustParseAddr("192.0.2.20")},
+	}
+
+	selectClosest(p, r, nil)
+	if got := p.closest(r); !reflect.DeepEqual(got, r.Addrs) {
+		t.Errorf("expected every address until one replies, got: %v", got)
+	}
+}
+
+func Test_pinger_measured(t *testing.T) {
+	p, _ := newTestPinger(newFakeClock())
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	addr := netip.MustParseAddr("192.0.2.10")
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// Targets that aren't selecting their closest address are ignored.
+	p.measured(target, addr, time.Second)
+	if len(p.selections) != 0 {
+		t.Fatalf("expected no selection, got: %v", p.selections)
+	}
+
+	p.selections[target] = &selection{
+		sent: make(map[netip.Addr]int),
+		best: make(map[netip.Addr]time.Duration),
+	}
+	for _, l := range []time.Duration{2 * time.Second, time.Second, 3 * time.Second} {
+		p.measured(target, addr, l)
+	}
+	if got := p.selections[target].best[addr]; got != time.Second {
+		t.Errorf("expected the lowest latency to be kept, got: %v", got)
+	}
+}
+
+func Test_pinger_reselect(t *testing.T) {
+	p, _ := newTestPinger(newFakeClock())
+	near := netip.MustParseAddr("192.0.2.10")
+	far := netip.MustParseAddr("192.0.2.20")
+	other := netip.MustParseAddr("192.0.2.30")
+	target := &config.HostnameTarget{Host: "monitor.example."}
+	r := resolve.Resolution{Target: target, Addrs: []netip.Addr{near, far}, Fresh: true}
+	latency := map[netip.Addr]time.Duration{near: time.Millisecond, far: time.Second}
+	selectClosest(p, r, latency)
+
+	tests := []struct {
+		name     string
+		update   resolve.Resolution
+		reselect bool
+	}{
+		{
+			name:     "same addresses",
+			update:   r,
+			reselect: true,
+		},
+		{
+			name:     "same addresses of this family",
+			update:   resolve.Resolution{Target: target, Addrs: []netip.Addr{near, far, netip.MustParseAddr("2001:db8::1")}, Fresh: true},
+			reselect: true,
+		},
+		{
+			name:   "cached addresses",
+			update: resolve.Resolution{Target: target, Addrs: []netip.Addr{near, other}},
+		},
+		{
+			name:     "changed addresses",
+			update:   resolve.Resolution{Target: target, Addrs: []netip.Addr{near, other}, Fresh: true},
+			reselect: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p.reselect([]resolve.Resolution{tt.update})
+			if got := p.closest(r); tt.reselect != (len(got) != 1) {
+				t.Errorf("expected reselect %v, got: %v", tt.reselect, got)
+			}
+			selectClosest(p, r, latency)
+		})
+	}
+}
+
+func Test_pinger_reselect_SameAddresses(t *testing.T) {
+	p, _ := newTestPinger(newFakeClock())
+	near := netip.MustParseAddr("192.0.2.10")
+	far := netip.MustParseAddr("192.0.2.20")
+	r := resolve.Resolution{
+		Target: &config.HostnameTarget{Host: "anycast.example."},
+		Addrs:  []netip.Addr{near, far},
+		Fresh:  true,
+	}
+	selectClosest(p, r, map[netip.Addr]time.Duration{near: time.Millisecond, far: time.Second})
+
+	// The addresses stay the same, but the path to them changed.
+	p.reselect([]resolve.Resolution{r})
+	selectClosest(p, r, map[netip.Addr]time.Duration{near: time.Second, far: time.Millisecond})
+	if got := p.closest(r); !reflect.DeepEqual(got, []netip.Addr{far}) {
+		t.Errorf("expected the closest address to be evaluated again, got: %v", got)
+	}
+}
+
+func Test_pinger_reselect_Removed(t *testing.T) {
+	clock := newFakeClock()
+	p, _ := newTestPinger(clock)
+	closest := resolve.Resolution{
+		Target: &config.HostnameTarget{Host: "closest.example."},
+		Addrs:  []netip.Addr{netip.MustParseAddr("192.0.2.10")},
+	}
+	robin := resolve.Resolution{
+		Target: &config.HostnameTarget{Host: "robin.example."},
+		Addrs:  []netip.Addr{netip.MustParseAddr("192.0.2.20")},
+	}
+	p.closest(closest)
+	p.rotate(p.current(), robin, clock.Now(), time.Second, time.Second)
+
+	p.reselect([]resolve.Resolution{closest})
+	if _, ok := p.selections[closest.Target]; !ok {
+		t.Errorf("expected the selection of a remaining target to be kept")
+	}
+	if _, ok := p.robins[robin.Target]; ok {
+		t.Errorf("expected the removed round robin target to be forgotten")
+	}
+
+	p.reselect(nil)
+	if len(p.selections) != 0 || len(p.robins) != 0 {
+		t.Errorf("expected every target to be forgotten, got: %v, %v", p.selections, p.robins)
+	}
+}
+
+func Test_pinger_rotate(t *testing.T) {
+	for _, jitter := range []bool{false, true} {
+		clock := newFakeClock()
+		p, _ := newTestPinger(clock)
+		p.configure(config.Config{PingInterval: time.Second, Jitter: jitter})
+		s := p.current()
+		r := resolve.Resolution{
+			Target: &config.HostnameTarget{Host: "monitor.example.", Overrides: config.Overrides{Selection: config.SelectRoundRobin}},
+			Addrs: []netip.Addr{
+				netip.MustParseAddr("192.0.2.10"),
+				netip.MustParseAddr("192.0.2.20"),
+				netip.MustParseAddr("192.0.2.30"),
+			},
+		}
+
+		// Like the sender, addresses are sent to once they are due. With
+		// jitter the first send waits for the splay, the rounds are counted
+		// from it.
+		const rounds = 4
+		sends := make(map[netip.Addr]int)
+		tick := s.tick()
+		var end time.Time
+		for end.IsZero() || clock.Now().Before(end) {
+			for _, addr := range p.destinations(s, r, clock.Now(), tick, time.Second) {
+				if p.due(s, addr, r, clock.Now(), tick, time.Second) {
+					sends[addr] += 1
+					if end.IsZero() {
+						end = clock.Now().Add(rounds * time.Duration(len(r.Addrs)) * time.Second)
+					}
+				}
+			}
+			clock.Advance(tick)
+		}
+
+		// One address per interval, every address gets its turn.
+		for _, addr := range r.Addrs {
+			if sends[addr] != rounds {
+				t.Errorf("jitter %v: expected %d sends to %s, got %d", jitter, rounds, addr, sends[addr])
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package ping
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// Results buffered for every stream client, once they're behind by this many
+// results get dropped.
+const streamBuffer = 100
+
+// StreamHandler serves the results of every target live as server-sent
+// events, each one a json object. Clients that don't keep up miss results.
+type StreamHandler struct {
+	fanout *Fanout
+}
+
+func NewStreamHandler(fanout *Fanout) *StreamHandler {
+	return &StreamHandler{fanout: fanout}
+}
+
+type streamedResult struct {
+	Sent time.Time `json:"sent"`
+	// Null if the probe was lost.
+	Recv      *time.Time `json:"recv"`
+	ElapsedMs *float64   `json:"elapsed_ms"`
+	Dest      netip.Addr `json:"dest"`
+	Name      string     `json:"name"`
+	// Omitted if unknown, see PingResult.Seq.
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+func newStreamedResult(r *PingResult) streamedResult {
+	s := streamedResult{
+		Sent: r.Sent,
+		Dest: r.Dest,
+		Name: r.Target.MetricName(),
+		Seq:  r.Seq,
+	}
+	if !r.Recv.IsZero() {
+		recv := r.Recv
+		elapsed := float64(r.Elapsed()) / float64(time.Millisecond)
+		s.Recv = &recv
+		s.ElapsedMs = &elapsed
+	}
+	return s
+}
+
+func (h *StreamHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	results, cancel := h.fanout.Tap(streamBuffer)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		var r *PingResult
+		select {
+		case <-req.Context().Done():
+			return
+		case r, ok = <-results:
+			if !ok {
+				// The monitor is shutting down.
+				return
+			}
+		}
+
+		b, err := json.Marshal(newStreamedResult(r))
+		if err != nil {
+			// Can't happen, every field marshals.
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+			// The client went away.
+			return
+		}
+		flusher.Flush()
+	}
+}
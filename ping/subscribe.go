@@ -0,0 +1,72 @@
+package ping
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// Subscribers calls functions registered for a target with each of the
+// target's results. This allows embedding the monitor and reacting to the
+// results in process, eg: doing something when the gateway latency spikes.
+//
+// Subscribers are called from a single goroutine, so a slow subscriber
+// delays the other subscribers, but never the results pipeline. Results
+// are dropped when the subscribers fall behind.
+type Subscribers struct {
+	lock sync.RWMutex
+	subs map[string][]func(*PingResult)
+
+	pending chan *PingResult
+}
+
+func NewSubscribers(bufsz int) *Subscribers {
+	return &Subscribers{
+		subs:    make(map[string][]func(*PingResult)),
+		pending: make(chan *PingResult, bufsz),
+	}
+}
+
+// Subscribe registers fn to be called with every result of the target with the
+// given metric name.
+func (s *Subscribers) Subscribe(name string, fn func(*PingResult)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.subs[name] = append(s.subs[name], fn)
+}
+
+// Publish queues the result for the subscribers of its target, without
+// blocking.
+func (s *Subscribers) Publish(r *PingResult) {
+	s.lock.RLock()
+	_, ok := s.subs[r.Target.MetricName()]
+	s.lock.RUnlock()
+	if !ok {
+		return
+	}
+
+	select {
+	case s.pending <- r:
+	default:
+		slog.Warn("subscribers are behind, dropped result", "target", r.Target.MetricName())
+	}
+}
+
+// Run calls the subscribers with the published results, until the context is
+// cancelled.
+func (s *Subscribers) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-s.pending:
+			s.lock.RLock()
+			subs := s.subs[r.Target.MetricName()]
+			s.lock.RUnlock()
+
+			for _, fn := range subs {
+				fn(r)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package ping
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+)
+
+// tcpProber periodically connects to the configured TcpTargets, measuring the
+// time to complete the handshake. Like the httpProber, the dialer resolves the
+// host itself.
+type tcpProber struct {
+	result chan<- *PingResult
+
+	lock     sync.Mutex
+	interval time.Duration
+	targets  []*config.TcpTarget
+}
+
+func (p *tcpProber) update(c config.Config) {
+	targets := make([]*config.TcpTarget, 0)
+	for _, t := range c.Targets {
+		if tt, ok := t.(*config.TcpTarget); ok {
+			targets = append(targets, tt)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.interval = c.PingInterval
+	p.targets = targets
+}
+
+func (p *tcpProber) run(ctx context.Context) {
+	p.lock.Lock()
+	timer := time.NewTimer(p.interval)
+	p.lock.Unlock()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		p.lock.Lock()
+		timer.Reset(p.interval)
+		targets := p.targets
+		p.lock.Unlock()
+
+		for _, t := range targets {
+			go p.probe(ctx, t)
+		}
+	}
+}
+
+func (p *tcpProber) probe(ctx context.Context, t *config.TcpTarget) {
+	dialCtx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+
+	R := &PingResult{
+		Target: t,
+	}
+
+	// The dialer resolves the host before connecting, which would count
+	// towards the latency. Resolve separately so only the handshake is timed.
+	var dialer net.Dialer
+	addrs, err := net.DefaultResolver.LookupNetIP(dialCtx, "ip", t.Host)
+	if err != nil || len(addrs) == 0 {
+		slog.Debug("tcp probe failed to resolve", "target", t.MetricName(), "err", err)
+		return
+	}
+	addr := netip.AddrPortFrom(addrs[0].Unmap(), uint16(t.Port))
+	R.Dest = addr.Addr()
+
+	R.Sent = time.Now()
+	conn, err := dialer.DialContext(dialCtx, "tcp", addr.String())
+	if err != nil {
+		// Reported as lost, timing out is the usual failure.
+		slog.Debug("tcp probe failed", "target", t.MetricName(), "err", err)
+	} else {
+		R.Recv = time.Now()
+		conn.Close()
+	}
+
+	select {
+	case p.result <- R:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,39 @@
+package resolve
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/trace"
+)
+
+var (
+	asSourceFlag = flag.String("as-source",
+		"",
+		"Source of the autonomous system of traced hops: empty for none, 'cymru' for the Team Cymru DNS service, or 'mmdb=/path/to/GeoLite2-ASN.mmdb'.")
+)
+
+// FlagAnnotator returns the annotator that looks up autonomous systems with
+// the source selected by --as-source, nil if there is none.
+func FlagAnnotator() (*trace.Annotator, error) {
+	spec := *asSourceFlag
+	if spec == "" {
+		return nil, nil
+	}
+	if spec == "cymru" {
+		resolver, err := netResolver(*resolverFlag)
+		if err != nil {
+			return nil, err
+		}
+		return trace.NewAnnotator(trace.CymruSource{Resolver: resolver}), nil
+	}
+	if path := strings.TrimPrefix(spec, "mmdb="); path != spec {
+		source, err := trace.OpenMMDB(path)
+		if err != nil {
+			return nil, err
+		}
+		return trace.NewAnnotator(source), nil
+	}
+	return nil, fmt.Errorf("unknown as source: %q", spec)
+}
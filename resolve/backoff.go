@@ -0,0 +1,155 @@
+package resolve
+
+import (
+	"errors"
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+)
+
+var (
+	traceBackoffMaxFlag = flag.Duration("trace-backoff-max",
+		4*time.Hour,
+		"Longest time to wait before tracing a hops target that keeps failing again.")
+	resolveBackoffAfterFlag = flag.Int("resolve-backoff-after",
+		3,
+		"Consecutive failures to resolve a hostname before it's retried less often, zero to always retry.")
+	resolveBackoffMaxFlag = flag.Duration("resolve-backoff-max",
+		time.Hour,
+		"Longest time to wait before resolving a hostname that keeps failing again.")
+)
+
+var errBackoff = errors.New("not retrying failed target yet")
+
+// targetBackoff spaces out the resolution of targets that keep failing, eg:
+// because the process lacks the privilege to trace, or the hostname doesn't
+// exist. After the first few failures, every consecutive failure doubles the
+// number of resolve cycles that are skipped, up to a limit. Targets that
+// resolve fine are never skipped. Safe for concurrent use.
+type targetBackoff struct {
+	lock  sync.Mutex
+	state map[config.LatencyTarget]*backoffState
+}
+
+type backoffState struct {
+	failures int
+	// Resolve cycles left to skip before resolving again.
+	skip int
+}
+
+// backoffPolicy is how a kind of target backs off.
+type backoffPolicy struct {
+	// Consecutive failures allowed before skipping cycles.
+	after int
+	max   time.Duration
+	// Describes the resolution in logs.
+	kind string
+}
+
+// policyOf returns the backoff policy of the target, false if it doesn't back
+// off. Other targets don't resolve over the network, and can't fail to.
+func policyOf(t config.LatencyTarget) (backoffPolicy, bool) {
+	switch t.(type) {
+	case *config.TraceHops, *config.RouteTarget:
+		return backoffPolicy{
+			after: 1,
+			max:   *traceBackoffMaxFlag,
+			kind:  "trace",
+		}, true
+	case *config.HostnameTarget, *config.SRVTarget:
+		if *resolveBackoffAfterFlag <= 0 {
+			return backoffPolicy{}, false
+		}
+		return backoffPolicy{
+			after: *resolveBackoffAfterFlag,
+			max:   *resolveBackoffMaxFlag,
+			kind:  "resolution",
+		}, true
+	}
+	return backoffPolicy{}, false
+}
+
+func newTargetBackoff() *targetBackoff {
+	return &targetBackoff{
+		state: make(map[config.LatencyTarget]*backoffState),
+	}
+}
+
+// wait reports whether the target should not be resolved this cycle. Must be
+// called once per target per resolve cycle.
+func (b *targetBackoff) wait(t config.LatencyTarget) bool {
+	if _, ok := policyOf(t); !ok {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.state[t]
+	if !ok || s.skip == 0 {
+		return false
+	}
+	s.skip -= 1
+	return true
+}
+
+// done records the result of resolving the target, interval is the time
+// between resolve cycles.
+func (b *targetBackoff) done(t config.LatencyTarget, err error, interval time.Duration) {
+	policy, ok := policyOf(t)
+	if !ok {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	s, ok := b.state[t]
+	if err == nil {
+		if ok {
+			slog.Info(policy.kind+" succeeded after failures", "target", t.MetricName(), "failures", s.failures)
+			delete(b.state, t)
+		}
+		return
+	}
+
+	if !ok {
+		s = &backoffState{}
+		b.state[t] = s
+	}
+	s.failures += 1
+
+	maxSkip := 0
+	if interval > 0 {
+		maxSkip = int(policy.max / interval)
+	}
+	skip := 0
+	for i := policy.after; i < s.failures && skip < maxSkip; i++ {
+		skip = skip*2 + 1
+	}
+	if skip > maxSkip {
+		skip = maxSkip
+	}
+	if skip > 0 {
+		// Only logged when resolving is attempted, not every skipped cycle.
+		slog.Warn(policy.kind+" keeps failing, skipping resolves", "target", t.MetricName(), "failures", s.failures, "skip", skip)
+	}
+	s.skip = skip
+}
+
+// forget drops the state of targets that are no longer configured.
+func (b *targetBackoff) forget(targets []config.LatencyTarget) {
+	keep := make(map[config.LatencyTarget]struct{}, len(targets))
+	for _, t := range targets {
+		keep[t] = struct{}{}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for t := range b.state {
+		if _, ok := keep[t]; !ok {
+			delete(b.state, t)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/trace"
+)
+
+const (
+	dohContentType = "application/dns-message"
+	// Largest dns message, the size is a 16 bit field.
+	maxDNSMessage = 65535
+)
+
+var (
+	resolverFlag = flag.String("resolver",
+		"system",
+		"Resolver to look up names with: 'system', 'go' for the Go resolver which honors DNS TTLs, or 'doh=https://...' for DNS over HTTPS to the endpoint.")
+)
+
+// FlagResolver creates a resolver like NewResolver, that looks up names with
+// the resolver selected by --resolver. The hops of recorded routes are
+// annotated with their autonomous system, if the annotator isn't nil.
+func FlagResolver(routes *Routes, annotator *trace.Annotator) (Resolver, error) {
+	resolver, err := netResolver(*resolverFlag)
+	if err != nil {
+		return nil, err
+	}
+	r := NewResolver(resolver, routes).(*netresolver)
+	r.annotator = annotator
+	return r, nil
+}
+
+// netResolver returns the resolver described by the value of --resolver. All
+// but the system resolver record the ttl of the answers, see withTTL.
+func netResolver(spec string) (*net.Resolver, error) {
+	if spec == "system" {
+		return net.DefaultResolver, nil
+	}
+	if spec == "go" {
+		// The go resolver is the only one that dials, and so the only one
+		// with answers to record.
+		var d net.Dialer
+		return &net.Resolver{
+			PreferGo: true,
+			Dial:     recordingDial(d.DialContext),
+		}, nil
+	}
+	if endpoint := strings.TrimPrefix(spec, "doh="); endpoint != spec {
+		resolver, err := NewDoHResolver(endpoint, http.DefaultClient)
+		if err != nil {
+			return nil, err
+		}
+		resolver.Dial = recordingDial(resolver.Dial)
+		return resolver, nil
+	}
+	return nil, fmt.Errorf("unknown resolver: %q", spec)
+}
+
+// NewDoHResolver creates a resolver that sends its queries to the endpoint as
+// DNS over HTTPS (RFC 8484) requests, instead of to the system name servers.
+func NewDoHResolver(endpoint string, client *http.Client) (*net.Resolver, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad doh endpoint: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("doh endpoint must be a http(s) url: %s", endpoint)
+	}
+
+	return &net.Resolver{
+		// The go resolver sends dns messages over the connections it dials,
+		// those are forwarded as http requests.
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{
+				ctx:      ctx,
+				client:   client,
+				endpoint: u.String(),
+			}, nil
+		},
+	}, nil
+}
+
+// dohConn is a connection to a name server, that sends every message written
+// to it as a DNS over HTTPS request, and reads back the responses. It's not a
+// net.PacketConn, so messages are prefixed with their length like over tcp.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	endpoint string
+
+	lock     sync.Mutex
+	deadline time.Time
+	written  bytes.Buffer
+	response bytes.Buffer
+	closed   bool
+}
+
+var _ net.Conn = &dohConn{}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	c.written.Write(b)
+	for {
+		msg := c.written.Bytes()
+		if len(msg) < 2 || len(msg) < 2+int(binary.BigEndian.Uint16(msg)) {
+			// Wait for the rest of the message.
+			return len(b), nil
+		}
+		msg = msg[2 : 2+binary.BigEndian.Uint16(msg)]
+		if err := c.query(msg); err != nil {
+			return 0, err
+		}
+		c.written.Next(2 + len(msg))
+	}
+}
+
+// query sends the message to the endpoint, and buffers the response to be
+// read. Must be called with the lock held.
+func (c *dohConn) query(msg []byte) error {
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel func()
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("doh endpoint returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxDNSMessage {
+		return errors.New("doh response is too large")
+	}
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(body)))
+	c.response.Write(length[:])
+	c.response.Write(body)
+	return nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	if c.response.Len() == 0 {
+		// Responses are requested synchronously while writing.
+		return 0, io.EOF
+	}
+	return c.response.Read(b)
+}
+
+func (c *dohConn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *dohConn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *dohConn) SetReadDeadline(t time.Time) error {
+	// Reads don't block, only the requests made while writing do.
+	return nil
+}
+
+func (c *dohConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *dohConn) LocalAddr() net.Addr {
+	return dohAddr("local")
+}
+
+func (c *dohConn) RemoteAddr() net.Addr {
+	return dohAddr(c.endpoint)
+}
+
+// dohAddr is the address of either end of a dohConn.
+type dohAddr string
+
+func (a dohAddr) Network() string {
+	return "doh"
+}
+
+func (a dohAddr) String() string {
+	return string(a)
+}
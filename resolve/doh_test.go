@@ -0,0 +1,134 @@
+package resolve
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohHandler answers A queries with the address, and AAAA queries with nothing.
+func dohHandler(t *testing.T, addr netip.Addr) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != dohContentType {
+			t.Errorf("unexpected request: %s %v", r.Method, r.Header)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var query dnsmessage.Message
+		if err := query.Unpack(body); err != nil {
+			t.Errorf("bad query: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		reply := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+			Questions: query.Questions,
+		}
+		if q := query.Questions[0]; q.Type == dnsmessage.TypeA {
+			reply.Answers = append(reply.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.AResource{A: addr.As4()},
+			})
+		}
+		packed, err := reply.Pack()
+		if err != nil {
+			t.Errorf("could not pack reply: %v", err)
+		}
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(packed)
+	}
+}
+
+func Test_DoHResolver(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+	server := httptest.NewServer(dohHandler(t, addr))
+	defer server.Close()
+
+	resolver, err := NewDoHResolver(server.URL, server.Client())
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	got, err := NewResolver(resolver, nil).Resolve(ctx, &config.HostnameTarget{Host: "monitor.example."})
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if want := []netip.Addr{addr}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func Test_DoHResolver_RecordsTTL(t *testing.T) {
+	server := httptest.NewServer(dohHandler(t, netip.MustParseAddr("192.0.2.1")))
+	defer server.Close()
+
+	resolver, err := NewDoHResolver(server.URL, server.Client())
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	resolver.Dial = recordingDial(resolver.Dial)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx, rec := withTTL(ctx)
+	if _, err := resolver.LookupNetIP(ctx, "ip", "monitor.example."); err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if ttl, ok := rec.TTL(); !ok || ttl != time.Minute {
+		t.Errorf("got ttl %v (%t), want %v", ttl, ok, time.Minute)
+	}
+}
+
+func Test_DoHResolver_HonorsContext(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+	defer close(block)
+
+	resolver, err := NewDoHResolver(server.URL, server.Client())
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := resolver.LookupNetIP(ctx, "ip", "monitor.example."); err == nil {
+		t.Errorf("expected lookup to fail once the context is done")
+	}
+}
+
+func Test_NetResolver(t *testing.T) {
+	for _, spec := range []string{"system", "go", "doh=https://dns.example/dns-query"} {
+		if _, err := netResolver(spec); err != nil {
+			t.Errorf("did not expect error for %q: %v", spec, err)
+		}
+	}
+	// Only the go resolver is asked for, the system one stays the default.
+	if r, _ := netResolver("system"); r != net.DefaultResolver {
+		t.Errorf("expected the system resolver to be the default resolver")
+	}
+	if r, _ := netResolver("go"); !r.PreferGo || r.Dial == nil {
+		t.Errorf("expected the go resolver to dial with the go resolver")
+	}
+	for _, spec := range []string{"", "dns.example", "doh=ftp://dns.example"} {
+		if _, err := netResolver(spec); err == nil {
+			t.Errorf("expected error for %q", spec)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package resolve
+
+import (
+	"net/netip"
+	"sync"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+)
+
+// expander splits the resolutions of targets configured with Expand, of
+// CIDRTargets and of RouteTargets, into one resolution per address.
+//
+// The AddressTargets are kept between resolutions, because consumers key their
+// state on the target, and a new pointer would look like a new target.
+type expander struct {
+	// Partial results are expanded concurrently with each other.
+	lock    sync.Mutex
+	targets map[config.LatencyTarget][]*config.AddressTarget
+	// Hops of the last fresh resolution of every RouteTarget.
+	hops map[config.LatencyTarget]map[netip.Addr]int
+}
+
+func newExpander() *expander {
+	return &expander{
+		targets: make(map[config.LatencyTarget][]*config.AddressTarget),
+		hops:    make(map[config.LatencyTarget]map[netip.Addr]int),
+	}
+}
+
+func expands(t config.LatencyTarget) bool {
+	switch t := t.(type) {
+	case *config.HostnameTarget:
+		return t.Expand
+	case *config.CIDRTarget, *config.RouteTarget:
+		return true
+	}
+	return false
+}
+
+// expand returns the resolution split by address, or the resolution itself if
+// the target isn't expanded. Addresses must be sorted, so that the index of an
+// address is stable between resolutions.
+func (e *expander) expand(res Resolution) []Resolution {
+	if !expands(res.Target) {
+		return []Resolution{res}
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if _, ok := res.Target.(*config.RouteTarget); ok {
+		return e.expandRoute(res)
+	}
+
+	targets := e.targets[res.Target]
+	for i := len(targets); i < len(res.Addrs); i++ {
+		target := &config.AddressTarget{
+			Parent: res.Target,
+			Index:  i,
+		}
+		if _, ok := res.Target.(*config.CIDRTarget); ok {
+			// The addresses of a prefix are the same every resolution.
+			target.Addr = res.Addrs[i]
+		}
+		targets = append(targets, target)
+	}
+	e.targets[res.Target] = targets
+
+	expanded := make([]Resolution, 0, len(res.Addrs))
+	for i, addr := range res.Addrs {
+		expanded = append(expanded, Resolution{
+			Target:   targets[i],
+			Addrs:    []netip.Addr{addr},
+			Hostname: res.Hostname,
+			Fresh:    res.Fresh,
+		})
+	}
+	return expanded
+}
+
+// expandRoute splits the resolution of a route by the hop of every address,
+// instead of the index, so that every hop keeps its target while the routers
+// before it come and go.
+func (e *expander) expandRoute(res Resolution) []Resolution {
+	hops := res.Hops
+	if hops != nil {
+		e.hops[res.Target] = hops
+	} else {
+		hops = e.hops[res.Target]
+	}
+
+	targets := e.targets[res.Target]
+	expanded := make([]Resolution, 0, len(res.Addrs))
+	for _, addr := range res.Addrs {
+		hop, ok := hops[addr]
+		if !ok {
+			continue
+		}
+		for len(targets) <= hop {
+			targets = append(targets, nil)
+		}
+		if targets[hop] == nil {
+			targets[hop] = &config.AddressTarget{
+				Parent: res.Target,
+				Index:  hop,
+			}
+		}
+		expanded = append(expanded, Resolution{
+			Target:   targets[hop],
+			Addrs:    []netip.Addr{addr},
+			Hostname: res.Hostname,
+			Fresh:    res.Fresh,
+		})
+	}
+	e.targets[res.Target] = targets
+	return expanded
+}
+
+// forget drops the address targets of targets no longer in the config.
+func (e *expander) forget(current []config.LatencyTarget) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	keep := make(map[config.LatencyTarget]struct{}, len(current))
+	for _, t := range current {
+		keep[t] = struct{}{}
+	}
+	for t := range e.targets {
+		if _, ok := keep[t]; !ok {
+			delete(e.targets, t)
+			delete(e.hops, t)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package resolve
+
+import (
+	"context"
+	"net/netip"
+)
+
+// hopRecorder collects the hop of the route every address of a RouteTarget
+// was traced at. Unlike ttlRecorder, only the goroutine of the trace records
+// into it.
+type hopRecorder struct {
+	hops map[netip.Addr]int
+}
+
+type hopsKey struct{}
+
+// withHops returns a context that records the hops of the addresses routes
+// resolved with it resolve to.
+func withHops(ctx context.Context) (context.Context, *hopRecorder) {
+	rec := &hopRecorder{}
+	return context.WithValue(ctx, hopsKey{}, rec), rec
+}
+
+// hopsOf returns the recorder of the context, nil if it doesn't have one.
+func hopsOf(ctx context.Context) *hopRecorder {
+	rec, _ := ctx.Value(hopsKey{}).(*hopRecorder)
+	return rec
+}
+
+func (r *hopRecorder) record(addr netip.Addr, hop int) {
+	if r.hops == nil {
+		r.hops = make(map[netip.Addr]int)
+	}
+	r.hops[addr] = hop
+}
+
+// Hops returns the hop of every address recorded, nil if none were.
+func (r *hopRecorder) Hops() map[netip.Addr]int {
+	return r.hops
+}
@@ -11,6 +11,50 @@ var (
 	ipv6Flag      = flag.Bool("allow-ip6", true, "Resolver returns ipv6 addresses, disable to filter them out.")
 )
 
+// AllowedAddr reports if the address family is enabled. Ipv4 in 6 addresses
+// are only allowed by their own flag, not as either family.
 func AllowedAddr(a netip.Addr) bool {
-	return (a.Is6() && *ipv6Flag) || (a.Is4() && *ipv4Flag) || (a.Is4In6() && *mixed4In6Flag)
+	if a.Is4In6() {
+		return *mixed4In6Flag
+	}
+	return (a.Is6() && *ipv6Flag) || (a.Is4() && *ipv4Flag)
+}
+
+// Unmapped returns the address as it is pinged. Ipv4 in 6 addresses are
+// unmapped, unless they are allowed by their own flag.
+func Unmapped(a netip.Addr) netip.Addr {
+	if *mixed4In6Flag {
+		return a
+	}
+	return a.Unmap()
+}
+
+// AllowedFamily reports if any addresses of the family are enabled. Ipv4 in 6
+// addresses count as ipv6, they are sent over ipv6.
+func AllowedFamily(is4 bool) bool {
+	if is4 {
+		return *ipv4Flag
+	}
+	return *ipv6Flag || *mixed4In6Flag
+}
+
+// hostAddrs returns the host addresses of the prefix in order. For ipv4 those
+// exclude the network and broadcast addresses, except in /31 and /32 prefixes
+// which don't have them. For ipv6 they exclude the subnet router anycast
+// address, the first one.
+func hostAddrs(prefix netip.Prefix) []netip.Addr {
+	prefix = prefix.Masked()
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+
+	var addrs []netip.Addr
+	for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+		addrs = append(addrs, addr)
+	}
+	if hostBits < 2 {
+		return addrs
+	}
+	if prefix.Addr().Is4() {
+		return addrs[1 : len(addrs)-1]
+	}
+	return addrs[1:]
 }
@@ -0,0 +1,118 @@
+package resolve
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func Test_filter(t *testing.T) {
+	v4 := netip.MustParseAddr("1.1.1.1")
+	v6 := netip.MustParseAddr("2001:db8::1")
+	mapped := netip.MustParseAddr("::ffff:1.1.1.1")
+
+	tests := []struct {
+		name   string
+		ip4    bool
+		ip6    bool
+		mixed  bool
+		addrs  []netip.Addr
+		result []netip.Addr
+	}{
+		{
+			name:   "all allowed",
+			ip4:    true,
+			ip6:    true,
+			addrs:  []netip.Addr{v4, v6},
+			result: []netip.Addr{v4, v6},
+		},
+		{
+			name:   "ipv6 disabled",
+			ip4:    true,
+			addrs:  []netip.Addr{v4, v6},
+			result: []netip.Addr{v4},
+		},
+		{
+			name:   "everything filtered is empty",
+			ip4:    true,
+			addrs:  []netip.Addr{v6},
+			result: []netip.Addr{},
+		},
+		{
+			name:   "mapped addresses are unmapped",
+			ip4:    true,
+			addrs:  []netip.Addr{mapped},
+			result: []netip.Addr{v4},
+		},
+		{
+			name:   "mapped addresses need their own flag",
+			ip6:    true,
+			mixed:  true,
+			addrs:  []netip.Addr{mapped, v6},
+			result: []netip.Addr{mapped, v6},
+		},
+		{
+			name:   "mapped addresses aren't ipv6",
+			ip6:    true,
+			addrs:  []netip.Addr{mapped},
+			result: []netip.Addr{},
+		},
+	}
+
+	defer func(ip4, ip6, mixed bool) {
+		*ipv4Flag, *ipv6Flag, *mixed4In6Flag = ip4, ip6, mixed
+	}(*ipv4Flag, *ipv6Flag, *mixed4In6Flag)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			*ipv4Flag, *ipv6Flag, *mixed4In6Flag = test.ip4, test.ip6, test.mixed
+			if got := filter(test.addrs); !reflect.DeepEqual(got, test.result) {
+				t.Errorf("got: %v, want: %v", got, test.result)
+			}
+		})
+	}
+}
+
+func Test_AllowedFamily(t *testing.T) {
+	defer func(ip4, ip6, mixed bool) {
+		*ipv4Flag, *ipv6Flag, *mixed4In6Flag = ip4, ip6, mixed
+	}(*ipv4Flag, *ipv6Flag, *mixed4In6Flag)
+
+	*ipv4Flag, *ipv6Flag, *mixed4In6Flag = true, false, false
+	if !AllowedFamily(true) || AllowedFamily(false) {
+		t.Errorf("expected only ipv4 to be allowed")
+	}
+	// Mapped addresses are sent over ipv6.
+	*mixed4In6Flag = true
+	if !AllowedFamily(false) {
+		t.Errorf("expected ipv6 to be allowed for mapped addresses")
+	}
+}
+
+func Test_hostAddrs(t *testing.T) {
+	addrs := func(s ...string) []netip.Addr {
+		var result []netip.Addr
+		for _, a := range s {
+			result = append(result, netip.MustParseAddr(a))
+		}
+		return result
+	}
+	tests := []struct {
+		prefix string
+		addrs  []netip.Addr
+	}{
+		{"192.0.2.0/30", addrs("192.0.2.1", "192.0.2.2")},
+		{"192.0.2.0/31", addrs("192.0.2.0", "192.0.2.1")},
+		{"192.0.2.7/32", addrs("192.0.2.7")},
+		{"255.255.255.252/30", addrs("255.255.255.253", "255.255.255.254")},
+		{"2001:db8::/126", addrs("2001:db8::1", "2001:db8::2", "2001:db8::3")},
+	}
+	for _, tc := range tests {
+		if got := hostAddrs(netip.MustParsePrefix(tc.prefix)); !reflect.DeepEqual(got, tc.addrs) {
+			t.Errorf("%s: got %v, want %v", tc.prefix, got, tc.addrs)
+		}
+	}
+	if got := hostAddrs(netip.MustParsePrefix("10.0.0.0/24")); len(got) != 254 {
+		t.Errorf("expected 254 hosts in a /24, got %d", len(got))
+	}
+}
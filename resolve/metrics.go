@@ -0,0 +1,154 @@
+package resolve
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/stats"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+)
+
+var (
+	metricsByTargetFlag = flag.Bool("resolve-metrics-by-target",
+		false,
+		"Label resolver metrics with the target name, increases metric cardinality.")
+	successWindowFlag = flag.Duration("resolve-success-window",
+		time.Hour,
+		"Window of time over which the hostname resolution success ratio is computed.")
+)
+
+const (
+	nameKey   = attribute.Key("name")
+	resultKey = attribute.Key("result")
+
+	// The resolution succeeded.
+	resultFresh = "fresh"
+	// The resolution failed, and previously resolved addresses were used.
+	resultCached = "cached"
+	// The resolution failed, and there was nothing to fall back to.
+	resultDropped = "dropped"
+)
+
+type serviceMetrics struct {
+	resolves syncint64.Counter
+	// Always labeled by target, to alert on the resolution of each target.
+	successes syncint64.Counter
+	failures  syncint64.Counter
+
+	lock        sync.Mutex
+	lastSuccess map[string]time.Time
+
+	// Only tracks hostname and srv targets, other targets don't use DNS and
+	// can't fail to resolve for DNS reasons.
+	success *stats.Ratio
+}
+
+func newServiceMetrics() *serviceMetrics {
+	m := &serviceMetrics{
+		success:     stats.NewRatio(*successWindowFlag),
+		lastSuccess: make(map[string]time.Time),
+	}
+
+	meter := global.Meter("netmon")
+	resolves, err := meter.SyncInt64().Counter(
+		"network/resolve",
+		instrument.WithDescription("Count of target resolutions, by if the result was fresh, cached, or dropped."))
+	if err != nil {
+		slog.Error("failed to create resolve metrics", "err", err)
+		resolves, _ = metric.NewNoopMeter().SyncInt64().Counter("network/resolve")
+	}
+	m.resolves = resolves
+
+	successes, err := meter.SyncInt64().Counter(
+		"network/resolve/successes",
+		instrument.WithDescription("Count of resolutions that succeeded, by target."))
+	if err != nil {
+		slog.Error("failed to create resolve metrics", "err", err)
+		successes, _ = metric.NewNoopMeter().SyncInt64().Counter("network/resolve/successes")
+	}
+	m.successes = successes
+	failures, err := meter.SyncInt64().Counter(
+		"network/resolve/failures",
+		instrument.WithDescription("Count of resolutions that failed, by target."))
+	if err != nil {
+		slog.Error("failed to create resolve metrics", "err", err)
+		failures, _ = metric.NewNoopMeter().SyncInt64().Counter("network/resolve/failures")
+	}
+	m.failures = failures
+
+	last, err := meter.AsyncInt64().Gauge(
+		"network/resolve/last_success_seconds",
+		instrument.WithDescription("Unix time of the last successful resolution of the target, zero if it never succeeded."))
+	if err == nil {
+		err = meter.RegisterCallback([]instrument.Asynchronous{last}, func(ctx context.Context) {
+			m.lock.Lock()
+			defer m.lock.Unlock()
+			for name, when := range m.lastSuccess {
+				seconds := int64(0)
+				if !when.IsZero() {
+					seconds = when.Unix()
+				}
+				last.Observe(ctx, seconds, nameKey.String(name))
+			}
+		})
+	}
+	if err != nil {
+		slog.Error("failed to create resolve last success metric", "err", err)
+	}
+
+	ratio, err := meter.AsyncFloat64().Gauge(
+		"network/resolve_success_ratio",
+		instrument.WithDescription("Fraction of hostname resolutions that succeeded, over a window of time."))
+	if err == nil {
+		err = meter.RegisterCallback([]instrument.Asynchronous{ratio}, func(ctx context.Context) {
+			for name, r := range m.success.Snapshot(time.Now()) {
+				ratio.Observe(ctx, r, nameKey.String(name))
+			}
+		})
+	}
+	if err != nil {
+		slog.Error("failed to create resolve success metric", "err", err)
+	}
+	return m
+}
+
+func (m *serviceMetrics) resolved(ctx context.Context, t config.LatencyTarget, result string) {
+	attrs := []attribute.KeyValue{resultKey.String(result)}
+	if *metricsByTargetFlag {
+		attrs = append(attrs, nameKey.String(t.MetricName()))
+	}
+	m.resolves.Add(ctx, 1, attrs...)
+
+	if result == resultFresh {
+		m.successes.Add(ctx, 1, nameKey.String(t.MetricName()))
+	} else {
+		m.failures.Add(ctx, 1, nameKey.String(t.MetricName()))
+	}
+
+	switch t.(type) {
+	case *config.HostnameTarget, *config.SRVTarget:
+		m.success.Record(t.MetricName(), time.Now(), result == resultFresh)
+	}
+}
+
+// succeeded replaces the time of the last successful resolution of every
+// target, targets not in the map are no longer reported.
+func (m *serviceMetrics) succeeded(lastSuccess map[config.LatencyTarget]time.Time) {
+	names := make(map[string]time.Time, len(lastSuccess))
+	for t, when := range lastSuccess {
+		names[t.MetricName()] = when
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lastSuccess = names
+}
@@ -2,15 +2,23 @@ package resolve
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/ip"
 	"github.com/VolatileDream/workbench/web/network-monitor/trace"
 )
 
+// Number of hops traced at the same time, so that resolving hops far away
+// doesn't take minutes when some hops don't respond.
+const traceParallelism = 4
+
 type Resolver interface {
 	Resolve(context.Context, config.LatencyTarget) ([]netip.Addr, error)
 }
@@ -18,17 +26,33 @@ type Resolver interface {
 type netresolver struct {
 	// Resolver to use
 	resolver *net.Resolver
+
+	// Optional, records the route of hops targets.
+	routes *Routes
+	// Optional, annotates the hops of recorded routes.
+	annotator *trace.Annotator
+
+	reverse *reverseCache
 }
 
 var _ Resolver = &netresolver{}
+var _ ReverseResolver = &netresolver{}
 
+// DefaultResolver looks up names with the system resolver, see FlagResolver
+// for the one selected by --resolver.
 func DefaultResolver() Resolver {
-	return NewResolver(net.DefaultResolver)
+	return NewResolver(net.DefaultResolver, nil)
 }
 
-func NewResolver(resolver *net.Resolver) Resolver {
+// NewResolver creates a resolver that looks up names with the resolver, and
+// records the traced route of hops targets into routes, if it's not nil.
+func NewResolver(resolver *net.Resolver, routes *Routes) Resolver {
 	return &netresolver{
 		resolver: resolver,
+		routes:   routes,
+		reverse: &reverseCache{
+			entries: make(map[netip.Addr]reverseEntry),
+		},
 	}
 }
 
@@ -36,47 +60,249 @@ func (r *netresolver) Resolve(ctx context.Context, t config.LatencyTarget) ([]ne
 	switch t.(type) {
 	case *config.TraceHops:
 		return r.resolveHops(ctx, t.(*config.TraceHops))
+	case *config.RouteTarget:
+		return r.resolveRoute(ctx, t.(*config.RouteTarget))
 	case *config.HostnameTarget:
 		return r.resolveHost(ctx, t.(*config.HostnameTarget))
+	case *config.SRVTarget:
+		return r.resolveSRV(ctx, t.(*config.SRVTarget))
 	case *config.StaticIP:
 		s := t.(*config.StaticIP)
 		return filter([]netip.Addr{s.IP}), nil
+	case *config.CIDRTarget:
+		return filter(hostAddrs(t.(*config.CIDRTarget).Prefix)), nil
+	case *config.HttpTarget:
+		// The http client resolves the host itself when probing.
+		return nil, nil
+	case *config.TcpTarget:
+		// Like http, the dialer resolves the host itself.
+		return nil, nil
+	case *config.BroadcastTarget:
+		// Probed separately, responses come from many addresses.
+		return nil, nil
 	}
 	return nil, fmt.Errorf("could not resolve target of type %v\n", t)
 }
 
 func (r *netresolver) resolveHops(ctx context.Context, th *config.TraceHops) ([]netip.Addr, error) {
-	res, err := trace.TraceRoute(ctx, th.Dest, trace.TraceRouteOptions{
-		MaxHops:    th.Hop + 1,
-		Retries:    5,
-		HopTimeout: 2 * time.Second,
-	})
+	if th.HopASN != 0 && r.annotator == nil {
+		return nil, errors.New("matching hops by autonomous system requires --as-source")
+	}
+
+	maxHops := th.Hop + 1
+	if th.MatchesHop() {
+		// The matching hop could be anywhere on the route.
+		maxHops = 0
+	}
+	res, err := r.traceRoute(ctx, th.Dest, th.Host, th.Family, maxHops, th.DSCP)
+	if err != nil {
+		return nil, err
+	}
+
+	// Names and autonomous systems are best effort, and only looked up
+	// when hops are matched by them or the route is recorded.
+	var names [][]string
+	if th.HopMatchRegex != "" || r.routes != nil {
+		names, _ = trace.ResolveHops(ctx, res.Addrs(), hopNameTimeout)
+	}
+	if th.HopASN != 0 || r.routes != nil {
+		r.annotator.Annotate(ctx, res)
+	}
+
+	index, err := hopIndex(th, res, names)
 	if err != nil {
+		r.recordRoute(th, res, -1, names)
 		return nil, err
 	}
+	r.recordRoute(th, res, index, names)
 
-	index := th.Hop
-	if index < 0 {
-		index += len(res.Hops)
+	// Flaky networks drop many of the trace probes, don't resolve to a
+	// hop that may not be the configured one.
+	if !res.Hops[index].Addr.IsValid() {
+		return nil, fmt.Errorf("hop %d did not respond to the traceroute", th.Hop)
 	}
-	// If the index is outside the range of reasonable, then it's an exception.
-	// Since it's not possible to know the number of hops without having run a
-	// trace route out of band, this likely constrains passed indexes to the
-	// range between -2 and 2.
-	if index < 0 || len(res.Hops) <= index {
-		return nil, fmt.Errorf("traceroute has less than %d hops", th.Hop)
+	valid := 0
+	for _, hop := range res.Hops {
+		if hop.Addr.IsValid() {
+			valid += 1
+		}
+	}
+	if valid < th.MinValidHops {
+		return nil, fmt.Errorf("traceroute has %d responding hops, less than the %d required", valid, th.MinValidHops)
 	}
 
 	return filter([]netip.Addr{
-		res.Hops[index].Unmap(),
+		res.Hops[index].Addr.Unmap(),
 	}), nil
 }
 
+// traceRoute traces the route to dest, or to an address of the family host
+// resolves to if dest isn't valid. Zero maxHops traces the whole route.
+func (r *netresolver) traceRoute(ctx context.Context, dest netip.Addr, host string, family config.Family, maxHops, dscp int) (*trace.TraceResult, error) {
+	if !dest.IsValid() {
+		addrs, err := r.resolver.LookupNetIP(ctx, family.Network(), host)
+		if err != nil {
+			return nil, err
+		}
+		if addrs = filter(addrs); len(addrs) == 0 {
+			return nil, fmt.Errorf("no usable %s address for %s", family.Network(), host)
+		}
+		dest = sortAddrs(addrs)[0]
+	}
+
+	// Trace from the same interface as the pings, otherwise the route may
+	// differ from the one actually being monitored.
+	src, err := ip.SourceOf(sourceOf(ctx), dest.Is4())
+	if err != nil {
+		return nil, err
+	}
+
+	return trace.TraceRoute(ctx, dest, trace.TraceRouteOptions{
+		MaxHops:     maxHops,
+		Retries:     5,
+		HopTimeout:  2 * time.Second,
+		Interface:   src,
+		Parallelism: traceParallelism,
+		DSCP:        dscp,
+	})
+}
+
+// resolveRoute resolves to the address of every hop of the route that
+// responded, including the destination, and records the hop each is at into
+// the context, see withHops.
+func (r *netresolver) resolveRoute(ctx context.Context, rt *config.RouteTarget) ([]netip.Addr, error) {
+	res, err := r.traceRoute(ctx, rt.Dest, rt.Host, rt.Family, 0, rt.DSCP)
+	if err != nil {
+		return nil, err
+	}
+	if r.routes != nil {
+		names, _ := trace.ResolveHops(ctx, res.Addrs(), hopNameTimeout)
+		r.annotator.Annotate(ctx, res)
+		r.routes.record(rt.Name, res, -1, names)
+	}
+
+	hops := hopsOf(ctx)
+	var addrs []netip.Addr
+	seen := make(map[netip.Addr]struct{})
+	// The first hop is the source, not a router.
+	for i := 1; i < len(res.Hops); i++ {
+		addr := res.Hops[i].Addr.Unmap()
+		if !addr.IsValid() {
+			continue
+		}
+		// Routing loops visit the same router more than once, it's
+		// named after the first hop it was seen at.
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+		if hops != nil {
+			hops.record(addr, i)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no hop responded to the traceroute")
+	}
+	return filter(addrs), nil
+}
+
+// hopIndex returns the index of the hop of the route that the target
+// resolves to. Names are the reverse DNS names of the hops.
+func hopIndex(th *config.TraceHops, res *trace.TraceResult, names [][]string) (int, error) {
+	if !th.MatchesHop() {
+		index := th.Hop
+		if index < 0 {
+			index += len(res.Hops)
+		}
+		// If the index is outside the range of reasonable, then it's an
+		// exception. Since it's not possible to know the number of hops
+		// without having run a trace route out of band, this likely
+		// constrains passed indexes to the range between -2 and 2.
+		if index < 0 || len(res.Hops) <= index {
+			return -1, fmt.Errorf("traceroute has less than %d hops", th.Hop)
+		}
+		return index, nil
+	}
+
+	var match *regexp.Regexp
+	if th.HopMatchRegex != "" {
+		var err error
+		if match, err = regexp.Compile(th.HopMatchRegex); err != nil {
+			return -1, err
+		}
+	}
+	// The first hop is the source, not a router.
+	for i := 1; i < len(res.Hops); i++ {
+		if th.HopASN != 0 && res.Hops[i].AS.Number != th.HopASN {
+			continue
+		}
+		if match != nil && (i >= len(names) || !matchesName(match, names[i])) {
+			continue
+		}
+		return i, nil
+	}
+	return -1, fmt.Errorf("no hop of the traceroute matches")
+}
+
+// matchesName reports whether any of the names matches, without the trailing
+// dot of the reverse lookup.
+func matchesName(match *regexp.Regexp, names []string) bool {
+	for _, name := range names {
+		if match.MatchString(strings.TrimSuffix(name, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *netresolver) recordRoute(th *config.TraceHops, res *trace.TraceResult, selected int, names [][]string) {
+	if r.routes == nil {
+		return
+	}
+	r.routes.record(th.Name, res, selected, names)
+}
+
 func (r *netresolver) resolveHost(ctx context.Context, s *config.HostnameTarget) ([]netip.Addr, error) {
 	addrs, err := r.resolver.LookupNetIP(ctx, "ip", s.Host)
 	return filter(addrs), err
 }
 
+// resolveSRV resolves every host the SRV record points at. Hosts that fail to
+// resolve are skipped, unless all of them fail.
+func (r *netresolver) resolveSRV(ctx context.Context, s *config.SRVTarget) ([]netip.Addr, error) {
+	_, srvs, err := r.resolver.LookupSRV(ctx, s.Service, s.Proto, s.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	// Records without targets resolve to no addresses, like the targets
+	// filter empties.
+	addrs := make([]netip.Addr, 0)
+	var lastErr error
+	seen := make(map[netip.Addr]struct{})
+	for _, srv := range srvs {
+		found, err := r.resolver.LookupNetIP(ctx, "ip", srv.Target)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, addr := range found {
+			if _, ok := seen[addr]; !ok {
+				seen[addr] = struct{}{}
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	if len(addrs) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return filter(addrs), nil
+}
+
+// filter drops addresses of disabled families. Targets whose addresses are all
+// filtered out resolve to an empty, not nil, list of addresses, which the
+// service reports like any other resolution.
 func filter(addrs []netip.Addr) []netip.Addr {
 	if len(addrs) == 0 {
 		return addrs
@@ -84,9 +310,7 @@ func filter(addrs []netip.Addr) []netip.Addr {
 
 	result := make([]netip.Addr, 0, len(addrs))
 	for _, addr := range addrs {
-		if !*mixed4In6Flag {
-			addr = addr.Unmap()
-		}
+		addr = Unmapped(addr)
 		if AllowedAddr(addr) {
 			result = append(result, addr)
 		}
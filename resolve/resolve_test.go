@@ -0,0 +1,63 @@
+package resolve
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+	"github.com/VolatileDream/workbench/web/network-monitor/trace"
+)
+
+func Test_hopIndex(t *testing.T) {
+	res := &trace.TraceResult{
+		Hops: []trace.Hop{
+			{Addr: netip.MustParseAddr("192.168.1.10")},
+			{Addr: netip.MustParseAddr("192.168.1.1")},
+			{},
+			{Addr: netip.MustParseAddr("203.0.113.1"), AS: trace.AS{Number: 64500}},
+			{Addr: netip.MustParseAddr("203.0.113.2"), AS: trace.AS{Number: 64500}},
+			{Addr: netip.MustParseAddr("198.51.100.1"), AS: trace.AS{Number: 64501}},
+		},
+	}
+	names := [][]string{
+		nil,
+		{"router.lan."},
+		nil,
+		{"edge1.isp.net."},
+		{"core1.isp.net."},
+		{"peer.transit.net."},
+	}
+
+	tests := []struct {
+		name   string
+		target config.TraceHops
+		want   int
+		err    bool
+	}{
+		{name: "index", target: config.TraceHops{Hop: 2}, want: 2},
+		{name: "negative index", target: config.TraceHops{Hop: -1}, want: 5},
+		{name: "index past route", target: config.TraceHops{Hop: 6}, err: true},
+		{name: "name", target: config.TraceHops{HopMatchRegex: `\.isp\.net$`}, want: 3},
+		{name: "asn", target: config.TraceHops{HopASN: 64501}, want: 5},
+		{name: "name and asn", target: config.TraceHops{HopMatchRegex: `^core`, HopASN: 64500}, want: 4},
+		{name: "no match", target: config.TraceHops{HopMatchRegex: `^core`, HopASN: 64501}, err: true},
+		{name: "source never matches", target: config.TraceHops{HopMatchRegex: `.*`}, want: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := hopIndex(&test.target, res, names)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected error, got hop %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("did not expect error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got hop %d, want %d", got, test.want)
+			}
+		})
+	}
+}
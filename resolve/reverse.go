@@ -0,0 +1,71 @@
+package resolve
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long reverse lookups are cached for. Router names rarely change, and
+// looking them up every resolve interval would only add load.
+const reverseCacheTTL = time.Hour
+
+// ReverseResolver is implemented by resolvers that can look up the hostname of
+// an address.
+type ReverseResolver interface {
+	// LookupHostname returns the hostname of the address, or an empty
+	// string if it has none.
+	LookupHostname(ctx context.Context, addr netip.Addr) string
+}
+
+// reverseCache caches reverse lookups, including failed ones. Safe for
+// concurrent use.
+type reverseCache struct {
+	lock    sync.Mutex
+	entries map[netip.Addr]reverseEntry
+}
+
+type reverseEntry struct {
+	name    string
+	expires time.Time
+}
+
+func (c *reverseCache) get(addr netip.Addr, now time.Time) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[addr]
+	if !ok || now.After(e.expires) {
+		return "", false
+	}
+	return e.name, true
+}
+
+func (c *reverseCache) put(addr netip.Addr, name string, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for a, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, a)
+		}
+	}
+	c.entries[addr] = reverseEntry{
+		name:    name,
+		expires: now.Add(reverseCacheTTL),
+	}
+}
+
+func (r *netresolver) LookupHostname(ctx context.Context, addr netip.Addr) string {
+	if name, ok := r.reverse.get(addr, time.Now()); ok {
+		return name
+	}
+
+	var name string
+	names, err := r.resolver.LookupAddr(ctx, addr.String())
+	if err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+	r.reverse.put(addr, name, time.Now())
+	return name
+}
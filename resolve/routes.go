@@ -0,0 +1,93 @@
+package resolve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/trace"
+)
+
+// Time allowed to look up the name of each hop of a route.
+const hopNameTimeout = time.Second
+
+// Route is the most recent route traced for a hops target.
+type Route struct {
+	Name        string     `json:"name"`
+	Source      netip.Addr `json:"source"`
+	Destination netip.Addr `json:"destination"`
+	// Selected is the index of the hop the target resolved to, or -1 if the
+	// route didn't have the configured hop.
+	Selected int       `json:"selected"`
+	Hops     []Hop     `json:"hops"`
+	Updated  time.Time `json:"updated"`
+}
+
+type Hop struct {
+	// Not set if the hop didn't respond.
+	Addr  netip.Addr `json:"address,omitempty"`
+	Names []string   `json:"names,omitempty"`
+	// Autonomous system of the hop, not set if unknown or --as-source is
+	// unset.
+	ASN uint32 `json:"asn,omitempty"`
+	Org string `json:"org,omitempty"`
+}
+
+// Routes keeps the route of every hops target, so that the configured hop
+// index can be checked against the actual route. Safe for concurrent use.
+type Routes struct {
+	lock   sync.Mutex
+	routes map[string]Route
+}
+
+func NewRoutes() *Routes {
+	return &Routes{
+		routes: make(map[string]Route),
+	}
+}
+
+func (r *Routes) record(name string, res *trace.TraceResult, selected int, names [][]string) {
+	route := Route{
+		Name:        name,
+		Source:      res.Source,
+		Destination: res.Dest,
+		Selected:    selected,
+		Hops:        make([]Hop, 0, len(res.Hops)),
+		Updated:     time.Now(),
+	}
+	for i, h := range res.Hops {
+		hop := Hop{
+			Addr: h.Addr.Unmap(),
+			ASN:  h.AS.Number,
+			Org:  h.AS.Org,
+		}
+		if i < len(names) {
+			hop.Names = names[i]
+		}
+		route.Hops = append(route.Hops, hop)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.routes[name] = route
+}
+
+// ServeHTTP dumps the routes of every hops target as json.
+func (r *Routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	result := make([]Route, 0, len(r.routes))
+	for _, route := range r.routes {
+		result = append(result, route)
+	}
+	r.lock.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
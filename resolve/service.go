@@ -5,14 +5,27 @@ package resolve
 
 import (
 	"context"
-	"log"
+	"errors"
+	"flag"
+	"log/slog"
 	"net/netip"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/VolatileDream/workbench/web/network-monitor/config"
 )
 
+var (
+	maxConcurrentResolvesFlag = flag.Int("max-concurrent-resolves",
+		16,
+		"Maximum number of targets resolved at once, traced hops each send a traceroute. Zero is unlimited.")
+	resultBufferFlag = flag.Int("resolve-result-buffer",
+		100,
+		"Number of resolve results buffered for the pingers.")
+)
+
 type ConfigLoader <-chan config.Config
 type ResolverService struct {
 	// TODO
@@ -25,42 +38,99 @@ type ResolverService struct {
 	resolver Resolver
 
 	results chan Result
+
+	metrics *serviceMetrics
+
+	backoff *targetBackoff
+
+	expanded *expander
+
+	// Debugging state of the targets, see ServeHTTP.
+	states atomic.Value // []TargetState
+
+	// Maximum number of targets resolved at once, zero is unlimited.
+	concurrency int
+
+	log *slog.Logger
 }
 
 type Result struct {
 	Resolved []Resolution
+
+	// Partial results are sent as targets finish resolving, and only contain
+	// the targets that changed. They should be merged into the previous
+	// results. Results that aren't partial contain every target.
+	Partial bool
 }
 
 type Resolution struct {
 	Target config.LatencyTarget
 	Addrs  []netip.Addr
+
+	// Hostname is the reverse DNS name of the address of hops targets, if
+	// the resolver supports looking it up. Empty if unknown.
+	Hostname string
+
+	// Fresh is set if the addresses were looked up successfully for this
+	// result, instead of reused from an earlier one.
+	Fresh bool
+
+	// Hops is the hop of the route every address of a RouteTarget was
+	// traced at, only set if Fresh. The expander remembers them for the
+	// results that reuse the addresses.
+	Hops map[netip.Addr]int
 }
 
 type resolution struct {
-	target config.LatencyTarget
-	addrs  []netip.Addr
-	err    error
+	target   config.LatencyTarget
+	addrs    []netip.Addr
+	hostname string
+	err      error
+	// Smallest ttl of the dns answers, zero if unknown.
+	ttl time.Duration
+	// Hops of the addresses of route targets, see Resolution.
+	hops map[netip.Addr]int
 }
 
+// errUnexpired is the error of targets that weren't resolved, because the ttl
+// of their addresses hasn't expired yet.
+var errUnexpired = errors.New("addresses have not expired yet")
+
+// Shortest time to wait between resolve cycles, when targets are already due
+// once a cycle ends.
+const minResolveWait = time.Second
+
 func NewServiceWithStaticConfig(resolver Resolver, conf config.Config) (*ResolverService, <-chan Result) {
 	l := make(chan config.Config, 1)
 	l <- conf
 
-	c := make(chan Result, 100)
+	c := make(chan Result, *resultBufferFlag)
 	r := &ResolverService{
 		loader:   l,
 		resolver: resolver,
 		results:  c,
+		metrics:  newServiceMetrics(),
+		backoff:  newTargetBackoff(),
+		expanded: newExpander(),
+		log:      slog.Default(),
+
+		concurrency: *maxConcurrentResolvesFlag,
 	}
 	return r, c
 }
 
 func NewService(loader ConfigLoader, resolver Resolver) (*ResolverService, <-chan Result) {
-	c := make(chan Result, 100)
+	c := make(chan Result, *resultBufferFlag)
 	r := &ResolverService{
 		loader:   loader,
 		resolver: resolver,
 		results:  c,
+		metrics:  newServiceMetrics(),
+		backoff:  newTargetBackoff(),
+		expanded: newExpander(),
+		log:      slog.Default(),
+
+		concurrency: *maxConcurrentResolvesFlag,
 	}
 	return r, c
 }
@@ -82,44 +152,104 @@ func (r *ResolverService) Run(ctx context.Context) {
 	defer timer.Stop()
 
 	cache := make(map[config.LatencyTarget][]netip.Addr)
+	hostnames := make(map[config.LatencyTarget]string)
+	lastSuccess := make(map[config.LatencyTarget]time.Time)
+	// When targets are resolved next, see nextResolve.
+	due := make(map[config.LatencyTarget]time.Time)
 
 resolve_loop:
 	for {
 		select {
 		case <-ctx.Done():
 			break resolve_loop
-		case cfg = <-r.loader:
-			timer.Reset(cfg.ResolveInterval)
+		case c := <-r.loader:
+			if c.Equal(cfg) {
+				// Resolving now would only reset the interval early.
+				r.log.Info("config unchanged, not resolving again")
+				continue
+			}
+			cfg = c
+			// Every target of a new config is resolved right away.
+			due = make(map[config.LatencyTarget]time.Time)
 		case <-timer.C:
-			timer.Reset(cfg.ResolveInterval)
 		}
 
+		now := time.Now()
+		targets, unexpired := dueTargets(cfg.Targets, due, now)
+
 		// If we can't resolve everything quickly relative to the interval,
 		// then what was the point in trying to resolve them all?
-		rCtx, cancel := context.WithTimeout(ctx, cfg.ResolveInterval/2)
-		result := r.resolve(rCtx, cfg.Targets)
+		rCtx, cancel := context.WithTimeout(withSource(ctx, cfg.Source), cfg.ResolveInterval/2)
+		r.backoff.forget(cfg.Targets)
+		r.expanded.forget(cfg.Targets)
+		result := r.resolve(rCtx, targets, cfg.ResolveInterval, func(res resolution) {
+			r.sendPartial(cache, res)
+		})
 		cancel()
+		for _, t := range unexpired {
+			result = append(result, resolution{target: t, err: errUnexpired})
+		}
 
 		R := Result{
 			Resolved: make([]Resolution, 0, len(result)),
 		}
 		newCache := make(map[config.LatencyTarget][]netip.Addr)
+		newHostnames := make(map[config.LatencyTarget]string)
+		newLastSuccess := make(map[config.LatencyTarget]time.Time)
+		newDue := make(map[config.LatencyTarget]time.Time)
+		var unresolved []config.LatencyTarget
 		for _, res := range result {
+			fresh := false
+			newLastSuccess[res.target] = lastSuccess[res.target]
+			newDue[res.target] = nextResolve(res, now, cfg.ResolveInterval)
 			if res.err == nil {
 				newCache[res.target] = res.addrs
+				newHostnames[res.target] = res.hostname
+				newLastSuccess[res.target] = time.Now()
+				fresh = true
+				r.metrics.resolved(ctx, res.target, resultFresh)
+			} else if errors.Is(res.err, errUnexpired) {
+				// Still fresh, only not looked up again.
+				newCache[res.target] = cache[res.target]
+				newHostnames[res.target] = hostnames[res.target]
+				newDue[res.target] = due[res.target]
 			} else {
 				newCache[res.target] = cache[res.target]
-				log.Printf("failed to resolve '%s': %v", res.target, res.err)
+				newHostnames[res.target] = hostnames[res.target]
+				if !errors.Is(res.err, errBackoff) {
+					// The backoff logs when it starts skipping.
+					r.log.Warn("failed to resolve", "target", res.target.MetricName(), "err", res.err)
+				}
+				if newCache[res.target] != nil {
+					r.metrics.resolved(ctx, res.target, resultCached)
+				} else {
+					r.metrics.resolved(ctx, res.target, resultDropped)
+				}
 			}
 
 			if addrs := newCache[res.target]; addrs != nil {
-				R.Resolved = append(R.Resolved, Resolution{
-					Target: res.target,
-					Addrs:  addrs,
-				})
+				expanded := Resolution{
+					Target:   res.target,
+					Addrs:    addrs,
+					Hostname: newHostnames[res.target],
+					Fresh:    fresh,
+				}
+				if fresh {
+					expanded.Hops = res.hops
+				}
+				R.Resolved = append(R.Resolved, r.expanded.expand(expanded)...)
+			} else {
+				unresolved = append(unresolved, res.target)
 			}
 		}
 		cache = newCache
+		hostnames = newHostnames
+		lastSuccess = newLastSuccess
+		due = newDue
+		timer.Reset(untilDue(due, cfg.ResolveInterval))
+		r.metrics.succeeded(lastSuccess)
+		R.Resolved = LimitAddrs(R.Resolved, cfg.MaxAddresses)
+		r.states.Store(targetStates(R.Resolved, unresolved, lastSuccess))
 
 		// A caller could forever avoid reading the result, so we have to
 		// double up on exiting if the context gets cancelled. But also we
@@ -131,8 +261,7 @@ resolve_loop:
 		expiry := time.NewTimer(cfg.ResolveInterval / 4)
 		select {
 		case <-expiry.C:
-			log.Printf("timed out (%s) writing resolve result. reader hung?\n",
-				cfg.ResolveInterval/4)
+			r.log.Warn("timed out writing resolve result, reader hung?", "timeout", cfg.ResolveInterval/4)
 
 		case r.results <- R:
 		case <-ctx.Done():
@@ -144,9 +273,156 @@ resolve_loop:
 	close(r.results)
 }
 
-func (r *ResolverService) resolve(ctx context.Context, targets []config.LatencyTarget) []resolution {
-	// Resolve them all concurrently
+// dueTargets splits the targets into the ones to resolve now, and the ones
+// whose addresses haven't expired yet.
+func dueTargets(targets []config.LatencyTarget, due map[config.LatencyTarget]time.Time, now time.Time) (resolve, unexpired []config.LatencyTarget) {
+	for _, t := range targets {
+		if now.Before(due[t]) {
+			unexpired = append(unexpired, t)
+		} else {
+			resolve = append(resolve, t)
+		}
+	}
+	return resolve, unexpired
+}
+
+// nextResolve returns when the target should be resolved again. Hostnames
+// are resolved again when the ttl of their answers expires, instead of after
+// the interval, but not more often than the smallest resolve interval.
+func nextResolve(res resolution, now time.Time, interval time.Duration) time.Time {
+	switch res.target.(type) {
+	case *config.HostnameTarget, *config.SRVTarget:
+		if res.err != nil || res.ttl <= 0 {
+			break
+		}
+		if res.ttl < config.SmallestResolveInterval {
+			return now.Add(config.SmallestResolveInterval)
+		}
+		return now.Add(res.ttl)
+	}
+	return now.Add(interval)
+}
+
+// untilDue returns the time until the next target is due, at most the
+// interval.
+func untilDue(due map[config.LatencyTarget]time.Time, interval time.Duration) time.Duration {
+	wait := interval
+	now := time.Now()
+	for _, d := range due {
+		if until := d.Sub(now); until < wait {
+			wait = until
+		}
+	}
+	if wait < minResolveWait {
+		return minResolveWait
+	}
+	return wait
+}
+
+// sendPartial sends a partial result for the resolution if it changed the
+// addresses of the target, so that slow targets don't delay the others.
+func (r *ResolverService) sendPartial(cache map[config.LatencyTarget][]netip.Addr, res resolution) {
+	if res.err != nil || res.addrs == nil || equalAddrs(cache[res.target], res.addrs) {
+		return
+	}
+
+	R := Result{
+		Resolved: r.expanded.expand(Resolution{
+			Target:   res.target,
+			Addrs:    res.addrs,
+			Hostname: res.hostname,
+			Fresh:    true,
+			Hops:     res.hops,
+		}),
+		Partial: true,
+	}
+	select {
+	case r.results <- R:
+	default:
+		// The complete result at the end of the cycle includes it anyway.
+	}
+}
+
+// hostname looks up the name of the address hops targets resolved to, if the
+// resolver supports it.
+func (r *ResolverService) hostname(ctx context.Context, t config.LatencyTarget, addrs []netip.Addr) string {
+	reverse, ok := r.resolver.(ReverseResolver)
+	if _, hops := t.(*config.TraceHops); !ok || !hops || len(addrs) != 1 {
+		return ""
+	}
+	return reverse.LookupHostname(ctx, addrs[0])
+}
+
+// LimitAddrs truncates the resolutions so that they contain at most max
+// addresses in total. Which addresses are dropped depends on the order the
+// targets finished resolving in. Partial results are limited by the receiver,
+// once they are merged with the previous results.
+func LimitAddrs(resolved []Resolution, max int) []Resolution {
+	if max <= 0 {
+		return resolved
+	}
+	total := 0
+	for _, res := range resolved {
+		total += len(res.Addrs)
+	}
+	if total <= max {
+		return resolved
+	}
+	slog.Warn("targets resolved to too many addresses, dropping the excess", "addresses", total, "max", max)
+
+	limited := make([]Resolution, 0, len(resolved))
+	remaining := max
+	for _, res := range resolved {
+		if remaining <= 0 {
+			break
+		}
+		if len(res.Addrs) > remaining {
+			res.Addrs = res.Addrs[:remaining]
+		}
+		remaining -= len(res.Addrs)
+		limited = append(limited, res)
+	}
+	return limited
+}
+
+// sortAddrs returns a sorted copy of the addresses, ipv4 before ipv6. System
+// resolvers may return addresses in any order, and consumers that select
+// addresses by position need a stable order between resolutions.
+func sortAddrs(addrs []netip.Addr) []netip.Addr {
+	if addrs == nil {
+		return nil
+	}
+	// Empty lists stay empty instead of becoming nil, see filter.
+	sorted := make([]netip.Addr, len(addrs))
+	copy(sorted, addrs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Less(sorted[j])
+	})
+	return sorted
+}
+
+func equalAddrs(a, b []netip.Addr) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve resolves all the targets concurrently, calling onResolved as each
+// target finishes. onResolved may be called concurrently. The interval is the
+// time until the targets are resolved again.
+func (r *ResolverService) resolve(ctx context.Context, targets []config.LatencyTarget, interval time.Duration, onResolved func(resolution)) []resolution {
+	// Resolve them all concurrently, up to the limit.
 	var wg sync.WaitGroup
+	var slots chan struct{}
+	if r.concurrency > 0 {
+		slots = make(chan struct{}, r.concurrency)
+	}
 
 	var rlock sync.Mutex
 	results := make([]resolution, 0, len(targets))
@@ -155,19 +431,59 @@ func (r *ResolverService) resolve(ctx context.Context, targets []config.LatencyT
 		wg.Add(1)
 		go func(t config.LatencyTarget) {
 			defer wg.Done()
-			addrs, err := r.resolver.Resolve(ctx, t)
-			log.Printf("resolved %s to %v\n", t.MetricName(), addrs)
+			// Targets that keep failing are still reported as failing,
+			// so that their cached addresses are used.
+			res := resolution{
+				target: t,
+				err:    errBackoff,
+			}
+			if !r.backoff.wait(t) {
+				res = r.resolveTarget(ctx, slots, t, interval)
+			}
+			onResolved(res)
 
 			rlock.Lock()
 			defer rlock.Unlock()
-			results = append(results, resolution{
-				target: t,
-				addrs:  addrs,
-				err:    err,
-			})
+			results = append(results, res)
 		}(target)
 	}
 
 	wg.Wait()
 	return results
 }
+
+// resolveTarget resolves the target once one of the slots is free, nil slots
+// don't limit how many targets resolve at once. Fails with the error of the
+// context if it's done first.
+func (r *ResolverService) resolveTarget(ctx context.Context, slots chan struct{}, t config.LatencyTarget, interval time.Duration) resolution {
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-ctx.Done():
+			return resolution{
+				target: t,
+				err:    ctx.Err(),
+			}
+		}
+	}
+
+	lookupCtx, ttl := withTTL(ctx)
+	lookupCtx, hops := withHops(lookupCtx)
+	addrs, err := r.resolver.Resolve(lookupCtx, t)
+	addrs = sortAddrs(addrs)
+	r.backoff.done(t, err, interval)
+	r.log.Debug("resolved", "target", t.MetricName(), "addrs", addrs)
+
+	res := resolution{
+		target: t,
+		addrs:  addrs,
+		err:    err,
+	}
+	res.ttl, _ = ttl.TTL()
+	res.hops = hops.Hops()
+	if err == nil {
+		res.hostname = r.hostname(ctx, t, addrs)
+	}
+	return res
+}
@@ -2,9 +2,14 @@ package resolve
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -29,6 +34,12 @@ func (tr *testResolver) SetAddr(target config.LatencyTarget, a netip.Addr) {
 		err:   nil,
 	}
 }
+func (tr *testResolver) SetAddrs(target config.LatencyTarget, a []netip.Addr) {
+	tr.result[target] = resolverResult{
+		addrs: a,
+		err:   nil,
+	}
+}
 func (tr *testResolver) SetErr(target config.LatencyTarget, e error) {
 	tr.result[target] = resolverResult{
 		addrs: nil,
@@ -57,6 +68,15 @@ func (tr *testResolver) Resolve(ctx context.Context, target config.LatencyTarget
 	return nil, nil
 }
 
+// nextComplete returns the next result that isn't partial.
+func nextComplete(results <-chan Result) Result {
+	for {
+		if R := <-results; !R.Partial {
+			return R
+		}
+	}
+}
+
 func Test_ResolverService_ExitsBeforeGivenConfig(t *testing.T) {
 	tCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -118,18 +138,23 @@ func Test_ResolverService_ErrorAfterFirstResolveThenReturnsCachedResult(t *testi
 			Resolution{
 				Target: target,
 				Addrs:  []netip.Addr{addr},
+				Fresh:  true,
 			},
 		},
 	}
-	R := <-results
+	R := nextComplete(results)
 	if !reflect.DeepEqual(R, expect) {
 		t.Fatalf("unexpected resolution: %v", R)
 	}
 
 	tr.SetErr(target, fmt.Errorf("error this time"))
+	// The cached addresses weren't looked up again.
+	expect.Resolved[0].Fresh = false
 
+	// Unchanged configs don't cause a resolve, so change something else.
+	cfg.PingInterval = time.Second
 	c <- cfg
-	R = <-results
+	R = nextComplete(results)
 	if !reflect.DeepEqual(R, expect) {
 		t.Fatalf("unexpected resolution: %v", R)
 	}
@@ -201,3 +226,423 @@ func Test_ResolverService_WaitsForAllTargetsBeforeResolving(t *testing.T) {
 
 	}
 }
+
+type slowResolver struct {
+	slow    config.LatencyTarget
+	release chan struct{}
+}
+
+var _ Resolver = &slowResolver{}
+
+func (sr *slowResolver) Resolve(ctx context.Context, t config.LatencyTarget) ([]netip.Addr, error) {
+	if t == sr.slow {
+		select {
+		case <-sr.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return []netip.Addr{netip.MustParseAddr("8.8.8.8")}, nil
+}
+
+func Test_ResolverService_SendsPartialResultBeforeSlowTarget(t *testing.T) {
+	tCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fast := &config.HostnameTarget{Name: "fast", Host: "fast"}
+	slow := &config.HostnameTarget{Name: "slow", Host: "slow"}
+
+	c := make(chan config.Config, 1)
+	c <- config.Config{
+		Targets:         []config.LatencyTarget{fast, slow},
+		ResolveInterval: time.Hour,
+	}
+
+	res := &slowResolver{
+		slow:    slow,
+		release: make(chan struct{}),
+	}
+	s, results := NewService(c, res)
+	go s.Run(tCtx)
+
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Fatalf("timed out waiting for partial result")
+	case R := <-results:
+		if !R.Partial || len(R.Resolved) != 1 || R.Resolved[0].Target != fast {
+			t.Fatalf("expected partial result for the fast target: %v", R)
+		}
+	}
+
+	close(res.release)
+
+	R := nextComplete(results)
+	if len(R.Resolved) != 2 {
+		t.Fatalf("expected complete result with both targets: %v", R)
+	}
+}
+
+// countingResolver blocks every lookup until released, and counts the most
+// lookups that were running at once.
+type countingResolver struct {
+	release chan struct{}
+
+	lock    sync.Mutex
+	running int
+	max     int
+}
+
+func (cr *countingResolver) Resolve(ctx context.Context, target config.LatencyTarget) ([]netip.Addr, error) {
+	cr.lock.Lock()
+	cr.running += 1
+	if cr.running > cr.max {
+		cr.max = cr.running
+	}
+	cr.lock.Unlock()
+	defer func() {
+		cr.lock.Lock()
+		cr.running -= 1
+		cr.lock.Unlock()
+	}()
+
+	select {
+	case <-cr.release:
+		return []netip.Addr{netip.MustParseAddr("127.0.0.1")}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func Test_ResolverService_LimitsConcurrentResolves(t *testing.T) {
+	var targets []config.LatencyTarget
+	for i := 0; i < 6; i++ {
+		targets = append(targets, &config.StaticIP{Name: fmt.Sprint(i), IP: netip.MustParseAddr("127.0.0.1")})
+	}
+
+	res := &countingResolver{release: make(chan struct{})}
+	s, _ := NewService(nil, res)
+	s.concurrency = 2
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(res.release)
+	}()
+	results := s.resolve(context.Background(), targets, time.Hour, func(resolution) {})
+	if len(results) != len(targets) {
+		t.Fatalf("expected %d results, got %v", len(targets), results)
+	}
+	for _, R := range results {
+		if R.err != nil {
+			t.Errorf("did not expect error for %s: %v", R.target, R.err)
+		}
+	}
+	if res.max != 2 {
+		t.Errorf("expected 2 lookups at once, got %d", res.max)
+	}
+}
+
+func Test_ResolverService_WaitingResolvesHonorDeadline(t *testing.T) {
+	targets := []config.LatencyTarget{
+		&config.StaticIP{Name: "a", IP: netip.MustParseAddr("127.0.0.1")},
+		&config.StaticIP{Name: "b", IP: netip.MustParseAddr("127.0.0.1")},
+	}
+
+	// Never released, so the first target holds the only slot.
+	res := &countingResolver{release: make(chan struct{})}
+	s, _ := NewService(nil, res)
+	s.concurrency = 1
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	results := s.resolve(ctx, targets, time.Hour, func(resolution) {})
+	if len(results) != len(targets) {
+		t.Fatalf("expected %d results, got %v", len(targets), results)
+	}
+	for _, R := range results {
+		if !errors.Is(R.err, context.DeadlineExceeded) {
+			t.Errorf("expected deadline error for %s, got: %v", R.target, R.err)
+		}
+	}
+}
+
+func Test_ResolverService_SortsAddresses(t *testing.T) {
+	tCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := make(chan config.Config, 1)
+	tr := NewTestResolver(t)
+	s, results := NewService(c, tr)
+
+	var target config.LatencyTarget = &config.HostnameTarget{
+		Name: "test",
+		Host: "test",
+	}
+	tr.SetAddrs(target, []netip.Addr{
+		netip.MustParseAddr("2001:db8::2"),
+		netip.MustParseAddr("8.8.8.8"),
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("1.1.1.1"),
+	})
+
+	go s.Run(tCtx)
+	c <- config.Config{
+		Targets:         []config.LatencyTarget{target},
+		ResolveInterval: time.Hour,
+	}
+
+	want := []netip.Addr{
+		netip.MustParseAddr("1.1.1.1"),
+		netip.MustParseAddr("8.8.8.8"),
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("2001:db8::2"),
+	}
+	R := nextComplete(results)
+	if len(R.Resolved) != 1 || !reflect.DeepEqual(R.Resolved[0].Addrs, want) {
+		t.Fatalf("unexpected resolution: %v", R)
+	}
+}
+
+func Test_ResolverService_ServesTargetStates(t *testing.T) {
+	tCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := make(chan config.Config, 1)
+	tr := NewTestResolver(t)
+	s, results := NewService(c, tr)
+
+	resolved := &config.HostnameTarget{Name: "resolved", Host: "resolved"}
+	failed := &config.HostnameTarget{Name: "failed", Host: "failed"}
+	tr.SetAddr(resolved, netip.MustParseAddr("1.1.1.1"))
+	tr.SetErr(failed, fmt.Errorf("failed"))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/targets", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected unavailable before resolving, got: %d", rec.Code)
+	}
+
+	go s.Run(tCtx)
+	c <- config.Config{
+		Targets:         []config.LatencyTarget{resolved, failed},
+		ResolveInterval: time.Hour,
+	}
+	nextComplete(results)
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/targets", nil))
+	var states []TargetState
+	if err := json.NewDecoder(rec.Body).Decode(&states); err != nil {
+		t.Fatalf("failed to decode states: %v", err)
+	}
+	if len(states) != 2 {
+		t.Fatalf("expected a state per target, got: %v", states)
+	}
+	if states[0].Name != "resolved" || len(states[0].Addrs) != 1 || states[0].LastSuccess.IsZero() {
+		t.Errorf("unexpected resolved state: %+v", states[0])
+	}
+	if states[1].Name != "failed" || len(states[1].Addrs) != 0 || !states[1].LastSuccess.IsZero() {
+		t.Errorf("unexpected failed state: %+v", states[1])
+	}
+}
+
+func Test_nextResolve(t *testing.T) {
+	now := time.Now()
+	host := &config.HostnameTarget{Name: "host", Host: "example.com"}
+	static := &config.StaticIP{Name: "static", IP: netip.MustParseAddr("1.1.1.1")}
+
+	tests := []struct {
+		name string
+		res  resolution
+		want time.Duration
+	}{
+		{"no ttl", resolution{target: host}, time.Hour},
+		{"long ttl", resolution{target: host, ttl: 2 * time.Hour}, 2 * time.Hour},
+		{"short ttl", resolution{target: host, ttl: time.Second}, config.SmallestResolveInterval},
+		{"failed", resolution{target: host, ttl: 2 * time.Hour, err: fmt.Errorf("failed")}, time.Hour},
+		{"not a hostname", resolution{target: static, ttl: 2 * time.Hour}, time.Hour},
+	}
+	for _, tc := range tests {
+		if got := nextResolve(tc.res, now, time.Hour); got.Sub(now) != tc.want {
+			t.Errorf("%s: resolves again after %v, want %v", tc.name, got.Sub(now), tc.want)
+		}
+	}
+
+	due := map[config.LatencyTarget]time.Time{
+		host:   now.Add(2 * time.Hour),
+		static: now,
+	}
+	targets, unexpired := dueTargets([]config.LatencyTarget{host, static}, due, now)
+	if !reflect.DeepEqual(targets, []config.LatencyTarget{static}) || !reflect.DeepEqual(unexpired, []config.LatencyTarget{host}) {
+		t.Errorf("got due %v and unexpired %v", targets, unexpired)
+	}
+	if wait := untilDue(map[config.LatencyTarget]time.Time{host: now.Add(-time.Minute)}, time.Hour); wait != minResolveWait {
+		t.Errorf("got wait %v for overdue target, want %v", wait, minResolveWait)
+	}
+}
+
+func Test_expander(t *testing.T) {
+	e := newExpander()
+	target := &config.HostnameTarget{Name: "test", Host: "test", Expand: true}
+	a := netip.MustParseAddr("1.1.1.1")
+	b := netip.MustParseAddr("8.8.8.8")
+
+	got := e.expand(Resolution{Target: target, Addrs: []netip.Addr{a, b}})
+	if len(got) != 2 {
+		t.Fatalf("expected a resolution per address, got: %v", got)
+	}
+	for i, res := range got {
+		if name := fmt.Sprintf("test/%d", i); res.Target.MetricName() != name {
+			t.Errorf("expected metric name %s, got: %s", name, res.Target.MetricName())
+		}
+	}
+	if !reflect.DeepEqual(got[1].Addrs, []netip.Addr{b}) {
+		t.Errorf("expected second address, got: %v", got[1].Addrs)
+	}
+
+	again := e.expand(Resolution{Target: target, Addrs: []netip.Addr{b}})
+	if len(again) != 1 || again[0].Target != got[0].Target {
+		t.Errorf("expected address targets to be reused, got: %v", again)
+	}
+
+	e.forget(nil)
+	if after := e.expand(Resolution{Target: target, Addrs: []netip.Addr{a}}); after[0].Target == got[0].Target {
+		t.Errorf("expected forgotten address targets to be recreated")
+	}
+
+	cidr := &config.CIDRTarget{Name: "subnet", Prefix: netip.MustParsePrefix("1.1.1.0/30")}
+	if got := e.expand(Resolution{Target: cidr, Addrs: []netip.Addr{a}}); len(got) != 1 || got[0].Target.MetricName() != "subnet/1.1.1.1" {
+		t.Errorf("expected subnet address to be named after it, got: %v", got)
+	}
+
+	plain := &config.HostnameTarget{Name: "plain", Host: "plain"}
+	if got := e.expand(Resolution{Target: plain, Addrs: []netip.Addr{a, b}}); len(got) != 1 || got[0].Target != plain {
+		t.Errorf("expected unexpanded target to be unchanged, got: %v", got)
+	}
+}
+
+func Test_expander_Route(t *testing.T) {
+	e := newExpander()
+	route := &config.RouteTarget{Name: "route", Dest: netip.MustParseAddr("8.8.8.8")}
+	a := netip.MustParseAddr("1.1.1.1")
+	b := netip.MustParseAddr("8.8.8.8")
+
+	got := e.expand(Resolution{
+		Target: route,
+		Addrs:  []netip.Addr{a, b},
+		Hops:   map[netip.Addr]int{a: 1, b: 3},
+		Fresh:  true,
+	})
+	if len(got) != 2 {
+		t.Fatalf("expected a resolution per hop, got: %v", got)
+	}
+	for i, name := range []string{"route/1", "route/3"} {
+		if got[i].Target.MetricName() != name {
+			t.Errorf("expected metric name %s, got: %s", name, got[i].Target.MetricName())
+		}
+	}
+
+	// Cached addresses don't have hops, the last ones are used.
+	again := e.expand(Resolution{Target: route, Addrs: []netip.Addr{b}})
+	if len(again) != 1 || again[0].Target != got[1].Target {
+		t.Errorf("expected the hop target to be reused, got: %v", again)
+	}
+
+	// A new router at the same hop keeps the target of the hop.
+	c := netip.MustParseAddr("9.9.9.9")
+	moved := e.expand(Resolution{Target: route, Addrs: []netip.Addr{c}, Hops: map[netip.Addr]int{c: 1}, Fresh: true})
+	if len(moved) != 1 || moved[0].Target != got[0].Target || !reflect.DeepEqual(moved[0].Addrs, []netip.Addr{c}) {
+		t.Errorf("expected the new router to use the target of hop 1, got: %v", moved)
+	}
+}
+
+func Test_LimitAddrs(t *testing.T) {
+	a := netip.MustParseAddr("1.1.1.1")
+	b := netip.MustParseAddr("8.8.8.8")
+	resolved := []Resolution{
+		{Target: &config.StaticIP{Name: "a"}, Addrs: []netip.Addr{a, b}},
+		{Target: &config.StaticIP{Name: "b"}, Addrs: []netip.Addr{b}},
+	}
+
+	if got := LimitAddrs(resolved, 0); !reflect.DeepEqual(got, resolved) {
+		t.Errorf("unlimited should not change resolutions, got: %v", got)
+	}
+	if got := LimitAddrs(resolved, 3); !reflect.DeepEqual(got, resolved) {
+		t.Errorf("resolutions under the limit should not change, got: %v", got)
+	}
+	got := LimitAddrs(resolved, 1)
+	if len(got) != 1 || !reflect.DeepEqual(got[0].Addrs, []netip.Addr{a}) {
+		t.Errorf("expected a single address, got: %v", got)
+	}
+}
+
+func Test_targetBackoff(t *testing.T) {
+	b := newTargetBackoff()
+	target := &config.TraceHops{Name: "hop", Dest: netip.MustParseAddr("8.8.8.8"), Hop: 1}
+	failed := fmt.Errorf("failed")
+
+	// Counts the cycles skipped before the next attempt.
+	skipped := func(of config.LatencyTarget) int {
+		n := 0
+		for b.wait(of) {
+			n++
+		}
+		return n
+	}
+
+	b.done(target, failed, time.Minute)
+	if n := skipped(target); n != 0 {
+		t.Errorf("expected the first failure to retry immediately, skipped %d", n)
+	}
+	b.done(target, failed, time.Minute)
+	if n := skipped(target); n != 1 {
+		t.Errorf("expected to skip 1 cycle, skipped %d", n)
+	}
+	b.done(target, failed, time.Minute)
+	if n := skipped(target); n != 3 {
+		t.Errorf("expected to skip 3 cycles, skipped %d", n)
+	}
+	b.done(target, failed, 2*time.Hour)
+	if n := skipped(target); n != 2 {
+		t.Errorf("expected the backoff to be capped at 2 cycles, skipped %d", n)
+	}
+
+	b.done(target, nil, time.Minute)
+	b.done(target, failed, time.Minute)
+	if n := skipped(target); n != 0 {
+		t.Errorf("expected success to reset the backoff, skipped %d", n)
+	}
+
+	// Hostnames only back off after a few failures.
+	host := &config.HostnameTarget{Name: "host", Host: "example.com"}
+	for i := 0; i < *resolveBackoffAfterFlag; i++ {
+		b.done(host, failed, time.Minute)
+		if b.wait(host) {
+			t.Fatalf("expected hostname to be retried after %d failures", i+1)
+		}
+	}
+	b.done(host, failed, time.Minute)
+	if n := skipped(host); n != 1 {
+		t.Errorf("expected to skip 1 cycle, skipped %d", n)
+	}
+
+	static := &config.StaticIP{Name: "static", IP: netip.MustParseAddr("1.1.1.1")}
+	b.done(static, failed, time.Minute)
+	b.done(static, failed, time.Minute)
+	if b.wait(static) {
+		t.Errorf("static targets should not back off")
+	}
+}
+
+func Test_sortAddrs(t *testing.T) {
+	if got := sortAddrs(nil); got != nil {
+		t.Errorf("expected nil to stay nil, got: %v", got)
+	}
+	if got := sortAddrs([]netip.Addr{}); got == nil || len(got) != 0 {
+		t.Errorf("expected an empty list to stay empty, got: %#v", got)
+	}
+	addrs := []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.1")}
+	want := []netip.Addr{addrs[2], addrs[1], addrs[0]}
+	if got := sortAddrs(addrs); !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+}
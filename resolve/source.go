@@ -0,0 +1,19 @@
+package resolve
+
+import (
+	"context"
+)
+
+type sourceKey struct{}
+
+// withSource returns a context that traces routes from source, the interface
+// name or local address of the config, see ip.SourceOf.
+func withSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// sourceOf returns the source of the context, empty if it doesn't have one.
+func sourceOf(ctx context.Context) string {
+	source, _ := ctx.Value(sourceKey{}).(string)
+	return source
+}
@@ -0,0 +1,63 @@
+package resolve
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+)
+
+// TargetState is what the resolver currently believes a target resolves to.
+type TargetState struct {
+	Name     string       `json:"name"`
+	Target   string       `json:"target"`
+	Addrs    []netip.Addr `json:"addresses"`
+	Hostname string       `json:"hostname,omitempty"`
+	// LastSuccess is when the target last resolved without an error, zero if
+	// it never did. Addresses of targets that fail are the cached ones.
+	LastSuccess time.Time `json:"last-success"`
+}
+
+// targetStates converts the resolutions of a complete result into their
+// states. Targets without any addresses are included, because they're the
+// interesting ones to debug.
+func targetStates(resolved []Resolution, unresolved []config.LatencyTarget, lastSuccess map[config.LatencyTarget]time.Time) []TargetState {
+	states := make([]TargetState, 0, len(resolved)+len(unresolved))
+	for _, res := range resolved {
+		t := res.Target
+		if a, ok := t.(*config.AddressTarget); ok {
+			t = a.Parent
+		}
+		states = append(states, TargetState{
+			Name:        res.Target.MetricName(),
+			Target:      res.Target.String(),
+			Addrs:       res.Addrs,
+			Hostname:    res.Hostname,
+			LastSuccess: lastSuccess[t],
+		})
+	}
+	for _, t := range unresolved {
+		states = append(states, TargetState{
+			Name:        t.MetricName(),
+			Target:      t.String(),
+			Addrs:       []netip.Addr{},
+			LastSuccess: lastSuccess[t],
+		})
+	}
+	return states
+}
+
+// ServeHTTP dumps the state of every target as of the latest complete
+// resolution as json.
+func (r *ResolverService) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	states, ok := r.states.Load().([]TargetState)
+	if !ok {
+		http.Error(w, "targets not resolved yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
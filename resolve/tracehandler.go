@@ -0,0 +1,150 @@
+package resolve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/ip"
+	"github.com/VolatileDream/workbench/web/network-monitor/trace"
+)
+
+// Longest an on-demand trace may take, including looking up the hop names.
+const traceRequestTimeout = 30 * time.Second
+
+// TraceHandler runs a traceroute to the destination of every request, and
+// replies with the route as json. Traces need privileges and send many
+// probes, so only one runs at a time, other requests are rejected meanwhile.
+//
+// Takes the query parameters dest, the address to trace to, and optionally
+// maxhops.
+type TraceHandler struct {
+	busy chan struct{}
+	// Optional, annotates the hops with their autonomous system.
+	annotator *trace.Annotator
+	// Optional, returns the source of the current config to trace from.
+	source func() string
+}
+
+func NewTraceHandler(annotator *trace.Annotator, source func() string) *TraceHandler {
+	return &TraceHandler{
+		busy:      make(chan struct{}, 1),
+		annotator: annotator,
+		source:    source,
+	}
+}
+
+type tracedRoute struct {
+	Source netip.Addr  `json:"source"`
+	Dest   netip.Addr  `json:"dest"`
+	Hops   []tracedHop `json:"hops"`
+}
+
+type tracedHop struct {
+	// Not set if the hop didn't respond.
+	Addr  netip.Addr `json:"addr,omitempty"`
+	Names []string   `json:"names,omitempty"`
+	ASN   uint32     `json:"asn,omitempty"`
+	Org   string     `json:"org,omitempty"`
+}
+
+// traceQuery parses the destination and options of a trace request.
+func traceQuery(req *http.Request) (netip.Addr, trace.TraceRouteOptions, error) {
+	opts := trace.TraceRouteOptions{
+		Retries:     3,
+		HopTimeout:  2 * time.Second,
+		Parallelism: traceParallelism,
+	}
+	q := req.URL.Query()
+	dest, err := netip.ParseAddr(q.Get("dest"))
+	if err != nil {
+		return netip.Addr{}, opts, fmt.Errorf("bad dest: %w", err)
+	}
+	dest = dest.Unmap()
+
+	if s := q.Get("maxhops"); s != "" {
+		hops, err := strconv.Atoi(s)
+		if err != nil || hops < 1 || hops > trace.DefaultTTL {
+			return netip.Addr{}, opts, fmt.Errorf("maxhops must be between 1 and %d: %q", trace.DefaultTTL, s)
+		}
+		opts.MaxHops = hops
+	}
+	return dest, opts, nil
+}
+
+func (h *TraceHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	dest, opts, err := traceQuery(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	select {
+	case h.busy <- struct{}{}:
+		defer func() { <-h.busy }()
+	default:
+		http.Error(w, "a trace is already running", http.StatusTooManyRequests)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), traceRequestTimeout)
+	defer cancel()
+
+	// Trace from the same interface as the pings, like hops targets.
+	source := ""
+	if h.source != nil {
+		source = h.source()
+	}
+	opts.Interface, err = ip.SourceOf(source, dest.Is4())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := trace.TraceRoute(ctx, dest, opts)
+	if err != nil {
+		traceError(w, err)
+		return
+	}
+	names, err := trace.ResolveHops(ctx, res.Addrs(), hopNameTimeout)
+	if err != nil {
+		traceError(w, err)
+		return
+	}
+	h.annotator.Annotate(ctx, res)
+	writeRoute(w, res, names)
+}
+
+func traceError(w http.ResponseWriter, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, "trace timed out", http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func writeRoute(w http.ResponseWriter, res *trace.TraceResult, names [][]string) {
+	route := tracedRoute{
+		Source: res.Source,
+		Dest:   res.Dest,
+		Hops:   make([]tracedHop, 0, len(res.Hops)),
+	}
+	for i, h := range res.Hops {
+		hop := tracedHop{
+			Addr: h.Addr.Unmap(),
+			ASN:  h.AS.Number,
+			Org:  h.AS.Org,
+		}
+		if i < len(names) {
+			hop.Names = names[i]
+		}
+		route.Hops = append(route.Hops, hop)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(route)
+}
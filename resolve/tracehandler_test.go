@@ -0,0 +1,37 @@
+package resolve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func Test_traceQuery(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/trace?dest=::ffff:192.0.2.1&maxhops=20", nil)
+	dest, opts, err := traceQuery(req)
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); dest != want {
+		t.Errorf("got dest %v, want %v", dest, want)
+	}
+	if opts.MaxHops != 20 {
+		t.Errorf("got max hops %d, want 20", opts.MaxHops)
+	}
+
+	for _, query := range []string{"", "dest=example.com", "dest=192.0.2.1&maxhops=0", "dest=192.0.2.1&maxhops=1000", "dest=192.0.2.1&maxhops=x"} {
+		req := httptest.NewRequest(http.MethodGet, "/trace?"+query, nil)
+		if _, _, err := traceQuery(req); err == nil {
+			t.Errorf("expected error for %q", query)
+		}
+	}
+}
+
+func Test_TraceHandler_RejectsBadQuery(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewTraceHandler(nil, nil).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/trace?dest=nope", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
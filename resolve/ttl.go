@@ -0,0 +1,139 @@
+package resolve
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ttlRecorder collects the smallest ttl of the dns answers read during a
+// lookup. Safe for concurrent use, lookups of both families run in parallel.
+type ttlRecorder struct {
+	lock sync.Mutex
+	ttl  time.Duration
+	seen bool
+}
+
+type ttlKey struct{}
+
+// withTTL returns a context that records the ttl of the answers to lookups
+// made with it, if the resolver was created by netResolver.
+func withTTL(ctx context.Context) (context.Context, *ttlRecorder) {
+	rec := &ttlRecorder{}
+	return context.WithValue(ctx, ttlKey{}, rec), rec
+}
+
+// ttlOf returns the recorder of the context, nil if it doesn't have one.
+func ttlOf(ctx context.Context) *ttlRecorder {
+	rec, _ := ctx.Value(ttlKey{}).(*ttlRecorder)
+	return rec
+}
+
+func (r *ttlRecorder) record(ttl time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.seen || ttl < r.ttl {
+		r.ttl = ttl
+	}
+	r.seen = true
+}
+
+// TTL returns the smallest ttl recorded, false if no answers were read.
+func (r *ttlRecorder) TTL() (time.Duration, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.ttl, r.seen
+}
+
+// recordAnswers records the ttl of every answer in the dns message.
+func (r *ttlRecorder) recordAnswers(msg []byte) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			// Either done, or malformed and the lookup fails anyway.
+			return
+		}
+		r.record(time.Duration(h.TTL) * time.Second)
+		if err := p.SkipAnswer(); err != nil {
+			return
+		}
+	}
+}
+
+// dialFunc dials the connections of a net.Resolver.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// recordingDial wraps the dial function, so that the ttl of the responses read
+// from its connections is recorded into the context of the lookup.
+func recordingDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		rec := ttlOf(ctx)
+		if err != nil || rec == nil {
+			return conn, err
+		}
+		// The go resolver frames messages by whether the conn is a
+		// net.PacketConn, so the wrapper must be one too.
+		if pc, ok := conn.(net.PacketConn); ok {
+			return &ttlPacketConn{ttlConn{Conn: conn, rec: rec}, pc}, nil
+		}
+		return &ttlConn{Conn: conn, rec: rec, stream: true}, nil
+	}
+}
+
+// ttlConn records the ttl of the dns responses read from the connection.
+type ttlConn struct {
+	net.Conn
+	rec *ttlRecorder
+
+	// Stream connections prefix messages with their length, and messages
+	// may span reads.
+	stream  bool
+	partial []byte
+}
+
+func (c *ttlConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if !c.stream {
+		c.rec.recordAnswers(b[:n])
+		return n, err
+	}
+
+	c.partial = append(c.partial, b[:n]...)
+	for len(c.partial) >= 2 {
+		length := 2 + int(binary.BigEndian.Uint16(c.partial))
+		if len(c.partial) < length {
+			break
+		}
+		c.rec.recordAnswers(c.partial[2:length])
+		c.partial = c.partial[length:]
+	}
+	return n, err
+}
+
+// ttlPacketConn is a ttlConn of a net.PacketConn.
+type ttlPacketConn struct {
+	ttlConn
+	pc net.PacketConn
+}
+
+func (c *ttlPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.pc.ReadFrom(b)
+	c.rec.recordAnswers(b[:n])
+	return n, addr, err
+}
+
+func (c *ttlPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.pc.WriteTo(b, addr)
+}
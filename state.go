@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+)
+
+// configState keeps the most recently loaded config, to serve it over http.
+type configState struct {
+	current atomic.Value // config.Config
+}
+
+type effectiveTarget struct {
+	Name         string `json:"name"`
+	Target       string `json:"target"`
+	Type         string `json:"type"`
+	PingInterval string `json:"ping-interval"`
+	Warmup       int    `json:"warmup"`
+	DontFragment bool   `json:"dont-fragment"`
+	Select       string `json:"select"`
+	DSCP         int    `json:"dscp"`
+	PayloadSize  int    `json:"payload-size"`
+}
+
+type effectiveConfig struct {
+	ResolveInterval string            `json:"resolve-interval"`
+	RampUp          string            `json:"ramp-up"`
+	Jitter          bool              `json:"jitter"`
+	Targets         []effectiveTarget `json:"targets"`
+}
+
+func (s *configState) run(ctx context.Context, c <-chan config.Config) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cfg := <-c:
+			s.current.Store(cfg)
+		}
+	}
+}
+
+// pingInterval returns the ping interval of the target in the current config,
+// zero if no config was loaded yet.
+func (s *configState) pingInterval(t config.LatencyTarget) time.Duration {
+	cfg, ok := s.current.Load().(config.Config)
+	if !ok {
+		return 0
+	}
+	return cfg.Settings(t).PingInterval
+}
+
+// source returns the source of the current config, empty if no config was
+// loaded yet.
+func (s *configState) source() string {
+	cfg, ok := s.current.Load().(config.Config)
+	if !ok {
+		return ""
+	}
+	return cfg.Source
+}
+
+func selectName(s config.Selection) string {
+	if s == config.SelectAll {
+		return "all"
+	}
+	return string(s)
+}
+
+// ServeHTTP dumps the effective settings of every target as json.
+func (s *configState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := s.current.Load().(config.Config)
+	if !ok {
+		http.Error(w, "no config loaded", http.StatusServiceUnavailable)
+		return
+	}
+
+	result := effectiveConfig{
+		ResolveInterval: cfg.ResolveInterval.String(),
+		RampUp:          cfg.RampUp.String(),
+		Jitter:          cfg.Jitter,
+		Targets:         make([]effectiveTarget, 0, len(cfg.Targets)),
+	}
+	for _, t := range cfg.Targets {
+		settings := cfg.Settings(t)
+		result.Targets = append(result.Targets, effectiveTarget{
+			Name:         t.MetricName(),
+			Target:       t.String(),
+			Type:         fmt.Sprintf("%T", t),
+			PingInterval: settings.PingInterval.String(),
+			Warmup:       settings.Warmup,
+			DontFragment: settings.DontFragment,
+			Select:       selectName(settings.Selection),
+			DSCP:         settings.DSCP,
+			PayloadSize:  settings.PayloadSize,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
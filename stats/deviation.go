@@ -0,0 +1,95 @@
+package stats
+
+// Tracks the latency consistency of targets over a sliding window of time.
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Deviation computes the standard deviation of latency samples per target,
+// over a sliding window of time. Safe for concurrent use.
+type Deviation struct {
+	window time.Duration
+
+	lock    sync.Mutex
+	samples map[string][]sample
+}
+
+type sample struct {
+	When  time.Time
+	Value float64
+}
+
+func NewDeviation(window time.Duration) *Deviation {
+	return &Deviation{
+		window:  window,
+		samples: make(map[string][]sample),
+	}
+}
+
+// Record adds a latency sample for the named target. Lost packets should not
+// be recorded, they have no latency to measure.
+func (d *Deviation) Record(name string, when time.Time, value float64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	s := d.prune(name, when)
+	d.samples[name] = append(s, sample{
+		When:  when,
+		Value: value,
+	})
+}
+
+// Snapshot returns the standard deviation of every target with at least two
+// samples inside the window ending at now. Targets without any samples in the
+// window are forgotten.
+func (d *Deviation) Snapshot(now time.Time) map[string]float64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	result := make(map[string]float64, len(d.samples))
+	for name := range d.samples {
+		s := d.prune(name, now)
+		if len(s) == 0 {
+			delete(d.samples, name)
+			continue
+		}
+		d.samples[name] = s
+		if len(s) < 2 {
+			continue
+		}
+		result[name] = stddev(s)
+	}
+	return result
+}
+
+// prune drops samples older than the window, must be called with the lock held.
+func (d *Deviation) prune(name string, now time.Time) []sample {
+	return prune(d.samples[name], now, d.window)
+}
+
+// prune drops the samples that are older than the window ending at now.
+func prune(s []sample, now time.Time, window time.Duration) []sample {
+	cutoff := now.Add(-window)
+	i := 0
+	for i < len(s) && s[i].When.Before(cutoff) {
+		i++
+	}
+	return append(s[:0], s[i:]...)
+}
+
+func stddev(s []sample) float64 {
+	var sum float64
+	for _, v := range s {
+		sum += v.Value
+	}
+	mean := sum / float64(len(s))
+
+	var sq float64
+	for _, v := range s {
+		sq += (v.Value - mean) * (v.Value - mean)
+	}
+	return math.Sqrt(sq / float64(len(s)))
+}
@@ -0,0 +1,66 @@
+package stats
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func Test_Deviation(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		name    string
+		samples []float64
+		// How long after the last sample to take the snapshot.
+		after time.Duration
+		want  map[string]float64
+	}{
+		{
+			name:    "no samples",
+			samples: nil,
+			want:    map[string]float64{},
+		},
+		{
+			name:    "single sample",
+			samples: []float64{10},
+			want:    map[string]float64{},
+		},
+		{
+			name:    "constant latency",
+			samples: []float64{10, 10, 10, 10},
+			want:    map[string]float64{"target": 0},
+		},
+		{
+			name:    "varying latency",
+			samples: []float64{2, 4, 4, 4, 5, 5, 7, 9},
+			want:    map[string]float64{"target": 2},
+		},
+		{
+			name:    "samples outside window",
+			samples: []float64{2, 4, 4, 4, 5, 5, 7, 9},
+			after:   time.Hour,
+			want:    map[string]float64{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDeviation(time.Minute)
+			when := start
+			for _, s := range test.samples {
+				d.Record("target", when, s)
+				when = when.Add(time.Second)
+			}
+
+			got := d.Snapshot(when.Add(test.after))
+			if len(got) != len(test.want) {
+				t.Fatalf("got: %v, want: %v", got, test.want)
+			}
+			for name, want := range test.want {
+				if math.Abs(got[name]-want) > 1e-9 {
+					t.Errorf("got: %v, want: %v", got, test.want)
+				}
+			}
+		})
+	}
+}
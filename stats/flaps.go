@@ -0,0 +1,80 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// Flaps detects targets crossing between up and down. Like Reachable, a
+// target is up while its last reply is within the window recorded with its
+// results, and goes down once a probe sent after the window is lost. Targets
+// start out in neither state, so the first result isn't a flap. Targets
+// without any results for the expiry are forgotten. Safe for concurrent use.
+type Flaps struct {
+	expiry time.Duration
+
+	lock      sync.Mutex
+	targets   map[string]*flapState
+	lastPrune time.Time
+}
+
+type flapState struct {
+	known     bool
+	up        bool
+	lastReply time.Time
+	lastSeen  time.Time
+}
+
+func NewFlaps(expiry time.Duration) *Flaps {
+	return &Flaps{
+		expiry:  expiry,
+		targets: make(map[string]*flapState),
+	}
+}
+
+// Record adds a result for the named target, and reports whether the target
+// went up or down because of it.
+func (f *Flaps) Record(name string, when time.Time, replied bool, window time.Duration) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.prune(when)
+	s, ok := f.targets[name]
+	if !ok {
+		s = &flapState{}
+		f.targets[name] = s
+	}
+	if when.After(s.lastSeen) {
+		s.lastSeen = when
+	}
+	if replied {
+		if when.After(s.lastReply) {
+			s.lastReply = when
+		}
+		flapped := s.known && !s.up
+		s.known, s.up = true, true
+		return flapped
+	}
+	// Probes lost within the window of a reply, or sent before it, are
+	// only loss.
+	if s.known && (!s.up || when.Sub(s.lastReply) <= window) {
+		return false
+	}
+	flapped := s.known
+	s.known, s.up = true, false
+	return flapped
+}
+
+// prune forgets the targets without results for the expiry, at most once
+// every expiry. Must be called with the lock held.
+func (f *Flaps) prune(now time.Time) {
+	if now.Sub(f.lastPrune) < f.expiry {
+		return
+	}
+	f.lastPrune = now
+	for name, s := range f.targets {
+		if now.Sub(s.lastSeen) > f.expiry {
+			delete(f.targets, name)
+		}
+	}
+}
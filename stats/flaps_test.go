@@ -0,0 +1,51 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Flaps(t *testing.T) {
+	start := time.Unix(1000, 0)
+	window := 5 * time.Second
+	f := NewFlaps(5 * time.Minute)
+
+	steps := []struct {
+		offset  time.Duration
+		replied bool
+		flapped bool
+	}{
+		// The first result is neither up nor down.
+		{0, true, false},
+		{time.Second, true, false},
+		// Lost within the window of the last reply, only loss.
+		{2 * time.Second, false, false},
+		{6 * time.Second, false, false},
+		// Went down.
+		{7 * time.Second, false, true},
+		{8 * time.Second, false, false},
+		// And came back up.
+		{9 * time.Second, true, true},
+		// Lost probes reported late, sent before the last reply.
+		{3 * time.Second, false, false},
+		{10 * time.Second, true, false},
+	}
+	for i, s := range steps {
+		if got := f.Record("a", start.Add(s.offset), s.replied, window); got != s.flapped {
+			t.Errorf("step %d: expected flapped %v, got %v", i, s.flapped, got)
+		}
+	}
+
+	// Down from the start, isn't a flap either.
+	if f.Record("never", start, false, window) {
+		t.Errorf("expected the first result not to flap")
+	}
+	if !f.Record("never", start.Add(time.Second), true, window) {
+		t.Errorf("expected the first reply after being down to flap")
+	}
+
+	// Forgotten without results for the expiry, and starts over.
+	if f.Record("a", start.Add(time.Hour), false, window) {
+		t.Errorf("expected forgotten target to start over")
+	}
+}
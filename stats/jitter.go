@@ -0,0 +1,78 @@
+package stats
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Jitter estimates the variation in latency between consecutive samples of
+// each key, like the interarrival jitter of RFC 3550: a running mean of the
+// absolute difference between consecutive samples, with a gain of 1/16.
+// Keys that haven't been updated within the expiry are forgotten. Safe for
+// concurrent use.
+type Jitter struct {
+	expiry time.Duration
+
+	lock   sync.Mutex
+	states map[Key]*jitterState
+}
+
+type jitterState struct {
+	last   sample
+	jitter float64
+	// Jitter needs two samples, the first one only sets last.
+	valid bool
+}
+
+func NewJitter(expiry time.Duration) *Jitter {
+	return &Jitter{
+		expiry: expiry,
+		states: make(map[Key]*jitterState),
+	}
+}
+
+// Record adds a latency sample for the key. Lost or reordered packets should
+// not be recorded, they aren't consecutive with the other samples.
+func (j *Jitter) Record(k Key, when time.Time, value float64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	s, ok := j.states[k]
+	if !ok || when.Sub(s.last.When) > j.expiry {
+		// Samples too far apart aren't consecutive either.
+		j.states[k] = &jitterState{
+			last: sample{When: when, Value: value},
+		}
+		return
+	}
+
+	d := math.Abs(value - s.last.Value)
+	if s.valid {
+		s.jitter += (d - s.jitter) / 16
+	} else {
+		s.jitter = d
+		s.valid = true
+	}
+	s.last = sample{When: when, Value: value}
+}
+
+// Snapshot returns the jitter of every key with at least two samples, that
+// was updated within the expiry.
+func (j *Jitter) Snapshot(now time.Time) map[Key]float64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	cutoff := now.Add(-j.expiry)
+	result := make(map[Key]float64, len(j.states))
+	for k, s := range j.states {
+		if s.last.When.Before(cutoff) {
+			delete(j.states, k)
+			continue
+		}
+		if s.valid {
+			result[k] = s.jitter
+		}
+	}
+	return result
+}
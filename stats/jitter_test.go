@@ -0,0 +1,40 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Jitter(t *testing.T) {
+	start := time.Unix(1000, 0)
+	j := NewJitter(time.Minute)
+	a := Key{Name: "a", Remote: "1.1.1.1"}
+	b := Key{Name: "b", Remote: "8.8.8.8"}
+
+	j.Record(a, start, 10)
+	j.Record(a, start.Add(time.Second), 26)
+	j.Record(a, start.Add(2*time.Second), 10)
+	j.Record(b, start, 10)
+
+	// The first difference initializes the jitter, the others move it by
+	// 1/16th of the difference: 16 + (16-16)/16.
+	got := j.Snapshot(start.Add(2 * time.Second))
+	want := map[Key]float64{a: 16}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+
+	j.Record(a, start.Add(3*time.Second), 10)
+	got = j.Snapshot(start.Add(3 * time.Second))
+	want = map[Key]float64{a: 15}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+
+	// Expired keys are forgotten.
+	got = j.Snapshot(start.Add(2 * time.Minute))
+	if len(got) != 0 {
+		t.Errorf("expected no jitter after expiry, got: %v", got)
+	}
+}
@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// Key identifies a single metric series of a target.
+type Key struct {
+	Name   string
+	Remote string
+}
+
+// Latest keeps the most recent value recorded for each key, and forgets keys
+// that haven't been updated within the expiry. Safe for concurrent use.
+type Latest struct {
+	expiry time.Duration
+
+	lock   sync.Mutex
+	values map[Key]sample
+}
+
+func NewLatest(expiry time.Duration) *Latest {
+	return &Latest{
+		expiry: expiry,
+		values: make(map[Key]sample),
+	}
+}
+
+func (l *Latest) Record(k Key, when time.Time, value float64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.values[k] = sample{
+		When:  when,
+		Value: value,
+	}
+}
+
+// Snapshot returns the latest value of every key updated within the expiry.
+func (l *Latest) Snapshot(now time.Time) map[Key]float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	cutoff := now.Add(-l.expiry)
+	result := make(map[Key]float64, len(l.values))
+	for k, s := range l.values {
+		if s.When.Before(cutoff) {
+			delete(l.values, k)
+			continue
+		}
+		result[k] = s.Value
+	}
+	return result
+}
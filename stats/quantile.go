@@ -0,0 +1,86 @@
+package stats
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Quantiles computes latency quantiles per target, over a sliding window of
+// time. At most maxSamples are kept per target, older samples are dropped
+// first. Safe for concurrent use.
+type Quantiles struct {
+	window     time.Duration
+	maxSamples int
+
+	lock    sync.Mutex
+	samples map[string][]sample
+}
+
+func NewQuantiles(window time.Duration, maxSamples int) *Quantiles {
+	return &Quantiles{
+		window:     window,
+		maxSamples: maxSamples,
+		samples:    make(map[string][]sample),
+	}
+}
+
+// Record adds a latency sample for the named target.
+func (q *Quantiles) Record(name string, when time.Time, value float64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	s := prune(q.samples[name], when, q.window)
+	if len(s) >= q.maxSamples {
+		s = append(s[:0], s[len(s)-q.maxSamples+1:]...)
+	}
+	q.samples[name] = append(s, sample{
+		When:  when,
+		Value: value,
+	})
+}
+
+// Snapshot returns the requested quantiles, in the same order, of every target
+// with samples inside the window ending at now. Targets without any samples in
+// the window are forgotten.
+func (q *Quantiles) Snapshot(now time.Time, quantiles ...float64) map[string][]float64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	result := make(map[string][]float64, len(q.samples))
+	for name, s := range q.samples {
+		s = prune(s, now, q.window)
+		if len(s) == 0 {
+			delete(q.samples, name)
+			continue
+		}
+		q.samples[name] = s
+
+		values := make([]float64, 0, len(s))
+		for _, v := range s {
+			values = append(values, v.Value)
+		}
+		sort.Float64s(values)
+
+		qs := make([]float64, 0, len(quantiles))
+		for _, quantile := range quantiles {
+			qs = append(qs, nearestRank(values, quantile))
+		}
+		result[name] = qs
+	}
+	return result
+}
+
+// nearestRank returns the quantile of the sorted values, using the nearest
+// rank method.
+func nearestRank(sorted []float64, quantile float64) float64 {
+	rank := int(math.Ceil(quantile * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,36 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Quantiles(t *testing.T) {
+	start := time.Unix(1000, 0)
+	q := NewQuantiles(time.Minute, 100)
+
+	for i := 1; i <= 100; i++ {
+		q.Record("target", start.Add(time.Duration(i)*time.Millisecond), float64(i))
+	}
+
+	got := q.Snapshot(start.Add(time.Second), 0.5, 0.95, 0.99)
+	want := map[string][]float64{"target": {50, 95, 99}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+
+	// Samples past the limit push out the oldest ones.
+	q.Record("target", start.Add(time.Second), 1000)
+	got = q.Snapshot(start.Add(time.Second), 0, 1)
+	want = map[string][]float64{"target": {2, 1000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+
+	// Idle targets are forgotten.
+	got = q.Snapshot(start.Add(2*time.Minute), 0.5)
+	if len(got) != 0 {
+		t.Errorf("expected idle targets to be forgotten, got: %v", got)
+	}
+}
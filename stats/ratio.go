@@ -0,0 +1,63 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// Ratio computes the fraction of successful attempts per target, over a
+// sliding window of time. Safe for concurrent use.
+type Ratio struct {
+	window time.Duration
+
+	lock     sync.Mutex
+	attempts map[string][]sample
+}
+
+func NewRatio(window time.Duration) *Ratio {
+	return &Ratio{
+		window:   window,
+		attempts: make(map[string][]sample),
+	}
+}
+
+// Record adds an attempt for the named target.
+func (r *Ratio) Record(name string, when time.Time, ok bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var value float64
+	if ok {
+		value = 1
+	}
+	s := prune(r.attempts[name], when, r.window)
+	r.attempts[name] = append(s, sample{
+		When:  when,
+		Value: value,
+	})
+}
+
+// Snapshot returns the success ratio of every target with attempts inside the
+// window ending at now. Targets without any attempts in the window are
+// forgotten.
+func (r *Ratio) Snapshot(now time.Time) map[string]float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	result := make(map[string]float64, len(r.attempts))
+	for name, s := range r.attempts {
+		s = prune(s, now, r.window)
+		if len(s) == 0 {
+			delete(r.attempts, name)
+			continue
+		}
+		r.attempts[name] = s
+
+		var ok float64
+		for _, v := range s {
+			ok += v.Value
+		}
+		result[name] = ok / float64(len(s))
+	}
+	return result
+}
@@ -0,0 +1,31 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Ratio(t *testing.T) {
+	start := time.Unix(1000, 0)
+	r := NewRatio(time.Minute)
+
+	r.Record("a", start, true)
+	r.Record("a", start.Add(time.Second), false)
+	r.Record("a", start.Add(2*time.Second), true)
+	r.Record("a", start.Add(3*time.Second), true)
+	r.Record("b", start, false)
+
+	got := r.Snapshot(start.Add(3 * time.Second))
+	want := map[string]float64{"a": 0.75, "b": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+
+	// Only the last attempt of a is inside the window.
+	got = r.Snapshot(start.Add(time.Minute + 3*time.Second))
+	want = map[string]float64{"a": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+}
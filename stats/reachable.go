@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// Reachable tracks whether each target replied recently. A target is
+// reachable while its last reply is within the window recorded with its
+// results, targets that never replied are unreachable. Targets without any
+// results for the expiry, or their window if longer, are forgotten. Safe for
+// concurrent use.
+type Reachable struct {
+	expiry time.Duration
+
+	lock    sync.Mutex
+	targets map[string]*reachableState
+}
+
+type reachableState struct {
+	window    time.Duration
+	lastReply time.Time
+	lastSeen  time.Time
+}
+
+func NewReachable(expiry time.Duration) *Reachable {
+	return &Reachable{
+		expiry:  expiry,
+		targets: make(map[string]*reachableState),
+	}
+}
+
+// Record adds a result for the named target, replies count as recent for the
+// window.
+func (r *Reachable) Record(name string, when time.Time, replied bool, window time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s, ok := r.targets[name]
+	if !ok {
+		s = &reachableState{}
+		r.targets[name] = s
+	}
+	s.window = window
+	if when.After(s.lastSeen) {
+		s.lastSeen = when
+	}
+	if replied && when.After(s.lastReply) {
+		s.lastReply = when
+	}
+}
+
+// Snapshot returns 1 for every target that replied within its window before
+// now, and 0 for the other targets that aren't forgotten.
+func (r *Reachable) Snapshot(now time.Time) map[string]float64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	result := make(map[string]float64, len(r.targets))
+	for name, s := range r.targets {
+		expiry := r.expiry
+		if s.window > expiry {
+			expiry = s.window
+		}
+		if now.Sub(s.lastSeen) > expiry {
+			delete(r.targets, name)
+			continue
+		}
+
+		result[name] = 0
+		if !s.lastReply.IsZero() && now.Sub(s.lastReply) <= s.window {
+			result[name] = 1
+		}
+	}
+	return result
+}
@@ -0,0 +1,42 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Reachable(t *testing.T) {
+	start := time.Unix(1000, 0)
+	r := NewReachable(5 * time.Minute)
+
+	r.Record("a", start, true, 10*time.Second)
+	r.Record("a", start.Add(time.Second), false, 10*time.Second)
+	r.Record("never", start, false, 10*time.Second)
+
+	got := r.Snapshot(start.Add(5 * time.Second))
+	want := map[string]float64{"a": 1, "never": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+
+	// The reply of a is no longer recent.
+	got = r.Snapshot(start.Add(11 * time.Second))
+	want = map[string]float64{"a": 0, "never": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+
+	r.Record("a", start.Add(20*time.Second), true, 10*time.Second)
+	got = r.Snapshot(start.Add(5*time.Minute + 10*time.Second))
+	want = map[string]float64{"a": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %v, want: %v", got, want)
+	}
+
+	// Forgotten without results for the expiry.
+	got = r.Snapshot(start.Add(10 * time.Minute))
+	if len(got) != 0 {
+		t.Errorf("expected targets to be forgotten, got: %v", got)
+	}
+}
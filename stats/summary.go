@@ -0,0 +1,111 @@
+package stats
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Summary computes ping style statistics per target over a sliding window of
+// time: how many probes were lost, and the min, average, max and standard
+// deviation of the latency of the others. Safe for concurrent use.
+type Summary struct {
+	window time.Duration
+
+	lock    sync.Mutex
+	samples map[string][]sample
+}
+
+// SummaryStats are the statistics of a target over the window. The latency
+// fields are only set if Count > Lost.
+type SummaryStats struct {
+	Count int
+	Lost  int
+
+	Min    float64
+	Avg    float64
+	Max    float64
+	StdDev float64
+}
+
+// LossPercent returns the percentage of probes that were lost.
+func (s SummaryStats) LossPercent() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return 100 * float64(s.Lost) / float64(s.Count)
+}
+
+func NewSummary(window time.Duration) *Summary {
+	return &Summary{
+		window:  window,
+		samples: make(map[string][]sample),
+	}
+}
+
+// Record adds a reply with the latency for the named target.
+func (s *Summary) Record(name string, when time.Time, value float64) {
+	s.record(name, sample{When: when, Value: value})
+}
+
+// RecordLost adds a probe without a reply for the named target.
+func (s *Summary) RecordLost(name string, when time.Time) {
+	// Lost probes have no value, keeping them alongside the replies keeps
+	// both pruned by the same window.
+	s.record(name, sample{When: when, Value: math.NaN()})
+}
+
+func (s *Summary) record(name string, v sample) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	samples := prune(s.samples[name], v.When, s.window)
+	s.samples[name] = append(samples, v)
+}
+
+// Snapshot returns the statistics of every target with probes inside the
+// window ending at now. Targets without any probes in the window are
+// forgotten.
+func (s *Summary) Snapshot(now time.Time) map[string]SummaryStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	result := make(map[string]SummaryStats, len(s.samples))
+	for name, samples := range s.samples {
+		samples = prune(samples, now, s.window)
+		if len(samples) == 0 {
+			delete(s.samples, name)
+			continue
+		}
+		s.samples[name] = samples
+		result[name] = summarize(samples)
+	}
+	return result
+}
+
+func summarize(samples []sample) SummaryStats {
+	stats := SummaryStats{Count: len(samples)}
+	replies := make([]sample, 0, len(samples))
+	for _, v := range samples {
+		if math.IsNaN(v.Value) {
+			stats.Lost += 1
+			continue
+		}
+		replies = append(replies, v)
+	}
+	if len(replies) == 0 {
+		return stats
+	}
+
+	stats.Min = math.Inf(1)
+	stats.Max = math.Inf(-1)
+	var sum float64
+	for _, v := range replies {
+		stats.Min = math.Min(stats.Min, v.Value)
+		stats.Max = math.Max(stats.Max, v.Value)
+		sum += v.Value
+	}
+	stats.Avg = sum / float64(len(replies))
+	stats.StdDev = stddev(replies)
+	return stats
+}
@@ -0,0 +1,46 @@
+package stats
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Summary(t *testing.T) {
+	start := time.Unix(1000, 0)
+	s := NewSummary(time.Minute)
+
+	for i, value := range []float64{2, 4, 4, 4, 5, 5, 7, 9} {
+		s.Record("target", start.Add(time.Duration(i)*time.Second), value)
+	}
+	s.RecordLost("target", start.Add(10*time.Second))
+	s.RecordLost("target", start.Add(11*time.Second))
+	s.RecordLost("down", start.Add(11*time.Second))
+
+	got := s.Snapshot(start.Add(20 * time.Second))
+	want := map[string]SummaryStats{
+		"target": {Count: 10, Lost: 2, Min: 2, Avg: 5, Max: 9, StdDev: 2},
+		"down":   {Count: 1, Lost: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %+v, want: %+v", got, want)
+	}
+	if loss := got["target"].LossPercent(); loss != 20 {
+		t.Errorf("expected 20%% loss, got %v", loss)
+	}
+
+	// Only the lost probes are still inside the window.
+	got = s.Snapshot(start.Add(70 * time.Second))
+	want = map[string]SummaryStats{
+		"target": {Count: 2, Lost: 2},
+		"down":   {Count: 1, Lost: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got: %+v, want: %+v", got, want)
+	}
+
+	// Forgotten without probes in the window.
+	if got = s.Snapshot(start.Add(2 * time.Minute)); len(got) != 0 {
+		t.Errorf("expected targets to be forgotten, got: %+v", got)
+	}
+}
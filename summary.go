@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/stats"
+)
+
+// summaryHandler serves the ping summary of every target as json.
+type summaryHandler struct {
+	summary *stats.Summary
+}
+
+type targetSummary struct {
+	Count       int     `json:"count"`
+	Lost        int     `json:"lost"`
+	LossPercent float64 `json:"loss_percent"`
+	// Null if every probe was lost.
+	MinMs    *float64 `json:"min_ms"`
+	AvgMs    *float64 `json:"avg_ms"`
+	MaxMs    *float64 `json:"max_ms"`
+	StdDevMs *float64 `json:"stddev_ms"`
+}
+
+func newTargetSummary(s stats.SummaryStats) targetSummary {
+	t := targetSummary{
+		Count:       s.Count,
+		Lost:        s.Lost,
+		LossPercent: s.LossPercent(),
+	}
+	if s.Count > s.Lost {
+		t.MinMs, t.AvgMs, t.MaxMs, t.StdDevMs = &s.Min, &s.Avg, &s.Max, &s.StdDev
+	}
+	return t
+}
+
+func (h *summaryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result := make(map[string]targetSummary)
+	for name, s := range h.summary.Snapshot(time.Now()) {
+		result[name] = newTargetSummary(s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
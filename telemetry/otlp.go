@@ -0,0 +1,50 @@
+//go:build otlp
+
+package telemetry
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/metric"
+)
+
+var (
+	otlpProtocolFlag = flag.String("otlp-protocol",
+		"grpc",
+		"Protocol to push metrics to the otlp collector with, 'grpc' or 'http'.")
+	otlpIntervalFlag = flag.Duration("otlp-interval",
+		time.Minute,
+		"How often metrics are pushed to the otlp collector.")
+)
+
+// otlpMetrics periodically pushes metrics to an otlp collector. The endpoint
+// and credentials are configured with the standard environment variables of
+// the exporters. The cleanup pushes any pending metrics before shutting down.
+func otlpMetrics(selector metric.AggregationSelector) (func(), error) {
+	ctx := context.Background()
+
+	var exporter metric.Exporter
+	var err error
+	switch *otlpProtocolFlag {
+	case "grpc":
+		exporter, err = otlpmetricgrpc.New(ctx,
+			otlpmetricgrpc.WithAggregationSelector(selector))
+	case "http":
+		exporter, err = otlpmetrichttp.New(ctx,
+			otlpmetrichttp.WithAggregationSelector(selector))
+	default:
+		err = fmt.Errorf("unknown otlp protocol: %q", *otlpProtocolFlag)
+	}
+	if err != nil {
+		return nothing, err
+	}
+
+	reader := metric.NewPeriodicReader(exporter, metric.WithInterval(*otlpIntervalFlag))
+	provider := metric.NewMeterProvider(metric.WithReader(reader))
+	return install(provider)
+}
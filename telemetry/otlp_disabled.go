@@ -0,0 +1,15 @@
+//go:build !otlp
+
+package telemetry
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/sdk/metric"
+)
+
+// otlpMetrics is only available when built with the otlp tag, the otlp
+// exporters pull in grpc, which most deployments don't need.
+func otlpMetrics(selector metric.AggregationSelector) (func(), error) {
+	return nothing, errors.New("built without otlp support, rebuild with -tags otlp")
+}
@@ -0,0 +1,88 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/sdk/metric"
+)
+
+var (
+	pushURLFlag = flag.String("push-url",
+		"",
+		"Pushgateway to push metrics to with --metrics-exporter=push, eg: http://pushgateway:9091.")
+	pushIntervalFlag = flag.Duration("push-interval",
+		time.Minute,
+		"How often metrics are pushed to the pushgateway.")
+	pushJobFlag = flag.String("push-job",
+		"netmon",
+		"Job label the pushed metrics are grouped under.")
+)
+
+// pushMetrics periodically pushes metrics to a prometheus pushgateway, for
+// hosts that no scraper can reach. The metrics are the same ones served on
+// /metrics otherwise. The cleanup stops pushing, and pushes a last time before
+// shutting down.
+func pushMetrics(selector metric.AggregationSelector) (func(), error) {
+	if *pushURLFlag == "" {
+		return nothing, errors.New("--push-url is required to push metrics")
+	}
+	if *pushIntervalFlag <= 0 {
+		return nothing, errors.New("--push-interval must be positive")
+	}
+
+	// Not the default registry, which the go client registers its own
+	// collectors into.
+	registry := prom.NewRegistry()
+	exporter, err := prometheus.New(
+		prometheus.WithoutUnits(),
+		prometheus.WithRegisterer(registry),
+		prometheus.WithAggregationSelector(selector))
+	if err != nil {
+		return nothing, err
+	}
+	provider := metric.NewMeterProvider(metric.WithReader(exporter))
+	shutdown, err := install(provider)
+	if err != nil {
+		return shutdown, err
+	}
+
+	// Replaces the metrics of the job on every push, so series of targets
+	// that were removed from the config disappear too.
+	pusher := push.New(*pushURLFlag, *pushJobFlag).Gatherer(registry)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(*pushIntervalFlag)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := pusher.PushContext(ctx); err != nil && ctx.Err() == nil {
+				slog.Warn("failed to push metrics", "url", *pushURLFlag, "err", err)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := pusher.PushContext(ctx); err != nil {
+			slog.Error("failed to push metrics on shutdown", "url", *pushURLFlag, "err", err)
+		}
+		shutdown()
+	}, nil
+}
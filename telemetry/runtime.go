@@ -0,0 +1,60 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/unit"
+)
+
+// Reading the memory stats stops the world, so it's done at most this often,
+// regardless of how often metrics are collected.
+const memStatsInterval = 15 * time.Second
+
+// memStats caches runtime.MemStats between reads.
+type memStats struct {
+	lock  sync.Mutex
+	read  time.Time
+	stats runtime.MemStats
+}
+
+func (m *memStats) get(now time.Time) runtime.MemStats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if now.Sub(m.read) >= memStatsInterval {
+		runtime.ReadMemStats(&m.stats)
+		m.read = now
+	}
+	return m.stats
+}
+
+// runtimeMetrics reports the health of the process itself, to catch goroutine
+// and memory leaks in long running deployments.
+func runtimeMetrics(meter metric.Meter) error {
+	goroutines, err := meter.AsyncInt64().Gauge(
+		"process/goroutines",
+		instrument.WithDescription("Number of goroutines that currently exist."))
+	if err != nil {
+		return fmt.Errorf("failed to create metric: %w", err)
+	}
+
+	heap, err := meter.AsyncInt64().Gauge(
+		"process/heap_alloc",
+		instrument.WithUnit(unit.Bytes),
+		instrument.WithDescription("Bytes of allocated heap objects."))
+	if err != nil {
+		return fmt.Errorf("failed to create metric: %w", err)
+	}
+
+	mem := &memStats{}
+	return meter.RegisterCallback([]instrument.Asynchronous{goroutines, heap}, func(ctx context.Context) {
+		goroutines.Observe(ctx, int64(runtime.NumGoroutine()))
+		stats := mem.get(time.Now())
+		heap.Observe(ctx, int64(stats.HeapAlloc))
+	})
+}
@@ -1,7 +1,12 @@
 package telemetry
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel/exporters/prometheus"
@@ -10,46 +15,94 @@ import (
 	"go.opentelemetry.io/otel/sdk/metric/aggregation"
 )
 
+var (
+	exporterFlag = flag.String("metrics-exporter",
+		"prometheus",
+		"Where metrics are exported: 'prometheus' serves them on /metrics, 'push' pushes them to the pushgateway at --push-url, 'otlp' pushes them to the collector configured by the OTEL_EXPORTER_OTLP_* environment variables.")
+)
+
+// Time allowed to flush metrics on shutdown.
+const shutdownTimeout = 5 * time.Second
+
 func nothing() {}
 
-func Setup() (func(), error) {
-	metricsCleanup, err := metrics()
+// Setup installs the metrics exporter. Latency histograms use the bucket
+// boundaries, or the default ones if empty.
+func Setup(buckets []float64) (func(), error) {
+	selector := overrideSelector(buckets)
+
+	var metricsCleanup func()
+	var err error
+	switch *exporterFlag {
+	case "prometheus":
+		metricsCleanup, err = metrics(selector)
+	case "push":
+		metricsCleanup, err = pushMetrics(selector)
+	case "otlp":
+		metricsCleanup, err = otlpMetrics(selector)
+	default:
+		err = fmt.Errorf("unknown metrics exporter: %q", *exporterFlag)
+	}
 	if err != nil {
 		return nothing, err
 	}
 	return metricsCleanup, nil
 }
 
-// metrics attaches the prometheus collector to the default http server.
-func metrics() (func(), error) {
+// metrics attaches the prometheus collector to the default http server. The
+// cleanup shuts down the provider, flushing any pending metrics.
+func metrics(selector metric.AggregationSelector) (func(), error) {
 	exporter, err := prometheus.New(
 		prometheus.WithoutUnits(),
-		prometheus.WithAggregationSelector(overrideSelector))
+		prometheus.WithAggregationSelector(selector))
 	if err != nil {
 		return nothing, err
 	}
 	provider := metric.NewMeterProvider(metric.WithReader(exporter))
 	http.Handle("/metrics", promhttp.Handler())
+	return install(provider)
+}
+
+// install makes the provider the global one, so that every meter of the app
+// records into it. The cleanup shuts down the provider.
+func install(provider *metric.MeterProvider) (func(), error) {
 	global.SetMeterProvider(provider)
 
-	// Need to shutdown the default http server.
-	return nothing, nil
+	shutdown := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Error("failed to shutdown metrics provider", "err", err)
+		}
+	}
+
+	if err := runtimeMetrics(provider.Meter("netmon")); err != nil {
+		return shutdown, err
+	}
+
+	return shutdown, nil
 }
 
-func overrideSelector(ik metric.InstrumentKind) aggregation.Aggregation {
-	if ik != metric.InstrumentKindSyncHistogram {
-		return metric.DefaultAggregationSelector(ik)
+// For better resolution at the low end (where we hope latency stays), change
+// the histogram collections to squeeze an extra two buckets in.
+// Constrasted with the default: {0, 5, 10, 25, 50, 75, 100, 250, 500, 1000}
+var defaultBoundaries = []float64{0, 2, 4, 8, 15, 25, 50, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000}
+
+// overrideSelector returns a selector that uses the boundaries for histograms,
+// or the default boundaries if there are none.
+func overrideSelector(boundaries []float64) metric.AggregationSelector {
+	if len(boundaries) == 0 {
+		boundaries = defaultBoundaries
 	}
-	// For better resolution at the low end (where we hope latency stays), change
-	// the histogram collections to squeeze an extra two buckets in.
-	//
-	// TODO: Ideally this would be configured on the latency metric itself.
-	// It does not appear the otel library supports this (yet?).
-	return aggregation.ExplicitBucketHistogram{
-		// Constrasted with the default: {0, 5, 10, 25, 50, 75, 100, 250, 500, 1000}
-		Boundaries: []float64{0, 2, 4, 8, 15, 25, 50, 100, 250, 500, 750, 1000, 2500, 5000, 7500, 10000},
-		NoMinMax:   false,
+	return func(ik metric.InstrumentKind) aggregation.Aggregation {
+		if ik != metric.InstrumentKindSyncHistogram {
+			return metric.DefaultAggregationSelector(ik)
+		}
+		// TODO: Ideally this would be configured on the latency metric itself.
+		// It does not appear the otel library supports this (yet?).
+		return aggregation.ExplicitBucketHistogram{
+			Boundaries: boundaries,
+			NoMinMax:   false,
+		}
 	}
 }
-
-var _ metric.AggregationSelector = overrideSelector
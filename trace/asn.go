@@ -0,0 +1,107 @@
+package trace
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// How long the autonomous system of an address is cached for. Routes
+	// are announced by the same system for months, and the sources are
+	// slow or rate limited.
+	asCacheTTL = 24 * time.Hour
+	// Failed lookups are most likely transient, and retried sooner.
+	asFailureCacheTTL = 10 * time.Minute
+	// Time allowed to look up the autonomous system of each hop.
+	asLookupTimeout = 2 * time.Second
+)
+
+// AS is an autonomous system, the network of a single operator.
+type AS struct {
+	// Zero if unknown.
+	Number uint32
+	// Name of the organization operating the system, empty if unknown.
+	Org string
+}
+
+// ASSource looks up the autonomous system that announces an address.
+type ASSource interface {
+	// LookupAS returns the zero AS if no system announces the address.
+	LookupAS(ctx context.Context, addr netip.Addr) (AS, error)
+}
+
+// Annotator sets the autonomous system of the hops of traced routes, and
+// caches the lookups since most routes share their first hops. A nil
+// Annotator doesn't annotate anything. Safe for concurrent use.
+type Annotator struct {
+	source ASSource
+
+	lock  sync.Mutex
+	cache map[netip.Addr]asEntry
+}
+
+type asEntry struct {
+	as      AS
+	expires time.Time
+}
+
+func NewAnnotator(source ASSource) *Annotator {
+	return &Annotator{
+		source: source,
+		cache:  make(map[netip.Addr]asEntry),
+	}
+}
+
+// Annotate looks up the autonomous system of every hop of the route. Hops
+// that didn't respond, have private addresses or fail to look up are left
+// without one.
+func (a *Annotator) Annotate(ctx context.Context, res *TraceResult) {
+	if a == nil {
+		return
+	}
+	for i := range res.Hops {
+		addr := res.Hops[i].Addr.Unmap()
+		if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+			continue
+		}
+		res.Hops[i].AS = a.lookup(ctx, addr, time.Now())
+	}
+}
+
+func (a *Annotator) lookup(ctx context.Context, addr netip.Addr, now time.Time) AS {
+	a.lock.Lock()
+	e, ok := a.cache[addr]
+	a.lock.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.as
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, asLookupTimeout)
+	as, err := a.source.LookupAS(lookupCtx, addr)
+	cancel()
+	ttl := asCacheTTL
+	if err != nil {
+		slog.Debug("autonomous system lookup failed", "addr", addr, "err", err)
+		if ctx.Err() != nil {
+			// Not the fault of the source, try again next time.
+			return AS{}
+		}
+		ttl = asFailureCacheTTL
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for cached, e := range a.cache {
+		if now.After(e.expires) {
+			delete(a.cache, cached)
+		}
+	}
+	a.cache[addr] = asEntry{
+		as:      as,
+		expires: now.Add(ttl),
+	}
+	return as
+}
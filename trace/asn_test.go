@@ -0,0 +1,108 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+type countingSource struct {
+	lookups map[netip.Addr]int
+	err     error
+}
+
+func (s *countingSource) LookupAS(ctx context.Context, addr netip.Addr) (AS, error) {
+	s.lookups[addr] += 1
+	if s.err != nil {
+		return AS{}, s.err
+	}
+	return AS{Number: 13335, Org: "CLOUDFLARENET, US"}, nil
+}
+
+func Test_Annotator(t *testing.T) {
+	source := &countingSource{lookups: make(map[netip.Addr]int)}
+	a := NewAnnotator(source)
+
+	public := netip.MustParseAddr("1.1.1.1")
+	private := netip.MustParseAddr("192.168.1.1")
+	res := &TraceResult{
+		Hops: []Hop{{Addr: private}, {}, {Addr: public}},
+	}
+	a.Annotate(context.Background(), res)
+	a.Annotate(context.Background(), res)
+
+	if res.Hops[0].AS != (AS{}) || res.Hops[1].AS != (AS{}) {
+		t.Errorf("expected private and unknown hops to not be annotated: %v", res.Hops)
+	}
+	if res.Hops[2].AS.Number != 13335 {
+		t.Errorf("expected public hop to be annotated: %v", res.Hops[2])
+	}
+	if n := source.lookups[public]; n != 1 {
+		t.Errorf("expected the lookup to be cached, looked up %d times", n)
+	}
+	if n := source.lookups[private]; n != 0 {
+		t.Errorf("expected private address to not be looked up, looked up %d times", n)
+	}
+}
+
+func Test_Annotator_CachesFailures(t *testing.T) {
+	source := &countingSource{lookups: make(map[netip.Addr]int), err: errors.New("failed")}
+	a := NewAnnotator(source)
+
+	public := netip.MustParseAddr("1.1.1.1")
+	res := &TraceResult{Hops: []Hop{{Addr: public}}}
+	a.Annotate(context.Background(), res)
+	a.Annotate(context.Background(), res)
+	if n := source.lookups[public]; n != 1 {
+		t.Errorf("expected the failure to be cached, looked up %d times", n)
+	}
+}
+
+func Test_Annotator_Nil(t *testing.T) {
+	var a *Annotator
+	res := &TraceResult{Hops: []Hop{{Addr: netip.MustParseAddr("1.1.1.1")}}}
+	a.Annotate(context.Background(), res)
+	if res.Hops[0].AS != (AS{}) {
+		t.Errorf("expected nil annotator to not annotate: %v", res.Hops)
+	}
+}
+
+func Test_cymruOriginName(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":            "4.3.2.1.origin.asn.cymru.com.",
+		"::ffff:1.2.3.4":     "4.3.2.1.origin.asn.cymru.com.",
+		"2001:db8::567:89ab": "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.origin6.asn.cymru.com.",
+	}
+	for addr, want := range tests {
+		if got := cymruOriginName(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("cymruOriginName(%s) = %s, want %s", addr, got, want)
+		}
+	}
+}
+
+func Test_parseCymruOrigin(t *testing.T) {
+	number, err := parseCymruOrigin([]string{
+		"3356 | 8.0.0.0/9 | US | arin | 1992-12-01",
+		"15169 36040 | 8.8.8.0/24 | US | arin | 1992-12-01",
+	})
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if number != 15169 {
+		t.Errorf("got %d, want 15169", number)
+	}
+
+	for _, txt := range []string{"", "15169", "x | 8.8.8.0/24", "15169 | nope"} {
+		if _, err := parseCymruOrigin([]string{txt}); err == nil {
+			t.Errorf("expected error for %q", txt)
+		}
+	}
+}
+
+func Test_parseCymruOrg(t *testing.T) {
+	org := parseCymruOrg([]string{"13335 | US | arin | 2010-07-14 | CLOUDFLARENET, US"})
+	if org != "CLOUDFLARENET, US" {
+		t.Errorf("got %q", org)
+	}
+}
@@ -0,0 +1,144 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// CymruSource looks up autonomous systems with the DNS interface of the Team
+// Cymru IP to ASN mapping service, https://www.team-cymru.com/ip-asn-mapping.
+type CymruSource struct {
+	Resolver *net.Resolver
+}
+
+var _ ASSource = CymruSource{}
+
+func (c CymruSource) LookupAS(ctx context.Context, addr netip.Addr) (AS, error) {
+	txts, err := c.Resolver.LookupTXT(ctx, cymruOriginName(addr))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return AS{}, nil
+		}
+		return AS{}, err
+	}
+	number, err := parseCymruOrigin(txts)
+	if err != nil || number == 0 {
+		return AS{}, err
+	}
+
+	// The name of the organization is best effort, the number is what
+	// matters.
+	as := AS{Number: number}
+	if txts, err := c.Resolver.LookupTXT(ctx, fmt.Sprintf("AS%d.asn.cymru.com.", number)); err == nil {
+		as.Org = parseCymruOrg(txts)
+	}
+	return as, nil
+}
+
+// cymruOriginName returns the name of the TXT record with the origin of the
+// address, the address reversed like for a PTR record.
+func cymruOriginName(addr netip.Addr) string {
+	addr = addr.Unmap()
+	var b strings.Builder
+	bytes := addr.AsSlice()
+	for i := len(bytes) - 1; i >= 0; i-- {
+		if addr.Is4() {
+			fmt.Fprintf(&b, "%d.", bytes[i])
+		} else {
+			fmt.Fprintf(&b, "%x.%x.", bytes[i]&0xF, bytes[i]>>4)
+		}
+	}
+	if addr.Is4() {
+		b.WriteString("origin.asn.cymru.com.")
+	} else {
+		b.WriteString("origin6.asn.cymru.com.")
+	}
+	return b.String()
+}
+
+// parseCymruOrigin returns the autonomous system of the most specific prefix
+// in the origin records, which look like:
+//
+//	13335 | 1.1.1.0/24 | AU | apnic | 2011-08-11
+//
+// Prefixes announced by several systems list all of them, the first is used.
+func parseCymruOrigin(txts []string) (uint32, error) {
+	var number uint32
+	bits := -1
+	for _, txt := range txts {
+		fields := strings.Split(txt, "|")
+		if len(fields) < 2 {
+			return 0, fmt.Errorf("malformed origin record: %q", txt)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return 0, fmt.Errorf("malformed origin record: %q", txt)
+		}
+		systems := strings.Fields(fields[0])
+		if len(systems) == 0 {
+			return 0, fmt.Errorf("malformed origin record: %q", txt)
+		}
+		n, err := strconv.ParseUint(systems[0], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("malformed origin record: %q", txt)
+		}
+		if prefix.Bits() > bits {
+			number = uint32(n)
+			bits = prefix.Bits()
+		}
+	}
+	return number, nil
+}
+
+// parseCymruOrg returns the organization in the autonomous system records,
+// which look like:
+//
+//	13335 | US | arin | 2010-07-14 | CLOUDFLARENET, US
+func parseCymruOrg(txts []string) string {
+	for _, txt := range txts {
+		fields := strings.Split(txt, "|")
+		if len(fields) >= 5 {
+			return strings.TrimSpace(fields[len(fields)-1])
+		}
+	}
+	return ""
+}
+
+// MMDBSource looks up autonomous systems in a MaxMind database of them, like
+// GeoLite2-ASN.
+type MMDBSource struct {
+	reader *maxminddb.Reader
+}
+
+var _ ASSource = &MMDBSource{}
+
+func OpenMMDB(path string) (*MMDBSource, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open mmdb: %w", err)
+	}
+	return &MMDBSource{reader: reader}, nil
+}
+
+func (m *MMDBSource) LookupAS(_ context.Context, addr netip.Addr) (AS, error) {
+	var record struct {
+		Number uint32 `maxminddb:"autonomous_system_number"`
+		Org    string `maxminddb:"autonomous_system_organization"`
+	}
+	if err := m.reader.Lookup(net.IP(addr.AsSlice()), &record); err != nil {
+		return AS{}, err
+	}
+	return AS{Number: record.Number, Org: record.Org}, nil
+}
+
+func (m *MMDBSource) Close() error {
+	return m.reader.Close()
+}
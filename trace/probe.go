@@ -0,0 +1,184 @@
+package trace
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/icmp"
+
+	xicmp "golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// prober sends the probe packets of a trace, and recognizes the icmp
+// messages sent in response to them.
+type prober interface {
+	setTTL(ttl int) error
+	// setTOS sets the type of service of the probes.
+	setTOS(tos int) error
+	// send sends a new probe, and returns the key that identifies it.
+	send(dest netip.Addr) (key int, err error)
+	// match returns the key of the probe the message is a response to, and
+	// if it was sent by the destination.
+	match(msg *xicmp.Message) (key int, reached bool, ok bool)
+	Close() error
+}
+
+// echoProber probes with icmp echo requests.
+type echoProber struct {
+	conn *xicmp.PacketConn
+	echo xicmp.Echo
+}
+
+func newEchoProber(source netip.Addr, seq int) (*echoProber, error) {
+	conn, err := icmp.Listen(source)
+	if err != nil {
+		return nil, fmt.Errorf("icmp socket listen failed: %w", err)
+	}
+
+	var portId int
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		portId = addr.Port
+	} else {
+		slog.Warn("traceroute could not determine UDP port number, only detecting packets via random sequence number")
+	}
+
+	return &echoProber{
+		conn: conn,
+		echo: xicmp.Echo{
+			// Can't be set by us, but the UDP port is used by the kernel to populate it.
+			// Setting it to that port ourselves makes it easier to reason about.
+			ID:   portId,
+			Seq:  seq, // incremented later.
+			Data: []byte("github.com/VolatileDream"),
+		},
+	}, nil
+}
+
+func (p *echoProber) setTTL(ttl int) error {
+	return setTTL(p.conn, ttl)
+}
+
+func (p *echoProber) setTOS(tos int) error {
+	return icmp.SetTOS(p.conn, tos)
+}
+
+func (p *echoProber) send(dest netip.Addr) (int, error) {
+	// Sequence numbers are only 16 bits on the wire.
+	p.echo.Seq = (p.echo.Seq + 1) & 0xFFFF
+	return p.echo.Seq, icmp.SendIcmpEcho(p.conn, &p.echo, dest)
+}
+
+func (p *echoProber) match(msg *xicmp.Message) (int, bool, bool) {
+	var parseFn func(*xicmp.Message) (*xicmp.Echo, error)
+
+	reached := false
+	if msg.Type == ipv4.ICMPTypeTimeExceeded || msg.Type == ipv6.ICMPTypeTimeExceeded {
+		parseFn = parseInnerMsg
+	} else if msg.Type == ipv4.ICMPTypeDestinationUnreachable || msg.Type == ipv6.ICMPTypeDestinationUnreachable {
+		parseFn = parseInnerMsg
+	} else if msg.Type == ipv4.ICMPTypeEchoReply || msg.Type == ipv6.ICMPTypeEchoReply {
+		parseFn = parseEchoReply
+		reached = true
+	} else {
+		slog.Debug("unexpected icmp type", "type", msg.Type, "body", fmt.Sprintf("%#v", msg.Body))
+		return 0, false, false
+	}
+
+	recvMsg, err := parseFn(msg)
+	if err != nil {
+		// failed to parse ignore it.
+		slog.Debug("could not extract icmp echo from received packet", "err", err)
+		return 0, false, false
+	}
+
+	if p.echo.ID != recvMsg.ID {
+		return 0, false, false
+	}
+	return recvMsg.Seq, reached, true
+}
+
+func (p *echoProber) Close() error {
+	return p.conn.Close()
+}
+
+// Destination unreachable codes for an unreachable port.
+const (
+	portUnreachable4 = 3
+	portUnreachable6 = 4
+)
+
+// udpProber probes with udp packets, sent to a different port each time so
+// that responses can be told apart by the quoted destination port.
+type udpProber struct {
+	conn *net.UDPConn
+	// Local port the probes are sent from.
+	port int
+	// Destination port of the last probe, every probe uses a new port.
+	dstPort int
+}
+
+func newUDPProber(source netip.Addr) (*udpProber, error) {
+	network := "udp6"
+	if source.Is4() {
+		network = "udp4"
+	}
+	conn, err := net.ListenUDP(network, net.UDPAddrFromAddrPort(netip.AddrPortFrom(source, 0)))
+	if err != nil {
+		return nil, fmt.Errorf("udp socket listen failed: %w", err)
+	}
+	return &udpProber{
+		conn:    conn,
+		port:    conn.LocalAddr().(*net.UDPAddr).Port,
+		dstPort: traceroutePort - 1, // incremented later.
+	}, nil
+}
+
+func (p *udpProber) setTOS(tos int) error {
+	if p.conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		return ipv4.NewConn(p.conn).SetTOS(tos)
+	}
+	return ipv6.NewConn(p.conn).SetTrafficClass(tos)
+}
+
+func (p *udpProber) setTTL(ttl int) error {
+	if p.conn.LocalAddr().(*net.UDPAddr).IP.To4() != nil {
+		return ipv4.NewConn(p.conn).SetTTL(ttl)
+	}
+	return ipv6.NewConn(p.conn).SetHopLimit(ttl)
+}
+
+func (p *udpProber) send(dest netip.Addr) (int, error) {
+	p.dstPort += 1
+	_, err := p.conn.WriteToUDPAddrPort([]byte("github.com/VolatileDream"), netip.AddrPortFrom(dest, uint16(p.dstPort)))
+	return p.dstPort, err
+}
+
+func (p *udpProber) match(msg *xicmp.Message) (int, bool, bool) {
+	reached := false
+	if msg.Type == ipv4.ICMPTypeDestinationUnreachable || msg.Type == ipv6.ICMPTypeDestinationUnreachable {
+		// Nothing listens on the high ports, so the destination responds
+		// with port unreachable. Other codes come from routers on the way.
+		reached = (msg.Type == ipv4.ICMPTypeDestinationUnreachable && msg.Code == portUnreachable4) ||
+			(msg.Type == ipv6.ICMPTypeDestinationUnreachable && msg.Code == portUnreachable6)
+	} else if msg.Type != ipv4.ICMPTypeTimeExceeded && msg.Type != ipv6.ICMPTypeTimeExceeded {
+		return 0, false, false
+	}
+
+	src, dst, err := parseInnerUDP(msg)
+	if err != nil {
+		slog.Debug("could not extract udp header from received packet", "err", err)
+		return 0, false, false
+	}
+	if src != p.port {
+		return 0, false, false
+	}
+	return dst, reached, true
+}
+
+func (p *udpProber) Close() error {
+	return p.conn.Close()
+}
@@ -20,20 +20,20 @@ package trace
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/netip"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/VolatileDream/workbench/web/network-monitor/icmp"
 
 	xicmp "golang.org/x/net/icmp"
-	"golang.org/x/net/ipv4"
-	"golang.org/x/net/ipv6"
 )
 
 const (
@@ -48,8 +48,21 @@ const (
 )
 
 var (
-	errNotTtlPacket     = fmt.Errorf("not a ttl exceeded packet")
-	errNotDstUnreachPkt = fmt.Errorf("not a destination unreachable packet")
+	// Shared by all traces that don't provide their own source, seeded once so
+	// that rapid successive traces don't pick correlated sequence numbers.
+	defaultRandLock sync.Mutex
+	defaultRand     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Mode is the kind of probe packet a trace sends.
+type Mode int
+
+const (
+	// ModeICMP sends ICMP echo requests.
+	ModeICMP Mode = iota
+	// ModeUDP sends UDP packets to incrementing high ports, like the
+	// classic traceroute. Some middleboxes drop ICMP echo but not UDP.
+	ModeUDP
 )
 
 type TraceRouteOptions struct {
@@ -65,21 +78,51 @@ type TraceRouteOptions struct {
 	HopTimeout time.Duration
 	// Local IP interface to bind to, only used if Valid.
 	Interface netip.Addr
+	// Rand is used to select the starting sequence number of the probes.
+	// Not safe to share between concurrent traces.
+	// Default: a package level source, seeded at startup.
+	Rand *rand.Rand
+	// Mode selects the kind of probe packets to send.
+	// Default: ModeICMP
+	Mode Mode
+	// Parallelism is the number of hops to probe at the same time. The
+	// probes are matched to their hops, so the result is the same.
+	// Default: 1
+	Parallelism int
+	// DSCP marks the probes with a differentiated services code point.
+	// Default: 0, unmarked
+	DSCP int
 }
 
 type TraceResult struct {
 	Source netip.Addr
 	Dest   netip.Addr
+	// The first hop is the source.
+	Hops []Hop
+}
+
+// Hop is a router on the traced route.
+type Hop struct {
 	// Will not be Valid if the hop is unknown.
-	Hops []netip.Addr
+	Addr netip.Addr
+	// Autonomous system the address belongs to, only set once annotated,
+	// see Annotator.
+	AS AS
 }
 
-func TraceRoute(ctx context.Context, dest netip.Addr, opts TraceRouteOptions) (*TraceResult, error) {
-	r := rand.New(rand.NewSource(time.Now().UnixMicro()))
+// Addrs returns the address of every hop of the route.
+func (r *TraceResult) Addrs() []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(r.Hops))
+	for _, hop := range r.Hops {
+		addrs = append(addrs, hop.Addr)
+	}
+	return addrs
+}
 
+func TraceRoute(ctx context.Context, dest netip.Addr, opts TraceRouteOptions) (*TraceResult, error) {
 	result := &TraceResult{
 		Dest: dest,
-		Hops: make([]netip.Addr, 0, DefaultTTL),
+		Hops: make([]Hop, 0, DefaultTTL),
 	}
 	if opts.Interface.IsValid() {
 		result.Source = opts.Interface
@@ -103,28 +146,25 @@ func TraceRoute(ctx context.Context, dest netip.Addr, opts TraceRouteOptions) (*
 	}
 
 	// First hop is always the source.
-	result.Hops = append(result.Hops, result.Source)
-
-	udpConn, err := icmp.Listen(result.Source)
-	defer udpConn.Close()
-	if err != nil {
-		return nil, fmt.Errorf("icmp socket listen failed: %w", err)
+	result.Hops = append(result.Hops, Hop{Addr: result.Source})
+
+	var p prober
+	switch opts.Mode {
+	case ModeICMP:
+		p, err = newEchoProber(result.Source, initialSequence(opts))
+	case ModeUDP:
+		p, err = newUDPProber(result.Source)
+	default:
+		err = fmt.Errorf("unknown mode: %d", opts.Mode)
 	}
-
-	var portId int
-	if addr, ok := udpConn.LocalAddr().(*net.UDPAddr); ok {
-		portId = addr.Port
-	} else {
-		log.Printf("traceroute could not determine UDP port number, only detecting packets via random sequence number\n")
+	if err != nil {
+		return nil, err
 	}
-
-	echo := xicmp.Echo{
-		// Can't be set by us, but the UDP port is used by the kernel to populate it.
-		// Setting it to that port ourselves makes it easier to reason about.
-		ID:   portId,
-		Seq:  r.Int() & 0xFFFF, // incremented later.
-		Data: []byte("github.com/VolatileDream"),
-		//Data: []byte("@@@@@@"),
+	defer p.Close()
+	if opts.DSCP != 0 {
+		if err := p.setTOS(icmp.TOS(opts.DSCP)); err != nil {
+			return nil, fmt.Errorf("could not set tos: %w", err)
+		}
 	}
 
 	tries := defaultRetries
@@ -140,104 +180,161 @@ func TraceRoute(ctx context.Context, dest netip.Addr, opts TraceRouteOptions) (*
 		maxHops = opts.MaxHops
 	}
 
-trace_hops:
-	for ttl := 1; ttl < maxHops; ttl++ {
-		err = setTTL(udpConn, ttl)
-		if err != nil {
-			return nil, fmt.Errorf("failed to set ttl to %d: %w", ttl, err)
-		}
+	parallelism := 1
+	if opts.Parallelism > 0 {
+		parallelism = opts.Parallelism
+	}
+
+	t := &tracer{
+		prober:     p,
+		dest:       result.Dest,
+		hopTimeout: hopTimeout,
+		probes:     make(map[int]*hopProbe),
+		keys:       make(map[int]int),
+	}
+	// Indexed by ttl, the hop for ttl zero is the source.
+	hops := make([]netip.Addr, maxHops)
+	// The last ttl to probe, lowered once the destination is reached.
+	lastTTL := maxHops - 1
+	nextTTL := 1
 
-		found := false
-		attemptDeadline := time.Now().Add(time.Duration(tries) * hopTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
 
-		for attempt := 0; attempt < tries && !found && time.Now().Before(attemptDeadline); attempt++ {
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			default:
+		for len(t.probes) < parallelism && nextTTL <= lastTTL {
+			t.probes[nextTTL] = &hopProbe{}
+			if err := t.send(nextTTL); err != nil {
+				return nil, err
 			}
+			nextTTL++
+		}
+		if len(t.probes) == 0 {
+			break
+		}
 
-			echo.Seq += 1
-			//log.Printf("sending ID: %d, Seq: %d, ttl:%d\n", echo.ID, echo.Seq, ttl)
-			err := icmp.SendIcmpEcho(udpConn, &echo, result.Dest)
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
-					return nil, fmt.Errorf("traceroute failed: %w", err)
-				}
-				// do something reasonable.
-				//log.Printf("icmp send err: %+v\n", err)
-				continue
+		icmpConn.SetReadDeadline(t.deadline())
+		addr, msg, err := icmp.ReadIcmp(icmpConn)
+		if err != nil {
+			// Most errors are probably timeouts.
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				// do something reasonable...
+				slog.Debug("icmp read error", "err", err)
 			}
-
-			hopDeadline := time.Now().Add(hopTimeout)
-			icmpConn.SetReadDeadline(hopDeadline)
-
-			for !found {
-				// Continue to read packets until we hit the deadline.
-				select {
-				case <-ctx.Done():
-					return nil, ctx.Err()
-				default:
-				}
-
-				addr, msg, err := icmp.ReadIcmp(icmpConn)
-				if err != nil {
-					// Most errors are probably timeouts.
-					if !errors.Is(err, os.ErrDeadlineExceeded) {
-						// do something reasonable...
-						log.Printf("icmp read err: %+v\n", err)
-					} else {
-						//log.Printf("icmp read timeout: %+v\n", err)
+		} else if ttl, reached, ok := t.match(msg); ok {
+			hops[ttl] = addr
+			if reached && ttl < lastTTL {
+				// Probes past the destination are answered by it too.
+				lastTTL = ttl
+				for pending := range t.probes {
+					if pending > lastTTL {
+						delete(t.probes, pending)
 					}
-					break
 				}
+			}
+		}
 
-				// TODO: This packets we don't want. Filter other message types better.
+		if err := t.retry(tries); err != nil {
+			return nil, err
+		}
+	}
 
-				var parseFn func(*xicmp.Message) (*xicmp.Echo, error)
+	for _, addr := range hops[1 : lastTTL+1] {
+		result.Hops = append(result.Hops, Hop{Addr: addr})
+	}
+	return result, nil
+}
 
-				if msg.Type == ipv4.ICMPTypeTimeExceeded || msg.Type == ipv6.ICMPTypeTimeExceeded {
-					parseFn = parseInnerMsg
-				} else if msg.Type == ipv4.ICMPTypeDestinationUnreachable || msg.Type == ipv6.ICMPTypeDestinationUnreachable {
-					parseFn = parseInnerMsg
+// tracer tracks the probes of a trace that are waiting for a response.
+type tracer struct {
+	prober     prober
+	dest       netip.Addr
+	hopTimeout time.Duration
 
-				} else if msg.Type == ipv4.ICMPTypeEchoReply || msg.Type == ipv6.ICMPTypeEchoReply {
-					parseFn = parseEchoReply
-				} else {
-					log.Printf("unexpected icmp type %v: %#v\n", msg.Type, msg.Body)
-					continue
-				}
+	// Probes waiting for a response, by ttl.
+	probes map[int]*hopProbe
+	// The ttl of every probe sent, by the key the prober identifies it by.
+	keys map[int]int
+}
 
-				recvMsg, err := parseFn(msg)
-				if err != nil {
-					// failed to parse ignore it.
-					log.Printf("could not extract icmp echo from received packet: %w", err)
-					continue
-				}
+type hopProbe struct {
+	attempts int
+	deadline time.Time
+}
 
-				if echo.ID != recvMsg.ID || echo.Seq != recvMsg.Seq {
-					// Packet not for us.
-					//log.Printf("ignoring recv ID: %d, Seq: %d\n", recvMsg.ID, recvMsg.Seq)
-					continue
-				}
+// send sends a probe for the ttl, which must be in probes.
+func (t *tracer) send(ttl int) error {
+	if err := t.prober.setTTL(ttl); err != nil {
+		return fmt.Errorf("failed to set ttl to %d: %w", ttl, err)
+	}
 
-				//log.Printf("recv with match ID: %d, Seq: %d, from: %v\n", recvMsg.ID, recvMsg.Seq, addr)
-				found = true
-				result.Hops = append(result.Hops, addr)
+	probe := t.probes[ttl]
+	probe.attempts += 1
+	probe.deadline = time.Now().Add(t.hopTimeout)
 
-				if msg.Type == ipv4.ICMPTypeEchoReply || msg.Type == ipv6.ICMPTypeEchoReply {
-					break trace_hops
-				}
-			} // read loop
-		} // write loop
+	key, err := t.prober.send(t.dest)
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return fmt.Errorf("traceroute failed: %w", err)
+		}
+		// Retried once the probe times out.
+		return nil
+	}
+	t.keys[key] = ttl
+	return nil
+}
 
-		if !found {
-			log.Printf("Hop %d not found...\n", ttl)
-			result.Hops = append(result.Hops, netip.Addr{})
+// deadline returns when the next probe times out.
+func (t *tracer) deadline() time.Time {
+	var deadline time.Time
+	for _, probe := range t.probes {
+		if deadline.IsZero() || probe.deadline.Before(deadline) {
+			deadline = probe.deadline
 		}
-	} // hop loop
+	}
+	return deadline
+}
 
-	return result, nil
+// match returns the ttl of the waiting probe the message responds to.
+func (t *tracer) match(msg *xicmp.Message) (int, bool, bool) {
+	key, reached, ok := t.prober.match(msg)
+	if !ok {
+		return 0, false, false
+	}
+	ttl, ok := t.keys[key]
+	if !ok {
+		return 0, false, false
+	}
+	delete(t.keys, key)
+	if _, waiting := t.probes[ttl]; !waiting {
+		// Already answered by another attempt, or given up on.
+		return 0, false, false
+	}
+	delete(t.probes, ttl)
+	return ttl, reached, true
+}
+
+// retry sends the probes that timed out again, or gives up on them after the
+// number of tries.
+func (t *tracer) retry(tries int) error {
+	now := time.Now()
+	for ttl, probe := range t.probes {
+		if now.Before(probe.deadline) {
+			continue
+		}
+		if probe.attempts >= tries {
+			slog.Debug("hop not found", "ttl", ttl)
+			delete(t.probes, ttl)
+			continue
+		}
+		if err := t.send(ttl); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func ResolveHops(ctx context.Context, addrs []netip.Addr, addrTimeout time.Duration) ([][]string, error) {
@@ -259,7 +356,7 @@ func ResolveHops(ctx context.Context, addrs []netip.Addr, addrTimeout time.Durat
 		cancel()
 
 		if err != nil {
-			log.Printf("name resolution failed: %v\n", err)
+			slog.Debug("hop name resolution failed", "addr", addr, "err", err)
 			results = append(results, nil)
 		} else {
 			results = append(results, s)
@@ -268,6 +365,16 @@ func ResolveHops(ctx context.Context, addrs []netip.Addr, addrTimeout time.Durat
 	return results, nil
 }
 
+// initialSequence picks the first sequence number to use for a trace.
+func initialSequence(opts TraceRouteOptions) int {
+	if opts.Rand != nil {
+		return opts.Rand.Int() & 0xFFFF
+	}
+	defaultRandLock.Lock()
+	defer defaultRandLock.Unlock()
+	return defaultRand.Int() & 0xFFFF
+}
+
 func sameIpType(one, two netip.Addr) bool {
 	return one.Is4() == two.Is4() || one.Is4In6() == two.Is4In6() || one.Is6() == two.Is6()
 }
@@ -282,52 +389,25 @@ func setTTL(conn *xicmp.PacketConn, ttl int) error {
 }
 
 func parseInnerMsg(m *xicmp.Message) (*xicmp.Echo, error) {
-	var data []byte
-	if m.Type == ipv4.ICMPTypeTimeExceeded || m.Type == ipv6.ICMPTypeTimeExceeded {
-		te, ok := m.Body.(*xicmp.TimeExceeded)
-		if !ok {
-			return nil, errNotTtlPacket
-		}
-		data = te.Data
-	} else if m.Type == ipv4.ICMPTypeDestinationUnreachable || m.Type == ipv6.ICMPTypeDestinationUnreachable {
-		du, ok := m.Body.(*xicmp.DstUnreach)
-		if !ok {
-			return nil, errNotDstUnreachPkt
-		}
-		data = du.Data
-	}
-
-	var protocol int
-	var offset int
-
-	// Handle ipv4
-	switch m.Type.(type) {
-	case ipv4.ICMPType:
-		h, err := ipv4.ParseHeader(data)
-		if err != nil {
-			return nil, fmt.Errorf("no ip4 header: %w", err)
-		}
-
-		protocol = 1
-		offset = h.Len + len(h.Options)
-
-	case ipv6.ICMPType:
-		// Handle ipv6
-		protocol = 58
-		offset = ipv6.HeaderLen
-	}
+	_, echo, err := icmp.QuotedEcho(m)
+	return echo, err
+}
 
-	// This message is TRUNCATED.
-	prevMsg, err := xicmp.ParseMessage(protocol, data[offset:])
+// parseInnerUDP returns the source and destination ports of the udp packet
+// quoted in the icmp error message.
+func parseInnerUDP(m *xicmp.Message) (int, int, error) {
+	_, data, err := icmp.QuotedPacket(m)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse contents: %w", err)
+		return 0, 0, err
 	}
-
-	if prevMsg.Type != ipv4.ICMPTypeEcho && prevMsg.Type != ipv6.ICMPTypeEchoRequest {
-		return nil, fmt.Errorf("contents not icmp echo")
+	// Only the first 8 bytes are guaranteed to be quoted, which covers the
+	// whole udp header.
+	if len(data) < 4 {
+		return 0, 0, fmt.Errorf("quoted udp header too short: %d bytes", len(data))
 	}
-
-	return prevMsg.Body.(*xicmp.Echo), nil
+	src := int(binary.BigEndian.Uint16(data[0:2]))
+	dst := int(binary.BigEndian.Uint16(data[2:4]))
+	return src, dst, nil
 }
 
 func parseEchoReply(m *xicmp.Message) (*xicmp.Echo, error) {
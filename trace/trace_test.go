@@ -0,0 +1,206 @@
+package trace
+
+import (
+	"math/rand"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	xicmp "golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func Test_InitialSequence_InjectedSourceIsDeterministic(t *testing.T) {
+	first := initialSequence(TraceRouteOptions{
+		Rand: rand.New(rand.NewSource(42)),
+	})
+	second := initialSequence(TraceRouteOptions{
+		Rand: rand.New(rand.NewSource(42)),
+	})
+	if first != second {
+		t.Errorf("expected identical sequences from identical seeds: %d != %d", first, second)
+	}
+
+	if want := rand.New(rand.NewSource(42)).Int() & 0xFFFF; first != want {
+		t.Errorf("got sequence %d, want %d", first, want)
+	}
+}
+
+func Test_InitialSequence_FitsInSixteenBits(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	for i := 0; i < 1000; i++ {
+		if seq := initialSequence(TraceRouteOptions{Rand: r}); seq < 0 || seq > 0xFFFF {
+			t.Fatalf("sequence out of range: %d", seq)
+		}
+	}
+	if seq := initialSequence(TraceRouteOptions{}); seq < 0 || seq > 0xFFFF {
+		t.Fatalf("default sequence out of range: %d", seq)
+	}
+}
+
+func Test_ParseInnerUDP(t *testing.T) {
+	h := ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + 8,
+		TTL:      1,
+		Protocol: 17,
+		Src:      net.IPv4(192, 168, 1, 2),
+		Dst:      net.IPv4(8, 8, 8, 8),
+	}
+	data, err := h.Marshal()
+	if err != nil {
+		t.Fatalf("failed to marshal header: %v", err)
+	}
+	// Source port 40000, destination port 33435, length, checksum.
+	data = append(data, 0x9c, 0x40, 0x82, 0x9b, 0, 8, 0, 0)
+
+	m := &xicmp.Message{
+		Type: ipv4.ICMPTypeTimeExceeded,
+		Body: &xicmp.TimeExceeded{Data: data},
+	}
+	src, dst, err := parseInnerUDP(m)
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if src != 40000 || dst != 33435 {
+		t.Errorf("got ports %d -> %d, want 40000 -> 33435", src, dst)
+	}
+
+	m.Body = &xicmp.TimeExceeded{Data: data[:ipv4.HeaderLen+2]}
+	if _, _, err := parseInnerUDP(m); err == nil {
+		t.Errorf("expected truncated udp header to fail")
+	}
+}
+
+func Test_ParseInnerMsg_IPv6ExtensionHeaders(t *testing.T) {
+	echo, err := (&xicmp.Message{
+		Type: ipv6.ICMPTypeEchoRequest,
+		Body: &xicmp.Echo{ID: 7, Seq: 1234, Data: []byte("netmon")},
+	}).Marshal(nil)
+	if err != nil {
+		t.Fatalf("failed to marshal echo: %v", err)
+	}
+
+	// Fixed header: version 6, next header hop-by-hop, hop limit 1.
+	data := make([]byte, ipv6.HeaderLen)
+	data[0] = 6 << 4
+	data[6] = 0
+	data[7] = 1
+	// Hop-by-hop options, 8 bytes, followed by a 16 byte destination options.
+	data = append(data, 60, 0, 1, 4, 0, 0, 0, 0)
+	data = append(data, 58, 1, 1, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	data = append(data, echo...)
+
+	m := &xicmp.Message{
+		Type: ipv6.ICMPTypeTimeExceeded,
+		Body: &xicmp.TimeExceeded{Data: data},
+	}
+	got, err := parseInnerMsg(m)
+	if err != nil {
+		t.Fatalf("did not expect error: %v", err)
+	}
+	if got.ID != 7 || got.Seq != 1234 {
+		t.Errorf("got echo id %d seq %d, want id 7 seq 1234", got.ID, got.Seq)
+	}
+
+	m.Body = &xicmp.TimeExceeded{Data: data[:ipv6.HeaderLen+4]}
+	if _, err := parseInnerMsg(m); err == nil {
+		t.Errorf("expected truncated extension header to fail")
+	}
+}
+
+// fakeProber hands out increasing keys, and never receives anything.
+type fakeProber struct {
+	ttl  int
+	sent []int
+}
+
+func (p *fakeProber) setTTL(ttl int) error {
+	p.ttl = ttl
+	return nil
+}
+
+func (p *fakeProber) setTOS(tos int) error {
+	return nil
+}
+
+func (p *fakeProber) send(dest netip.Addr) (int, error) {
+	p.sent = append(p.sent, p.ttl)
+	return len(p.sent), nil
+}
+
+func (p *fakeProber) match(msg *xicmp.Message) (int, bool, bool) {
+	body := msg.Body.(*xicmp.Echo)
+	return body.Seq, body.ID == 1, true
+}
+
+func (p *fakeProber) Close() error {
+	return nil
+}
+
+func Test_Tracer_MatchesProbesToTTL(t *testing.T) {
+	p := &fakeProber{}
+	tr := &tracer{
+		prober:     p,
+		dest:       netip.MustParseAddr("8.8.8.8"),
+		hopTimeout: time.Hour,
+		probes:     make(map[int]*hopProbe),
+		keys:       make(map[int]int),
+	}
+	for ttl := 1; ttl <= 3; ttl++ {
+		tr.probes[ttl] = &hopProbe{}
+		if err := tr.send(ttl); err != nil {
+			t.Fatalf("did not expect error: %v", err)
+		}
+	}
+
+	reply := func(key int, reached bool) *xicmp.Message {
+		id := 0
+		if reached {
+			id = 1
+		}
+		return &xicmp.Message{Body: &xicmp.Echo{ID: id, Seq: key}}
+	}
+
+	// Responses arrive out of order.
+	if ttl, reached, ok := tr.match(reply(3, true)); !ok || ttl != 3 || !reached {
+		t.Errorf("expected the third probe to match ttl 3, got: %d %v %v", ttl, reached, ok)
+	}
+	if ttl, _, ok := tr.match(reply(1, false)); !ok || ttl != 1 {
+		t.Errorf("expected the first probe to match ttl 1, got: %d %v", ttl, ok)
+	}
+	if _, _, ok := tr.match(reply(1, false)); ok {
+		t.Errorf("expected a duplicate response not to match")
+	}
+	if len(tr.probes) != 1 {
+		t.Errorf("expected only ttl 2 to be waiting, got: %v", tr.probes)
+	}
+}
+
+func Test_Tracer_RetriesTimedOutProbes(t *testing.T) {
+	p := &fakeProber{}
+	tr := &tracer{
+		prober:     p,
+		dest:       netip.MustParseAddr("8.8.8.8"),
+		hopTimeout: -time.Second, // Times out immediately.
+		probes:     make(map[int]*hopProbe),
+		keys:       make(map[int]int),
+	}
+	tr.probes[1] = &hopProbe{}
+	tr.send(1)
+
+	for i := 0; i < 3; i++ {
+		if err := tr.retry(2); err != nil {
+			t.Fatalf("did not expect error: %v", err)
+		}
+	}
+	if len(p.sent) != 2 {
+		t.Errorf("expected the probe to be sent twice, sent: %v", p.sent)
+	}
+	if len(tr.probes) != 0 {
+		t.Errorf("expected the probe to be given up on, got: %v", tr.probes)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/VolatileDream/workbench/web/network-monitor/config"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// Editors often write a file in several steps, wait for them to finish
+	// before reloading.
+	watchDebounce = time.Second
+)
+
+var (
+	watchConfigFlag = flag.Bool("watch-config",
+		false,
+		"Reload the config when its file changes, in addition to on SIGHUP.")
+)
+
+// watchConfig reloads the config from the source whenever the file at the path
+// changes, and sends it to cfgCh if it's different from the last config. The
+// watch stops when the context is done. Configs that fail to load are logged,
+// and the previous config stays active.
+func watchConfig(ctx context.Context, source config.ConfigSource, path string, last config.Config, cfgCh chan<- config.Config) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not watch config: %w", err)
+	}
+	// The directory is watched instead of the file, because editors and
+	// kubernetes replace the file, which ends a watch of the file itself.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("could not watch config: %w", err)
+	}
+
+	go func() {
+		defer watcher.Close()
+		debounce := time.NewTimer(watchDebounce)
+		debounce.Stop()
+		defer debounce.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if changesConfig(event, path) {
+					debounce.Reset(watchDebounce)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("error watching config", "err", err)
+			case <-debounce.C:
+				c, err := source.Load()
+				if err != nil {
+					slog.Error("failed to reload changed config, keeping the previous config", "err", err)
+					continue
+				}
+				if c.Equal(last) {
+					continue
+				}
+				slog.Info("config file changed, reloaded config")
+				last = *c
+				select {
+				case cfgCh <- *c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// changesConfig reports whether the event in the directory of the config may
+// have changed it.
+func changesConfig(event fsnotify.Event, path string) bool {
+	if event.Op == fsnotify.Chmod {
+		return false
+	}
+	if filepath.Clean(event.Name) == filepath.Clean(path) {
+		return true
+	}
+	// Kubernetes updates mounted configs by swapping a symlink to the
+	// directory with the files, named "..data".
+	return strings.HasPrefix(filepath.Base(event.Name), "..")
+}